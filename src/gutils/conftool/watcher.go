@@ -0,0 +1,45 @@
+// Copyright (C) 2019 WuPeng <wupeng364@outlook.com>.
+// Use of jsoncfg source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of jsoncfg software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and jsoncfg permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 配置工具-文件变化监听
+// 定时检查文件的修改时间和大小, 不依赖系统的文件通知
+
+package conftool
+
+import (
+	"os"
+	"time"
+)
+
+// WatchFile 监听文件变化, 修改时间或大小变化后调用onChange, 直到stop被关闭
+// 文件暂时不存在(如编辑器替换文件)时不触发, 重新出现后按变化处理
+func WatchFile(path string, interval time.Duration, onChange func(), stop <-chan struct{}) {
+	var modTime time.Time
+	var size int64
+	if st, err := os.Stat(path); nil == err {
+		modTime, size = st.ModTime(), st.Size()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			st, err := os.Stat(path)
+			if nil != err {
+				continue
+			}
+			if !st.ModTime().Equal(modTime) || st.Size() != size {
+				modTime, size = st.ModTime(), st.Size()
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (C) 2019 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 日志工具-分级和键值对字段, 输出文本或JSON格式, 每条日志一行
+
+package logtool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level 日志级别
+type Level int
+
+const (
+	// DEBUG 调试信息, 如每次数据转发
+	DEBUG Level = iota
+	// INFO 运行信息, 如启动和连接
+	INFO
+	// WARN 可以恢复的异常
+	WARN
+	// ERROR 错误
+	ERROR
+)
+
+const (
+	// FORMATTEXT 文本格式: 时间 级别 消息 key=value ...
+	FORMATTEXT = "text"
+	// FORMATJSON JSON格式, 每条日志一个JSON对象
+	FORMATJSON = "json"
+	// TIMEFORMAT 时间格式
+	TIMEFORMAT = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// String 级别名称
+func (level Level) String() string {
+	switch level {
+	case DEBUG:
+		return "DEBUG"
+	case INFO:
+		return "INFO"
+	case WARN:
+		return "WARN"
+	case ERROR:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(level)) + ")"
+}
+
+// ParseLevel 解析级别名称, 不区分大小写
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DEBUG, nil
+	case "info", "":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	}
+	return INFO, errors.New("unknown log level: " + name)
+}
+
+// ParseFormat 检查输出格式, 为空时使用文本格式
+func ParseFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case FORMATTEXT, "":
+		return FORMATTEXT, nil
+	case FORMATJSON:
+		return FORMATJSON, nil
+	}
+	return FORMATTEXT, errors.New("unknown log format: " + name)
+}
+
+// Logger 日志记录器, 并发安全
+// With 创建的子记录器共用输出和锁, 方法可以在nil上调用, 此时使用默认记录器
+type Logger struct {
+	out    io.Writer
+	level  Level
+	json   bool
+	fields []interface{} // 每条日志都带有的键值对
+	lock   *sync.Mutex
+}
+
+var (
+	defaultLogger = NewLogger(os.Stdout, INFO, FORMATTEXT)
+	defaultLock   sync.RWMutex
+)
+
+// NewLogger 创建日志记录器, 低于level的日志不输出, format为 text 或 json
+func NewLogger(out io.Writer, level Level, format string) *Logger {
+	return &Logger{out: out, level: level, json: format == FORMATJSON, lock: new(sync.Mutex)}
+}
+
+// NewFileLogger 创建输出到文件的日志记录器, 文件以追加方式打开, path为 - 时输出到标准输出
+func NewFileLogger(path string, level Level, format string) (*Logger, error) {
+	if path == "-" {
+		return NewLogger(os.Stdout, level, format), nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if nil != err {
+		return nil, err
+	}
+	return NewLogger(file, level, format), nil
+}
+
+// Default 默认日志记录器, 没有设置时输出INFO及以上级别的文本日志到标准输出
+func Default() *Logger {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault 设置默认日志记录器
+func SetDefault(logger *Logger) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	defaultLogger = logger
+}
+
+// get nil时使用默认记录器
+func (logger *Logger) get() *Logger {
+	if nil == logger {
+		return Default()
+	}
+	return logger
+}
+
+// With 创建带有固定字段的子记录器, kv为键值对
+func (logger *Logger) With(kv ...interface{}) *Logger {
+	logger = logger.get()
+	child := *logger
+	child.fields = append(append(make([]interface{}, 0, len(logger.fields)+len(kv)), logger.fields...), kv...)
+	return &child
+}
+
+// Enabled 是否输出该级别的日志, 用于避免准备不需要的字段
+func (logger *Logger) Enabled(level Level) bool {
+	return level >= logger.get().level
+}
+
+// Debug 输出调试日志
+func (logger *Logger) Debug(msg string, kv ...interface{}) {
+	logger.Log(DEBUG, msg, kv...)
+}
+
+// Info 输出运行日志
+func (logger *Logger) Info(msg string, kv ...interface{}) {
+	logger.Log(INFO, msg, kv...)
+}
+
+// Warn 输出警告日志
+func (logger *Logger) Warn(msg string, kv ...interface{}) {
+	logger.Log(WARN, msg, kv...)
+}
+
+// Error 输出错误日志
+func (logger *Logger) Error(msg string, kv ...interface{}) {
+	logger.Log(ERROR, msg, kv...)
+}
+
+// Log 输出日志, kv为键值对, 个数为奇数时最后一个值的键为 EXTRA
+func (logger *Logger) Log(level Level, msg string, kv ...interface{}) {
+	logger = logger.get()
+	if level < logger.level {
+		return
+	}
+	fields := kv
+	if len(logger.fields) > 0 {
+		fields = append(append(make([]interface{}, 0, len(logger.fields)+len(kv)), logger.fields...), kv...)
+	}
+	buf := &bytes.Buffer{}
+	if logger.json {
+		writeJSON(buf, time.Now(), level, msg, fields)
+	} else {
+		writeText(buf, time.Now(), level, msg, fields)
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.out.Write(buf.Bytes())
+}
+
+// writeText 文本格式, 包含空格、引号或等号的值加引号
+func writeText(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(now.Format(TIMEFORMAT))
+	buf.WriteString(" " + level.String() + " ")
+	buf.WriteString(quoteText(msg))
+	for i := 0; i < len(fields); i += 2 {
+		key, val := fieldAt(fields, i)
+		buf.WriteString(" " + key + "=" + quoteText(formatValue(val)))
+	}
+	buf.WriteByte('\n')
+}
+
+// writeJSON JSON格式, 字段按顺序输出
+func writeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, now.Format(TIMEFORMAT))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		key, val := fieldAt(fields, i)
+		buf.WriteByte(',')
+		writeJSONValue(buf, key)
+		buf.WriteByte(':')
+		switch v := val.(type) {
+		case error, fmt.Stringer, time.Duration:
+			writeJSONValue(buf, formatValue(v))
+		default:
+			writeJSONValue(buf, v)
+		}
+	}
+	buf.WriteString("}\n")
+}
+
+// writeJSONValue 输出JSON值, 不能编码的值输出为字符串
+func writeJSONValue(buf *bytes.Buffer, val interface{}) {
+	b, err := json.Marshal(val)
+	if nil != err {
+		b, _ = json.Marshal(fmt.Sprint(val))
+	}
+	buf.Write(b)
+}
+
+// fieldAt 取出第i个键值对
+func fieldAt(fields []interface{}, i int) (string, interface{}) {
+	if i+1 >= len(fields) {
+		return "EXTRA", fields[i]
+	}
+	key, ok := fields[i].(string)
+	if !ok {
+		key = fmt.Sprint(fields[i])
+	}
+	return key, fields[i+1]
+}
+
+// formatValue 值的文本形式
+func formatValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(val)
+}
+
+// quoteText 文本格式中需要时给值加引号
+func quoteText(val string) string {
+	if len(val) == 0 || strings.ContainsAny(val, " \t\r\n\"=") {
+		return strconv.Quote(val)
+	}
+	return val
+}
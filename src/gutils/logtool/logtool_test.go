@@ -0,0 +1,74 @@
+// Copyright (C) 2019 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package logtool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerText(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(buf, INFO, FORMATTEXT).With("serviceID", "s1")
+	logger.Debug("hidden")
+	logger.Info("client connected", "remote", "127.0.0.1:80", "err", errors.New("read: eof"), "cost", time.Second)
+	logger.Warn("odd", "last")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("line count: ", buf.String())
+	}
+	if !strings.HasSuffix(lines[0], ` INFO "client connected" serviceID=s1 remote=127.0.0.1:80 err="read: eof" cost=1s`) {
+		t.Fatal(lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " WARN odd serviceID=s1 EXTRA=last") {
+		t.Fatal(lines[1])
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(buf, DEBUG, FORMATJSON)
+	logger.With("exchengerID", "e1").Debug("pipe end", "bytes", 12, "err", errors.New("closed"))
+	res := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &res); nil != err {
+		t.Fatal(err, buf.String())
+	}
+	if res["level"] != "DEBUG" || res["msg"] != "pipe end" || res["exchengerID"] != "e1" || res["bytes"] != float64(12) || res["err"] != "closed" {
+		t.Fatal(buf.String())
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":`) {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, level := range map[string]Level{"debug": DEBUG, "INFO": INFO, "": INFO, "warn": WARN, "Error": ERROR} {
+		if res, err := ParseLevel(name); nil != err || res != level {
+			t.Fatal(name, res, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); nil == err {
+		t.Fatal("expected error")
+	}
+	if format, err := ParseFormat("JSON"); nil != err || format != FORMATJSON {
+		t.Fatal(format, err)
+	}
+	if _, err := ParseFormat("xml"); nil == err {
+		t.Fatal("expected error")
+	}
+	var logger *Logger
+	if logger.Enabled(DEBUG) || !logger.Enabled(INFO) {
+		t.Fatal("nil logger should use default")
+	}
+}
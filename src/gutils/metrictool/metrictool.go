@@ -0,0 +1,352 @@
+// Copyright (C) 2019 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 监控指标工具-Prometheus文本格式
+// 支持计数器、仪表盘、直方图和采集时计算的仪表盘, 每种指标可以有多个标签
+
+package metrictool
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry 指标注册表, 按注册顺序输出所有指标
+type Registry struct {
+	metrics []collector
+	lock    sync.Mutex
+}
+
+// collector 输出指标的文本格式
+type collector interface {
+	write(buf *bytes.Buffer)
+}
+
+// NewRegistry 创建指标注册表
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register 注册指标
+func (registry *Registry) register(metric collector) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.metrics = append(registry.metrics, metric)
+}
+
+// NewCounter 注册计数器, labels为标签名称
+func (registry *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	counter := &Counter{vec: newVec(name, help, "counter", labels)}
+	registry.register(counter)
+	return counter
+}
+
+// NewGauge 注册仪表盘, labels为标签名称
+func (registry *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	gauge := &Gauge{vec: newVec(name, help, "gauge", labels)}
+	registry.register(gauge)
+	return gauge
+}
+
+// NewGaugeFunc 注册采集时计算的仪表盘, 每次输出时调用collect, collect通过set设置每组标签的值
+func (registry *Registry) NewGaugeFunc(name, help string, labels []string, collect func(set func(value float64, labelValues ...string))) {
+	registry.register(&gaugeFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+// NewHistogram 注册直方图, buckets为升序的桶上限, +Inf桶自动添加
+func (registry *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	registry.register(histogram)
+	return histogram
+}
+
+// Text 所有指标的文本格式
+func (registry *Registry) Text() string {
+	registry.lock.Lock()
+	metrics := append([]collector(nil), registry.metrics...)
+	registry.lock.Unlock()
+	buf := &bytes.Buffer{}
+	for _, metric := range metrics {
+		metric.write(buf)
+	}
+	return buf.String()
+}
+
+// ServeHTTP 输出所有指标, 可以直接注册为 /metrics 的处理器
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(registry.Text()))
+}
+
+// Value 一组标签对应的数值, 并发安全
+type Value struct {
+	bits uint64
+}
+
+// Add 增加数值
+func (value *Value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&value.bits)
+		if atomic.CompareAndSwapUint64(&value.bits, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Set 设置数值
+func (value *Value) Set(val float64) {
+	atomic.StoreUint64(&value.bits, math.Float64bits(val))
+}
+
+// Get 获取数值
+func (value *Value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&value.bits))
+}
+
+// vec 一个指标的所有标签组合
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	series map[string]*series // key: 格式化后的标签
+	lock   sync.RWMutex
+}
+
+// series 一组标签值和对应的数据
+type series struct {
+	labelValues []string
+	value       interface{} // *Value 或 *HistogramValue
+}
+
+// newVec 创建指标
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{name: name, help: help, typ: typ, labels: labels, series: make(map[string]*series)}
+}
+
+// get 获取标签值对应的数据, 不存在时使用create创建
+// 标签值个数与标签名称不一致属于使用错误, 直接panic
+func (v *vec) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(v.labels) {
+		panic("metric " + v.name + ": expected " + strconv.Itoa(len(v.labels)) + " label values, got " + strconv.Itoa(len(labelValues)))
+	}
+	key := formatLabels(v.labels, labelValues, "", "")
+	v.lock.RLock()
+	res, ok := v.series[key]
+	v.lock.RUnlock()
+	if ok {
+		return res.value
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if res, ok = v.series[key]; !ok {
+		res = &series{labelValues: append([]string(nil), labelValues...), value: create()}
+		v.series[key] = res
+	}
+	return res.value
+}
+
+// Delete 删除一组标签的数据, 如隧道已删除
+func (v *vec) Delete(labelValues ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.series, formatLabels(v.labels, labelValues, "", ""))
+}
+
+// keys 按标签排序的所有标签组合
+func (v *vec) keys() ([]string, map[string]*series) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	keys := make([]string, 0, len(v.series))
+	res := make(map[string]*series, len(v.series))
+	for key, val := range v.series {
+		keys = append(keys, key)
+		res[key] = val
+	}
+	sort.Strings(keys)
+	return keys, res
+}
+
+// writeHeader 输出指标说明和类型
+func writeHeader(buf *bytes.Buffer, name, help, typ string) {
+	buf.WriteString("# HELP " + name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help) + "\n")
+	buf.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// writeValues 输出每组标签的数值
+func (v *vec) writeValues(buf *bytes.Buffer) {
+	writeHeader(buf, v.name, v.help, v.typ)
+	keys, all := v.keys()
+	for _, key := range keys {
+		buf.WriteString(v.name + key + " " + formatValue(all[key].value.(*Value).Get()) + "\n")
+	}
+}
+
+// Counter 计数器, 只增不减
+type Counter struct {
+	vec
+}
+
+// With 获取标签值对应的数值, 频繁更新时可以保存下来避免每次查找
+func (counter *Counter) With(labelValues ...string) *Value {
+	return counter.get(labelValues, func() interface{} { return &Value{} }).(*Value)
+}
+
+// Inc 加1
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.With(labelValues...).Add(1)
+}
+
+// Add 增加数值, delta不能为负数
+func (counter *Counter) Add(delta float64, labelValues ...string) {
+	counter.With(labelValues...).Add(delta)
+}
+
+// write 输出文本格式
+func (counter *Counter) write(buf *bytes.Buffer) {
+	counter.writeValues(buf)
+}
+
+// Gauge 仪表盘, 可增可减
+type Gauge struct {
+	vec
+}
+
+// With 获取标签值对应的数值
+func (gauge *Gauge) With(labelValues ...string) *Value {
+	return gauge.get(labelValues, func() interface{} { return &Value{} }).(*Value)
+}
+
+// Set 设置数值
+func (gauge *Gauge) Set(val float64, labelValues ...string) {
+	gauge.With(labelValues...).Set(val)
+}
+
+// Add 增加数值, delta可以为负数
+func (gauge *Gauge) Add(delta float64, labelValues ...string) {
+	gauge.With(labelValues...).Add(delta)
+}
+
+// write 输出文本格式
+func (gauge *Gauge) write(buf *bytes.Buffer) {
+	gauge.writeValues(buf)
+}
+
+// gaugeFunc 采集时计算的仪表盘
+type gaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(set func(value float64, labelValues ...string))
+}
+
+// write 调用采集函数并输出文本格式
+func (gauge *gaugeFunc) write(buf *bytes.Buffer) {
+	writeHeader(buf, gauge.name, gauge.help, "gauge")
+	lines := make([]string, 0)
+	gauge.collect(func(value float64, labelValues ...string) {
+		lines = append(lines, gauge.name+formatLabels(gauge.labels, labelValues, "", "")+" "+formatValue(value)+"\n")
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+}
+
+// Histogram 直方图, 统计数值的分布
+type Histogram struct {
+	vec
+	buckets []float64
+}
+
+// HistogramValue 一组标签对应的直方图数据, 并发安全
+type HistogramValue struct {
+	counts []uint64 // 每个桶的计数(不累加), 最后一个为+Inf
+	sum    Value
+}
+
+// With 获取标签值对应的直方图数据
+func (histogram *Histogram) With(labelValues ...string) *HistogramValue {
+	return histogram.get(labelValues, func() interface{} {
+		return &HistogramValue{counts: make([]uint64, len(histogram.buckets)+1)}
+	}).(*HistogramValue)
+}
+
+// Observe 记录一个数值
+func (histogram *Histogram) Observe(val float64, labelValues ...string) {
+	value := histogram.With(labelValues...)
+	index := sort.SearchFloat64s(histogram.buckets, val)
+	atomic.AddUint64(&value.counts[index], 1)
+	value.sum.Add(val)
+}
+
+// write 输出文本格式, 桶计数为累计值
+func (histogram *Histogram) write(buf *bytes.Buffer) {
+	writeHeader(buf, histogram.name, histogram.help, histogram.typ)
+	keys, all := histogram.keys()
+	for _, key := range keys {
+		value := all[key].value.(*HistogramValue)
+		labelValues := all[key].labelValues
+		var count uint64
+		for i := range value.counts {
+			count += atomic.LoadUint64(&value.counts[i])
+			le := "+Inf"
+			if i < len(histogram.buckets) {
+				le = formatValue(histogram.buckets[i])
+			}
+			buf.WriteString(histogram.name + "_bucket" + formatLabels(histogram.labels, labelValues, "le", le) + " " + strconv.FormatUint(count, 10) + "\n")
+		}
+		buf.WriteString(histogram.name + "_sum" + key + " " + formatValue(value.sum.Get()) + "\n")
+		buf.WriteString(histogram.name + "_count" + key + " " + strconv.FormatUint(count, 10) + "\n")
+	}
+}
+
+// formatLabels 输出标签, 如 {tunnel="web",mode="raw"}, 没有标签时返回空字符串
+// extraName不为空时追加一个标签, 用于直方图的le
+func formatLabels(labels []string, labelValues []string, extraName string, extraValue string) string {
+	if len(labels) == 0 && len(extraName) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)+1)
+	for i, name := range labels {
+		val := ""
+		if i < len(labelValues) {
+			val = labelValues[i]
+		}
+		parts = append(parts, name+`="`+escapeLabel(val)+`"`)
+	}
+	if len(extraName) > 0 {
+		parts = append(parts, extraName+`="`+escapeLabel(extraValue)+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// escapeLabel 转义标签值中的反斜杠、双引号和换行
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
+
+// formatValue 输出数值
+func formatValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
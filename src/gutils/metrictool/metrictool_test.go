@@ -0,0 +1,63 @@
+// Copyright (C) 2019 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package metrictool
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_bytes_total", "Bytes.", "tunnel", "direction")
+	gauge := registry.NewGauge("test_active", "Active sessions.", "tunnel")
+	registry.NewGaugeFunc("test_idle", "Idle conns.", []string{"tunnel"}, func(set func(float64, ...string)) {
+		set(3, "web")
+		set(1, `a"b`)
+	})
+	histogram := registry.NewHistogram("test_seconds", "Durations.", []float64{0.1, 1}, "tunnel")
+	total := registry.NewCounter("test_total", "No labels.")
+
+	counter.Add(100, "web", "sent")
+	counter.With("web", "sent").Add(20)
+	counter.Inc("ssh", "received")
+	gauge.Add(2, "web")
+	gauge.Add(-1, "web")
+	histogram.Observe(0.05, "web")
+	histogram.Observe(0.5, "web")
+	histogram.Observe(5, "web")
+	total.Inc()
+
+	text := registry.Text()
+	for _, line := range []string{
+		"# TYPE test_bytes_total counter",
+		`test_bytes_total{tunnel="ssh",direction="received"} 1`,
+		`test_bytes_total{tunnel="web",direction="sent"} 120`,
+		`test_active{tunnel="web"} 1`,
+		"# TYPE test_idle gauge",
+		`test_idle{tunnel="a\"b"} 1`,
+		`test_idle{tunnel="web"} 3`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{tunnel="web",le="0.1"} 1`,
+		`test_seconds_bucket{tunnel="web",le="1"} 2`,
+		`test_seconds_bucket{tunnel="web",le="+Inf"} 3`,
+		`test_seconds_sum{tunnel="web"} 5.55`,
+		`test_seconds_count{tunnel="web"} 3`,
+		"test_total 1",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatal("missing line: ", line, "\n", text)
+		}
+	}
+	counter.Delete("ssh", "received")
+	if strings.Contains(registry.Text(), `tunnel="ssh"`) {
+		t.Fatal("deleted series is still exported")
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// HTTP/1.1 增量报文解析器
+// 按状态机逐字节解析, 支持分段传输(含chunk扩展和trailer)、头信息不区分大小写,
+// 每次输入数据返回属于当前报文的字节数, 因此可以准确找到报文的结束位置
+
+package tcpmsgexchanger
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 解析状态
+const (
+	parseStartLine      = iota // 请求行或状态行
+	parseHeaders               // 头信息
+	parseBody                  // 固定长度的内容(Content-Length)
+	parseChunkSize             // 分段长度行
+	parseChunkData             // 分段内容
+	parseChunkDataCRLF         // 分段内容后的换行
+	parseTrailers              // 分段传输结束后的trailer
+	parseBodyUntilClose        // 没有长度的响应, 直到连接关闭
+	parseDone                  // 报文结束
+)
+
+// ErrHTTPHeaderTooLarge 头信息超过最大长度
+var ErrHTTPHeaderTooLarge = errors.New("http header too large")
+
+// ErrHTTPChunkLineTooLarge 分段长度行超过最大长度
+var ErrHTTPChunkLineTooLarge = errors.New("http chunk line too large")
+
+// HTTPParser HTTP报文解析器, 一个解析器解析一个报文
+type HTTPParser struct {
+	state         int         // 当前状态
+	line          []byte      // 未完整的行
+	headerLength  int         // 已接收的头信息长度
+	received      int64       // 已接收的字节数
+	remain        int64       // 当前内容或分段剩余的字节数
+	isResponse    bool        // 是否是响应报文
+	requestMethod string      // 响应对应的请求方法, HEAD请求的响应没有内容
+	method        string      // 请求方法
+	uri           string      // 请求地址
+	version       string      // 协议版本
+	statusCode    int         // 响应状态码
+	header        http.Header // 头信息
+}
+
+// NewHTTPParser 创建解析器, requestMethod 为解析响应时对应的请求方法, 可以为空
+func NewHTTPParser(requestMethod string) *HTTPParser {
+	return &HTTPParser{
+		requestMethod: requestMethod,
+		header:        make(http.Header),
+	}
+}
+
+// Feed 输入数据, 返回属于当前报文的字节数, 报文结束后剩余的数据属于下一个报文
+func (parser *HTTPParser) Feed(b []byte) (int, error) {
+	n := 0
+	for n < len(b) && parser.state != parseDone {
+		switch parser.state {
+		case parseBody, parseChunkData:
+			size := int64(len(b) - n)
+			if size > parser.remain {
+				size = parser.remain
+			}
+			n += int(size)
+			parser.remain -= size
+			if parser.remain == 0 {
+				if parser.state == parseBody {
+					parser.state = parseDone
+				} else {
+					parser.state = parseChunkDataCRLF
+				}
+			}
+		case parseBodyUntilClose:
+			n = len(b)
+		default:
+			// 其他状态都按行处理
+			index := bytes.IndexByte(b[n:], '\n')
+			end := len(b)
+			if index > -1 {
+				end = n + index + 1
+			}
+			// 每一种按行处理的状态都限制长度, 没有换行的数据不能无限缓存
+			if parser.state <= parseHeaders || parser.state == parseTrailers {
+				parser.headerLength += end - n
+				if parser.headerLength > HTTPHEADERMAXLENGTH {
+					return n, ErrHTTPHeaderTooLarge
+				}
+			} else if len(parser.line)+end-n > HTTPCHUNKLINEMAXLENGTH {
+				return n, ErrHTTPChunkLineTooLarge
+			}
+			parser.line = append(parser.line, b[n:end]...)
+			n = end
+			if index < 0 {
+				break
+			}
+			line := strings.TrimRight(string(parser.line), "\r\n")
+			parser.line = parser.line[:0]
+			if err := parser.parseLine(line); nil != err {
+				return n, err
+			}
+		}
+	}
+	parser.received += int64(n)
+	return n, nil
+}
+
+// parseLine 处理一个完整的行
+func (parser *HTTPParser) parseLine(line string) error {
+	switch parser.state {
+	case parseStartLine:
+		// 报文之间可能有多余的空行
+		if len(line) == 0 {
+			return nil
+		}
+		return parser.parseStartLine(line)
+	case parseHeaders:
+		if len(line) == 0 {
+			return parser.headersDone()
+		}
+		index := strings.IndexByte(line, ':')
+		if index <= 0 {
+			return errors.New("malformed http header: " + line)
+		}
+		parser.header.Add(strings.TrimSpace(line[:index]), strings.TrimSpace(line[index+1:]))
+	case parseChunkSize:
+		if index := strings.IndexByte(line, ';'); index > -1 {
+			line = line[:index]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if nil != err || size < 0 {
+			return errors.New("malformed chunk size: " + line)
+		}
+		if size == 0 {
+			parser.state = parseTrailers
+		} else {
+			parser.remain = size
+			parser.state = parseChunkData
+		}
+	case parseChunkDataCRLF:
+		if len(line) != 0 {
+			return errors.New("malformed chunk data end")
+		}
+		parser.state = parseChunkSize
+	case parseTrailers:
+		if len(line) == 0 {
+			parser.state = parseDone
+		}
+	}
+	return nil
+}
+
+// parseStartLine 解析请求行(GET / HTTP/1.1)或状态行(HTTP/1.1 200 OK)
+func (parser *HTTPParser) parseStartLine(line string) error {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 {
+		return errors.New("malformed http start line: " + line)
+	}
+	if strings.HasPrefix(fields[0], "HTTP/") {
+		code, err := strconv.Atoi(fields[1])
+		if nil != err {
+			return errors.New("malformed http status line: " + line)
+		}
+		parser.isResponse = true
+		parser.version = fields[0]
+		parser.statusCode = code
+	} else {
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+			return errors.New("malformed http request line: " + line)
+		}
+		parser.method = fields[0]
+		parser.uri = fields[1]
+		parser.version = fields[2]
+	}
+	parser.state = parseHeaders
+	return nil
+}
+
+// headersDone 头信息结束, 根据头信息决定内容的长度
+func (parser *HTTPParser) headersDone() error {
+	if parser.isResponse {
+		// 1xx, 204, 304 和 HEAD 请求的响应没有内容
+		if (parser.statusCode >= 100 && parser.statusCode < 200) || parser.statusCode == http.StatusNoContent ||
+			parser.statusCode == http.StatusNotModified || parser.requestMethod == http.MethodHead {
+			parser.state = parseDone
+			return nil
+		}
+	}
+	if encoding := parser.Header(HTTPHEADERTRANSFERENCODING); len(encoding) > 0 {
+		encodings := strings.Split(encoding, ",")
+		if strings.EqualFold(strings.TrimSpace(encodings[len(encodings)-1]), "chunked") {
+			parser.state = parseChunkSize
+			return nil
+		}
+		// 最后一个编码不是chunked的响应只能读到连接关闭
+		if parser.isResponse {
+			parser.state = parseBodyUntilClose
+			return nil
+		}
+		return errors.New("unsupported transfer encoding: " + encoding)
+	}
+	if length := parser.Header(HTTPHEADERCONTENTLENGTH); len(length) > 0 {
+		size, err := strconv.ParseInt(length, 10, 64)
+		if nil != err || size < 0 {
+			return errors.New("malformed content length: " + length)
+		}
+		parser.remain = size
+		parser.state = parseBody
+		if size == 0 {
+			parser.state = parseDone
+		}
+		return nil
+	}
+	// 没有长度的请求没有内容, 没有长度的响应读到连接关闭
+	if parser.isResponse {
+		parser.state = parseBodyUntilClose
+	} else {
+		parser.state = parseDone
+	}
+	return nil
+}
+
+// Done 报文是否已经结束
+func (parser *HTTPParser) Done() bool {
+	return parser.state == parseDone
+}
+
+// HeaderDone 头信息是否已经解析完成
+func (parser *HTTPParser) HeaderDone() bool {
+	return parser.state > parseHeaders
+}
+
+// UntilClose 报文是否需要读到连接关闭才结束
+func (parser *HTTPParser) UntilClose() bool {
+	return parser.state == parseBodyUntilClose
+}
+
+// isInterim 是否是1xx临时响应, 101表示协议切换, 不算临时响应
+func (parser *HTTPParser) isInterim() bool {
+	return parser.isResponse && parser.statusCode >= 100 && parser.statusCode < 200 &&
+		parser.statusCode != http.StatusSwitchingProtocols
+}
+
+// isUpgrade 是否是协议切换响应
+func (parser *HTTPParser) isUpgrade() bool {
+	return parser.isResponse && parser.statusCode == http.StatusSwitchingProtocols
+}
+
+// Received 已接收的字节数
+func (parser *HTTPParser) Received() int64 {
+	return parser.received
+}
+
+// IsResponse 是否是响应报文
+func (parser *HTTPParser) IsResponse() bool {
+	return parser.isResponse
+}
+
+// Method 请求方法
+func (parser *HTTPParser) Method() string {
+	return parser.method
+}
+
+// URI 请求地址
+func (parser *HTTPParser) URI() string {
+	return parser.uri
+}
+
+// Version 协议版本
+func (parser *HTTPParser) Version() string {
+	return parser.version
+}
+
+// StatusCode 响应状态码
+func (parser *HTTPParser) StatusCode() int {
+	return parser.statusCode
+}
+
+// Header 获取头信息, 名称不区分大小写, 多个同名头信息用逗号连接
+func (parser *HTTPParser) Header(name string) string {
+	return strings.Join(parser.header.Values(name), ", ")
+}
+
+// Headers 所有头信息
+func (parser *HTTPParser) Headers() http.Header {
+	return parser.header
+}
+
+// KeepAlive 报文结束后连接是否保持
+// HTTP/1.1 默认保持, 除非 Connection: close; HTTP/1.0 默认关闭, 除非 Connection: keep-alive
+func (parser *HTTPParser) KeepAlive() bool {
+	if parser.UntilClose() {
+		return false
+	}
+	connection := strings.ToLower(parser.Header(HTTPHEADERCONNECTION))
+	if strings.Contains(connection, "close") {
+		return false
+	}
+	if parser.version == "HTTP/1.0" {
+		return strings.Contains(connection, "keep-alive")
+	}
+	return true
+}
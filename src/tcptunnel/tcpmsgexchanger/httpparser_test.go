@@ -0,0 +1,195 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcpmsgexchanger
+
+import (
+	"bytes"
+	"gutils/logtool"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// feedAll 逐字节输入数据, 返回报文结束位置
+func feedAll(t *testing.T, parser *HTTPParser, data string) int {
+	for i := 0; i < len(data); i++ {
+		n, err := parser.Feed([]byte(data[i : i+1]))
+		if nil != err {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// 测试各种报文的结束位置, 管道化的下一个报文不能被当前报文消费
+func TestHTTPParser(t *testing.T) {
+	next := "GET /next HTTP/1.1\r\n\r\n"
+	cases := []struct {
+		name   string
+		method string
+		msg    string
+	}{
+		{"request", "", "GET / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{"content-length", "", "POST / HTTP/1.1\r\ncontent-length: 5\r\n\r\nhello"},
+		{"chunked", "", "HTTP/1.1 200 OK\r\nTRANSFER-ENCODING: gzip, chunked\r\n\r\n5;ext=1\r\nhello\r\n3\r\n\r\n\r\n0\r\nX-Sum: 1\r\n\r\n"},
+		{"no-content", "", "HTTP/1.1 204 No Content\r\nContent-Length: 10\r\n\r\n"},
+		{"not-modified", "", "HTTP/1.1 304 Not Modified\r\n\r\n"},
+		{"head", "HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"},
+		{"continue", "", "HTTP/1.1 100 Continue\r\n\r\n"},
+	}
+	for _, c := range cases {
+		// 整块输入
+		parser := NewHTTPParser(c.method)
+		n, err := parser.Feed([]byte(c.msg + next))
+		if nil != err || n != len(c.msg) || !parser.Done() {
+			t.Fatal(c.name, n, len(c.msg), err)
+		}
+		// 逐字节输入
+		parser = NewHTTPParser(c.method)
+		if n := feedAll(t, parser, c.msg+next); n != len(c.msg) || !parser.Done() {
+			t.Fatal(c.name, "byte by byte", n, len(c.msg))
+		}
+	}
+}
+
+// 测试没有换行的长行: 头信息和分段长度行超过最大长度时返回错误
+func TestHTTPParserLineTooLarge(t *testing.T) {
+	parser := NewHTTPParser("")
+	if _, err := parser.Feed([]byte("GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", HTTPHEADERMAXLENGTH))); err != ErrHTTPHeaderTooLarge {
+		t.Fatal("long header: ", err)
+	}
+	head := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	// 扩展在最大长度以内可以解析
+	parser = NewHTTPParser("")
+	ext := "1;" + strings.Repeat("e", HTTPCHUNKLINEMAXLENGTH-5) + "\r\n"
+	if n, err := parser.Feed([]byte(head + ext + "a\r\n0\r\n\r\n")); nil != err || !parser.Done() {
+		t.Fatal("chunk extension: ", n, err)
+	}
+	// 一次输入和分多次输入都会被限制
+	parser = NewHTTPParser("")
+	if _, err := parser.Feed([]byte(head + strings.Repeat("1", HTTPCHUNKLINEMAXLENGTH+1))); err != ErrHTTPChunkLineTooLarge {
+		t.Fatal("long chunk size: ", err)
+	}
+	parser = NewHTTPParser("")
+	parser.Feed([]byte(head + "1\r\na"))
+	var err error
+	for i := 0; i <= HTTPCHUNKLINEMAXLENGTH && nil == err; i += 1024 {
+		_, err = parser.Feed([]byte(strings.Repeat(" ", 1024)))
+	}
+	if err != ErrHTTPChunkLineTooLarge {
+		t.Fatal("long chunk data end: ", err)
+	}
+}
+
+// 测试头信息解析和连接保持
+func TestHTTPParserHeader(t *testing.T) {
+	parser := NewHTTPParser("")
+	feedAll(t, parser, "GET /a?b=c:d HTTP/1.0\r\nHost: example.com:8080\r\nCONNECTION: Keep-Alive\r\n\r\n")
+	if parser.Method() != "GET" || parser.URI() != "/a?b=c:d" || parser.Version() != "HTTP/1.0" {
+		t.Fatal("start line", parser.Method(), parser.URI(), parser.Version())
+	}
+	if parser.Header("host") != "example.com:8080" {
+		t.Fatal("host", parser.Header("host"))
+	}
+	if !parser.KeepAlive() {
+		t.Fatal("keep-alive")
+	}
+	// 没有长度的响应读到连接关闭
+	parser = NewHTTPParser("GET")
+	if n := feedAll(t, parser, "HTTP/1.1 200 OK\r\n\r\nbody"); n != 23 || parser.Done() || !parser.UntilClose() || parser.KeepAlive() {
+		t.Fatal("until close", n)
+	}
+	// 格式错误
+	if _, err := NewHTTPParser("").Feed([]byte("HTTP/1.1 OK\r\n")); nil == err {
+		t.Fatal("malformed status line")
+	}
+	if _, err := NewHTTPParser("").Feed([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n")); nil == err {
+		t.Fatal("malformed chunk size")
+	}
+}
+
+// 测试协议切换后双向转发, 切换前后已读取的数据不能丢失
+func TestHTTPExchangerUpgrade(t *testing.T) {
+	user, entry := tcpPair(t)
+	target, upstream := tcpPair(t)
+	defer user.Close()
+	defer upstream.Close()
+	go func() {
+		(&TCPExchanger4HHTTP{}).ExchangeData(entry, target)
+		entry.Close()
+		target.Close()
+	}()
+	// 请求和协议切换后的第一帧一起发送, 第一帧在切换之后才转发
+	user.Write([]byte("GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nclient-first"))
+	buf := make([]byte, 1024)
+	n, _ := upstream.Read(buf)
+	if !strings.HasSuffix(string(buf[:n]), "\r\n\r\n") {
+		t.Fatal("upstream received", string(buf[:n]))
+	}
+	upstream.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\nserver-first"))
+	n, _ = io.ReadAtLeast(user, buf, len("server-first"))
+	if !strings.HasSuffix(string(buf[:n]), "\r\n\r\nserver-first") {
+		t.Fatal("user received", string(buf[:n]))
+	}
+	if n, _ = io.ReadFull(upstream, buf[:12]); string(buf[:n]) != "client-first" {
+		t.Fatal("upstream received", string(buf[:n]))
+	}
+	// 之后的数据不再按HTTP报文解析
+	user.Write([]byte("not http"))
+	if n, _ = io.ReadFull(upstream, buf[:8]); string(buf[:n]) != "not http" {
+		t.Fatal("upstream received", string(buf[:n]))
+	}
+	upstream.Write([]byte("pong"))
+	upstream.(*net.TCPConn).CloseWrite()
+	data, _ := io.ReadAll(user)
+	if string(data) != "pong" {
+		t.Fatal("user received", string(data))
+	}
+}
+
+// 测试访问日志, 每个请求一行
+func TestHTTPExchangerAccessLog(t *testing.T) {
+	user, entry := tcpPair(t)
+	target, upstream := tcpPair(t)
+	defer user.Close()
+	defer upstream.Close()
+	buf := &bytes.Buffer{}
+	exchanger := &TCPExchanger4HHTTP{}
+	exchanger.SetAccessLog(logtool.NewLogger(buf, logtool.INFO, logtool.FORMATTEXT))
+	done := make(chan struct{})
+	go func() {
+		exchanger.ExchangeData(entry, target)
+		entry.Close()
+		target.Close()
+		close(done)
+	}()
+	go func() {
+		io.Copy(io.Discard, upstream)
+	}()
+	upstream.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokHTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+	user.Write([]byte("GET /a?b=1 HTTP/1.1\r\nHost: example.com\r\n\r\nPOST /c HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\nabc"))
+	user.(*net.TCPConn).CloseWrite()
+	io.ReadAll(user)
+	<-done
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("access log", buf.String())
+	}
+	if !strings.Contains(lines[0], ` method=GET uri="/a?b=1" host=example.com status=200 reqBytes=42 respBytes=40 `) {
+		t.Fatal(lines[0])
+	}
+	if !strings.Contains(lines[1], " method=POST uri=/c host=example.com status=404 reqBytes=61 respBytes=45 ") || !strings.Contains(lines[1], " duration=") {
+		t.Fatal(lines[1])
+	}
+}
@@ -12,50 +12,56 @@
 package tcpmsgexchanger
 
 import (
-	"fmt"
+	"gutils/logtool"
 	"gutils/strtool"
 	"io"
 	"net"
-	"strconv"
-	"strings"
+	"time"
 )
 
 const (
-	// HTTPBODYSPLITTER HTTP协议规定用回车和换行符分割数据
-	HTTPBODYSPLITTER = "\r\n\r\n"
-	// HTTPTRANSFERENCODINGENDCODE 分段传输时报文结束符号
-	HTTPTRANSFERENCODINGENDCODE = "\r\n0\r\n"
-	// HTTPHEADERCONTENTLENGTH HTTP头信息-作为报文是否结束的依据, 但有可能没有该字段
+	// HTTPHEADERCONTENTLENGTH HTTP头信息-内容长度
 	HTTPHEADERCONTENTLENGTH = "Content-Length"
 	// HTTPHEADERTRANSFERENCODING HTTP头信息-表示使用分段传输
 	HTTPHEADERTRANSFERENCODING = "Transfer-Encoding"
+	// HTTPHEADERCONNECTION HTTP头信息-连接是否保持
+	HTTPHEADERCONNECTION = "Connection"
 	// HTTPHEADERMAXLENGTH HTTP头信息最大解析长度
 	HTTPHEADERMAXLENGTH = 1024 * 1024 * 2
+	// HTTPCHUNKLINEMAXLENGTH 分段长度行(包括扩展)和分段结束换行的最大长度
+	HTTPCHUNKLINEMAXLENGTH = 4 * 1024
+	// HTTPREADBUFFERSIZE 每次读取数据的缓冲大小
+	HTTPREADBUFFERSIZE = 32 * 1024
 )
 
 // TCPExchanger4HHTTP 检查HTTP报文信息
-// 1. 是否是http报文, 2. 当前报文是否接收完成
+// 使用增量解析器找到每个报文的结束位置, 多读的数据留给下一个报文(管道化请求)
 type TCPExchanger4HHTTP struct {
-	isDebug        bool              // 是否调试输出
-	isExchange     bool              // 是否是双向交换数据
-	exchengerID    string            // 处理id
-	headerEndIndex int64             // 头信息结束位置
-	bodyEndIndex   int64             // 内容结束位置
-	headers        map[string]string // http头信息
-	receivedLength int64             // 总计接收了多少数据
-	receivedByte   []byte            // 临时缓存数据
+	logger        *logtool.Logger     // 日志, 为空时使用默认日志
+	accessLog     *logtool.Logger     // 访问日志, 为空时不记录
+	isExchange    bool                // 是否是双向交换数据
+	exchengerID   string              // 处理id
+	parser        *HTTPParser         // 最近一个报文的解析器
+	requestMethod string              // 最近一个请求的方法, 用于判断响应是否有内容
+	pending       map[net.Conn][]byte // 每个连接上已读取但属于下一个报文的数据
+	readBuf       []byte              // 读取缓冲
 }
 
-// printInfo 打印信息
-func (exchanger *TCPExchanger4HHTTP) printInfo(a ...interface{}) {
-	if exchanger.isDebug {
-		fmt.Println("["+exchanger.exchengerID+"]", a)
+// debug 输出调试日志, 带有处理id
+func (exchanger *TCPExchanger4HHTTP) debug(msg string, kv ...interface{}) {
+	if exchanger.logger.Enabled(logtool.DEBUG) {
+		exchanger.logger.With("exchengerID", exchanger.exchengerID).Debug(msg, kv...)
 	}
 }
 
-// SetDebug 设置是否输出日志
-func (exchanger *TCPExchanger4HHTTP) SetDebug(b bool) {
-	exchanger.isDebug = b
+// SetLogger 设置日志
+func (exchanger *TCPExchanger4HHTTP) SetLogger(logger *logtool.Logger) {
+	exchanger.logger = logger
+}
+
+// SetAccessLog 设置访问日志, 每个请求在收到响应后输出一行
+func (exchanger *TCPExchanger4HHTTP) SetAccessLog(logger *logtool.Logger) {
+	exchanger.accessLog = logger
 }
 
 // GetID 获取操作ID
@@ -64,174 +70,166 @@ func (exchanger *TCPExchanger4HHTTP) GetID() string {
 }
 
 // ExchangeData 双向交换数据 SRC <-> DEST, 双向交换数据, 操作id不会变
-func (exchanger *TCPExchanger4HHTTP) ExchangeData(src net.Conn, dest net.Conn) error {
+// 在同一个连接上循环转发 请求->响应, 直到SRC关闭连接或者任意一方要求关闭连接(Connection: close)
+// 响应为 101 Switching Protocols 时(如WebSocket), 改为双向同时转发直到任意一方关闭
+// 结束后关闭DEST的写入, 通知对端不会再有新的请求
+func (exchanger *TCPExchanger4HHTTP) ExchangeData(src net.Conn, dest net.Conn) (err error) {
 	exchanger.isExchange = true
 	exchanger.exchengerID = strtool.GetUUID()
-	exchanger.printInfo("SRC --> DEST(" + src.RemoteAddr().String() + " ---> " + dest.RemoteAddr().String() + ")")
-	err := exchanger.SendData(src, dest)
-	if nil != err {
-		return err
+	defer closeWrite(dest)
+	keepAlive := true
+	for nil == err && keepAlive {
+		keepAlive, err = exchanger.ExchangeRequest(src, dest)
 	}
-	exchanger.printInfo("DEST --> SRC(" + dest.RemoteAddr().String() + " ---> " + src.RemoteAddr().String() + ")")
-	return exchanger.SendData(dest, src)
+	// 连接在两次请求之间正常关闭
+	if err == io.EOF {
+		return nil
+	}
+	return err
 }
 
-// SendData 单向交换数据 SRC -> DEST, 单向交换数据, 操作id每次都不一样
-func (exchanger *TCPExchanger4HHTTP) SendData(src net.Conn, dest net.Conn) error {
-	if !exchanger.isExchange {
+// ExchangeRequest 转发一个请求和它的响应, 返回连接是否可以继续使用
+// 用于每个请求选择不同的DEST, 协议切换后双向转发直到结束, 不能继续使用
+func (exchanger *TCPExchanger4HHTTP) ExchangeRequest(src net.Conn, dest net.Conn) (bool, error) {
+	if len(exchanger.exchengerID) == 0 {
 		exchanger.exchengerID = strtool.GetUUID()
-		exchanger.printInfo("SRC --> DEST(" + src.RemoteAddr().String() + " ---> " + dest.RemoteAddr().String() + ")")
-	}
-	// 清空状态数据
-	exchanger.headerEndIndex = int64(0)
-	exchanger.bodyEndIndex = int64(0)
-	exchanger.receivedLength = int64(0)
-	exchanger.receivedByte = make([]byte, 0)
-	exchanger.headers = make(map[string]string, 0)
+	}
+	exchanger.isExchange = true
+	exchanger.debug("request start", "src", src.RemoteAddr().String(), "dest", dest.RemoteAddr().String())
+	start := time.Now()
+	err := exchanger.SendData(src, dest)
+	if nil != err {
+		return false, err
+	}
+	request := exchanger.parser
+	keepAlive := request.KeepAlive()
+	exchanger.debug("response start", "src", dest.RemoteAddr().String(), "dest", src.RemoteAddr().String())
+	err = exchanger.SendData(dest, src)
+	respBytes := exchanger.parser.Received()
+	// 1xx临时响应之后还有最终响应
+	for nil == err && exchanger.parser.isInterim() {
+		err = exchanger.SendData(dest, src)
+		respBytes += exchanger.parser.Received()
+	}
+	exchanger.logAccess(src, request, exchanger.parser, respBytes, time.Since(start), err)
+	if nil != err {
+		return false, err
+	}
+	// 协议切换后不再是HTTP报文, 改为双向同时转发
+	if exchanger.parser.isUpgrade() {
+		return false, exchanger.upgrade(src, dest)
+	}
+	return keepAlive && exchanger.parser.KeepAlive(), nil
+}
 
-	for {
-		// 从SRC机器读取数据
-		byteSrc := make([]byte, HTTPHEADERMAXLENGTH)
-		nSrc, errSrc := src.Read(byteSrc)
-		if nil != errSrc {
-			if errSrc != io.EOF {
-				exchanger.printInfo(errSrc)
-				return errSrc
-			}
-			break
-		}
-		// 先发送回去一些数据
-		_, errDest := dest.Write(byteSrc[:nSrc])
-		if nil != errDest {
-			exchanger.printInfo(errDest)
-			return errSrc
-		}
-		// 检查器接受数据
-		exchanger.receive(byteSrc[:nSrc])
-		// 检查是否接受完毕
-		if exchanger.isEnd() {
-			break
-		}
+// logAccess 输出一个请求的访问日志, 协议切换时只记录到切换为止
+func (exchanger *TCPExchanger4HHTTP) logAccess(src net.Conn, request, response *HTTPParser, respBytes int64, duration time.Duration, err error) {
+	if nil == exchanger.accessLog {
+		return
 	}
-	return nil
+	kv := []interface{}{
+		"remote", src.RemoteAddr().String(),
+		"method", request.Method(),
+		"uri", request.URI(),
+		"host", request.Header("Host"),
+		"status", response.StatusCode(),
+		"reqBytes", request.Received(),
+		"respBytes", respBytes,
+		"duration", duration,
+	}
+	if nil != err {
+		kv = append(kv, "err", err)
+	}
+	exchanger.accessLog.Info("access", kv...)
 }
 
-// receive 接受字节, 用于刷新状态
-func (exchanger *TCPExchanger4HHTTP) receive(bt []byte) {
-	// 累加接受的字节数
-	receivedStr := string(bt)
-	exchanger.printInfo("检查器接收到的长度:", exchanger.receivedLength, len(bt))
-	exchanger.receivedLength = exchanger.receivedLength + int64(len(bt))
-	//exchanger.printInfo( receivedStr )
-	// 如果没有解析过头, 则需要解析头信息
-	if exchanger.headerEndIndex <= 0 {
-		exchanger.receivedByte = append(exchanger.receivedByte, bt[:len(bt)]...)
-		receivedHeaderStr := string(exchanger.receivedByte)
-		// 第一个换行符 - 请求行+头信息
-		exchanger.headerEndIndex = int64(strings.Index(receivedHeaderStr, HTTPBODYSPLITTER))
-		if exchanger.headerEndIndex > -1 {
-			exchanger.printInfo("扫描Header信息!")
-			// 保存头信息
-			exchanger.headers = exchanger.str2Headers(receivedHeaderStr[:exchanger.headerEndIndex])
-			exchanger.receivedByte = make([]byte, 0)
-		} else {
-			// 这个包有可能是HTTPBody, 或者其他协议, 如果一直接受下去内存可能会爆炸
-			// 我们假设头信息不会超过2M, 如果超过这个长度报文缓存, 那我们则丢弃清空
-			// 同时由于之前可能没有接受到头信息, 所以Body结束位置只能每次都判断计算
-			if len(exchanger.receivedByte) >= HTTPHEADERMAXLENGTH {
-				exchanger.receivedByte = make([]byte, 0)
-				// > -1 说明是分段传输,检查到结束符号 0\r\n\r\n
-				exchanger.bodyEndIndex = int64(strings.Index(receivedStr, HTTPTRANSFERENCODINGENDCODE))
-				exchanger.printInfo("分段传输结束符检查-无头:", exchanger.bodyEndIndex)
-				if exchanger.bodyEndIndex < 0 {
-					// 普通结束符号
-					exchanger.bodyEndIndex = int64(strings.LastIndex(receivedStr, HTTPBODYSPLITTER))
-					exchanger.printInfo("标准结束符检查-无头:", exchanger.bodyEndIndex)
-				}
-				// 在同一个包内的位置
-				if exchanger.bodyEndIndex > 0 && exchanger.receivedLength > int64(len(bt)) {
-					exchanger.bodyEndIndex = exchanger.receivedLength + exchanger.bodyEndIndex
-				}
-			}
+// Pending 取出连接上已读取但还没有转发的数据(管道化的下一个请求)
+func (exchanger *TCPExchanger4HHTTP) Pending(conn net.Conn) []byte {
+	buf := exchanger.pending[conn]
+	delete(exchanger.pending, conn)
+	return buf
+}
 
+// upgrade 协议切换(101 Switching Protocols), 先发送已读取的剩余数据, 然后双向同时转发直到任意一方关闭
+func (exchanger *TCPExchanger4HHTTP) upgrade(src net.Conn, dest net.Conn) error {
+	exchanger.debug("protocol upgraded, exchange both directions")
+	if buf := exchanger.pending[src]; len(buf) > 0 {
+		if _, err := dest.Write(buf); nil != err {
+			return err
 		}
 	}
-	// 如果头信息解析好了, 则需要扫描是否存在结束换行符
-	if exchanger.headerEndIndex > 0 {
-		// 检查是否有Transfer-Encoding: chunked, 说明是分段传输, 需要判断结束符号 0\r\n\r\n
-		if val, exist := exchanger.headers[HTTPHEADERTRANSFERENCODING]; exist && strings.Replace(val, " ", "", -1) == "chunked" {
-			// > -1 说明是分段传输,检查到结束符号 0\r\n\r\n
-			exchanger.bodyEndIndex = int64(strings.Index(receivedStr, HTTPTRANSFERENCODINGENDCODE))
-			exchanger.printInfo("分段传输结束符检查:", exchanger.bodyEndIndex)
-		} else {
-			// 普通结束符号
-			exchanger.bodyEndIndex = int64(strings.LastIndex(receivedStr, HTTPBODYSPLITTER))
-			exchanger.printInfo("标准结束符检查:", exchanger.bodyEndIndex)
-		}
-		// 在同一个包内的位置
-		if exchanger.bodyEndIndex > 0 && exchanger.receivedLength > int64(len(bt)) {
-			exchanger.bodyEndIndex = exchanger.receivedLength + exchanger.bodyEndIndex
+	if buf := exchanger.pending[dest]; len(buf) > 0 {
+		if _, err := src.Write(buf); nil != err {
+			return err
 		}
 	}
+	exchanger.pending = nil
+	raw := &TCPExchanger4Raw{logger: exchanger.logger, exchengerID: exchanger.exchengerID}
+	return raw.exchange(src, dest)
 }
 
-// isEnd 消息体是否结束了
-func (exchanger *TCPExchanger4HHTTP) isEnd() bool {
-	// 是否接受到头信息
-	if exchanger.headerEndIndex <= 0 {
-		return false
-	}
-	// 1. 如果有头信息
-	// 检查是否有 Content-Length 设置
-	if val, exist := exchanger.headers[HTTPHEADERCONTENTLENGTH]; exist {
-		// 获取一次, 内容长度
-		length, err := strconv.ParseInt(strings.Replace(val, " ", "", -1), 10, 64)
-		if nil != err {
-			fmt.Println(err)
-			return true
-		}
-		// 当前数据长度是否大于 Content-Length长度 + 头信息下标 + 头信息分隔符长度
-		exchanger.printInfo("Content-Length长度检查:", exchanger.receivedLength, length, exchanger.headerEndIndex, len(HTTPBODYSPLITTER))
-		if exchanger.receivedLength >= int64(length)+int64(exchanger.headerEndIndex)+int64(len(HTTPBODYSPLITTER)) {
-			exchanger.printInfo("Content-Length长度检查通过!")
-			return true
+// SendData 单向交换数据 SRC -> DEST, 单向交换数据, 操作id每次都不一样
+// 只转发一个完整的报文, 报文之后多读的数据会在下次从SRC读取时先发送
+func (exchanger *TCPExchanger4HHTTP) SendData(src net.Conn, dest net.Conn) error {
+	if !exchanger.isExchange {
+		exchanger.exchengerID = strtool.GetUUID()
+		exchanger.debug("send start", "src", src.RemoteAddr().String(), "dest", dest.RemoteAddr().String())
+	}
+	if nil == exchanger.pending {
+		exchanger.pending = make(map[net.Conn][]byte)
+		exchanger.readBuf = make([]byte, HTTPREADBUFFERSIZE)
+	}
+	parser := NewHTTPParser(exchanger.requestMethod)
+	exchanger.parser = parser
+	buf := exchanger.pending[src]
+	delete(exchanger.pending, src)
+	for !parser.Done() {
+		if len(buf) == 0 {
+			// 从SRC机器读取数据
+			nSrc, errSrc := src.Read(exchanger.readBuf)
+			if nil != errSrc {
+				if errSrc != io.EOF {
+					exchanger.debug("read failed", "err", errSrc)
+					return errSrc
+				}
+				// 还没有收到任何数据就关闭了, 说明没有新的报文
+				if parser.Received() == 0 {
+					return io.EOF
+				}
+				// 没有长度的响应以连接关闭作为结束
+				if parser.UntilClose() {
+					break
+				}
+				exchanger.debug("message incomplete", "received", parser.Received())
+				return io.ErrUnexpectedEOF
+			}
+			buf = exchanger.readBuf[:nSrc]
 		}
-		return false
-	}
-	// 2. 如果没有指定内容长度
-	// 检查是否发现了结束符
-	if exchanger.bodyEndIndex > 0 {
-		exchanger.printInfo("Body结束符检查:", exchanger.bodyEndIndex, exchanger.headerEndIndex)
-		// 如果开始和结束位置相等, 则需要判断这段数据是否一共就只有这么长
-		if exchanger.bodyEndIndex == exchanger.headerEndIndex {
-			if exchanger.receivedLength == int64(exchanger.bodyEndIndex)+int64(len(HTTPBODYSPLITTER)) {
-				exchanger.printInfo("Body结束符检查通过!")
-				return true // 数据就这么长了
+		// 解析器只消费属于当前报文的数据
+		n, errParse := parser.Feed(buf)
+		if n > 0 {
+			if _, errDest := dest.Write(buf[:n]); nil != errDest {
+				exchanger.debug("write failed", "err", errDest)
+				return errDest
 			}
-
-		} else if exchanger.bodyEndIndex > exchanger.headerEndIndex {
-			exchanger.printInfo("Body结束符检查通过!")
-			return true
 		}
+		if nil != errParse {
+			exchanger.debug("parse failed", "err", errParse)
+			return errParse
+		}
+		buf = buf[n:]
 	}
-	return false
-}
-
-// str2Headers 获取头信息
-func (exchanger *TCPExchanger4HHTTP) str2Headers(body string) map[string]string {
-	res := make(map[string]string, 0)
-	if len(body) > 0 {
-		// 每个头信息占一行
-		lines := strings.Split(body, "\r\n")
-		for i := 0; i < len(lines); i++ {
-			// 判断是否是头信息行
-			if strings.Index(lines[i], ":") > -1 {
-				line := strings.Split(lines[i], ":")
-				// 替换头信息空格 并  分割字符
-				res[line[0]] = line[1]
-			}
+	// 保存属于下一个报文的数据, 缓冲区下次读取会被覆盖, 需要复制一份
+	if len(buf) > 0 {
+		exchanger.pending[src] = append([]byte(nil), buf...)
+	}
+	if parser.IsResponse() {
+		if !parser.isInterim() {
+			exchanger.requestMethod = ""
 		}
-
+	} else {
+		exchanger.requestMethod = parser.Method()
 	}
-	return res
+	exchanger.debug("message sent", "received", parser.Received())
+	return nil
 }
@@ -0,0 +1,69 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcpmsgexchanger
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// 测试长连接和管道化: 一个连接上的请求依次转发, 上一个响应完成后才转发下一个请求, Connection: close 的响应之后结束
+func TestHTTPExchangerKeepAlive(t *testing.T) {
+	user, entry := tcpPair(t)
+	target, upstream := tcpPair(t)
+	defer user.Close()
+	defer upstream.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- (&TCPExchanger4HHTTP{}).ExchangeData(entry, target)
+		entry.Close()
+		target.Close()
+	}()
+	first := "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	second := "POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\nConnection: close\r\n\r\nabc"
+	// 两个请求一起发送
+	user.Write([]byte(first + second))
+	buf := make([]byte, 1024)
+	if n, _ := io.ReadFull(upstream, buf[:len(first)]); string(buf[:n]) != first {
+		t.Fatal("upstream received", string(buf[:n]))
+	}
+	// 第一个响应之前不转发第二个请求
+	upstream.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := upstream.Read(buf); nil == err {
+		t.Fatal("second request is sent before the first response", string(buf[:n]))
+	}
+	upstream.SetReadDeadline(time.Time{})
+	firstResp := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	upstream.Write([]byte(firstResp))
+	if n, _ := io.ReadFull(user, buf[:len(firstResp)]); string(buf[:n]) != firstResp {
+		t.Fatal("user received", string(buf[:n]))
+	}
+	if n, _ := io.ReadFull(upstream, buf[:len(second)]); string(buf[:n]) != second {
+		t.Fatal("upstream received", string(buf[:n]))
+	}
+	secondResp := "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"
+	upstream.Write([]byte(secondResp))
+	if n, _ := io.ReadFull(user, buf[:len(secondResp)]); string(buf[:n]) != secondResp {
+		t.Fatal("user received", string(buf[:n]))
+	}
+	// 请求要求关闭连接, 转发结束并关闭上游的写入
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exchange does not end after Connection: close")
+	}
+	if data, _ := io.ReadAll(upstream); len(data) != 0 {
+		t.Fatal("upstream received", string(data))
+	}
+}
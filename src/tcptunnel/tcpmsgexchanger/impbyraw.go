@@ -0,0 +1,88 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 原始TCP数据交换器, 不解析协议, 双向同时转发
+
+package tcpmsgexchanger
+
+import (
+	"gutils/logtool"
+	"gutils/strtool"
+	"io"
+	"net"
+)
+
+// TCPExchanger4Raw 原始TCP数据交换
+// 两个方向同时转发, 一个方向读取结束后关闭另一端的写入, 两个方向都结束后返回
+type TCPExchanger4Raw struct {
+	logger      *logtool.Logger // 日志, 为空时使用默认日志
+	exchengerID string          // 处理id
+}
+
+// debug 输出调试日志, 带有处理id
+func (exchanger *TCPExchanger4Raw) debug(msg string, kv ...interface{}) {
+	if exchanger.logger.Enabled(logtool.DEBUG) {
+		exchanger.logger.With("exchengerID", exchanger.exchengerID).Debug(msg, kv...)
+	}
+}
+
+// SetLogger 设置日志
+func (exchanger *TCPExchanger4Raw) SetLogger(logger *logtool.Logger) {
+	exchanger.logger = logger
+}
+
+// GetID 获取操作ID
+func (exchanger *TCPExchanger4Raw) GetID() string {
+	return exchanger.exchengerID
+}
+
+// ExchangeData 双向交换数据 SRC <-> DEST, 两个方向都结束后返回
+func (exchanger *TCPExchanger4Raw) ExchangeData(src net.Conn, dest net.Conn) error {
+	exchanger.exchengerID = strtool.GetUUID()
+	exchanger.debug("exchange start", "src", src.RemoteAddr().String(), "dest", dest.RemoteAddr().String())
+	return exchanger.exchange(src, dest)
+}
+
+// exchange 两个方向同时转发, 两个方向都结束后返回
+// 一个方向出错(如连接被关闭)时关闭两端, 另一个方向不再等待对端关闭
+func (exchanger *TCPExchanger4Raw) exchange(src net.Conn, dest net.Conn) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- exchanger.pipe(src, dest)
+	}()
+	go func() {
+		errs <- exchanger.pipe(dest, src)
+	}()
+	var err error
+	for i := 0; i < 2; i++ {
+		if e := <-errs; nil != e && nil == err {
+			err = e
+			src.Close()
+			dest.Close()
+		}
+	}
+	return err
+}
+
+// SendData 单向交换数据 SRC -> DEST, 读取结束后关闭DEST的写入
+func (exchanger *TCPExchanger4Raw) SendData(src net.Conn, dest net.Conn) error {
+	exchanger.exchengerID = strtool.GetUUID()
+	exchanger.debug("send start", "src", src.RemoteAddr().String(), "dest", dest.RemoteAddr().String())
+	return exchanger.pipe(src, dest)
+}
+
+// pipe 转发数据直到SRC读取结束, 然后关闭DEST的写入
+func (exchanger *TCPExchanger4Raw) pipe(src net.Conn, dest net.Conn) error {
+	n, err := io.Copy(dest, src)
+	exchanger.debug("pipe end", "src", src.RemoteAddr().String(), "bytes", n, "err", err)
+	if e := closeWrite(dest); nil == err {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcpmsgexchanger
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair 创建一对相连的TCP连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// 测试单向关闭: 一端关闭写入后另一个方向继续转发, 两个方向都结束后返回
+func TestRawExchangerHalfClose(t *testing.T) {
+	user, entry := tcpPair(t)
+	target, upstream := tcpPair(t)
+	defer user.Close()
+	defer upstream.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- (&TCPExchanger4Raw{}).ExchangeData(entry, target)
+		entry.Close()
+		target.Close()
+	}()
+	user.Write([]byte("request"))
+	user.(*net.TCPConn).CloseWrite()
+	// 上游读到请求后收到EOF
+	data, err := io.ReadAll(upstream)
+	if nil != err || string(data) != "request" {
+		t.Fatal("upstream received", string(data), err)
+	}
+	// 另一个方向仍然可以写入
+	upstream.Write([]byte("response"))
+	buf := make([]byte, len("response"))
+	if n, _ := io.ReadFull(user, buf); string(buf[:n]) != "response" {
+		t.Fatal("user received", string(buf[:n]))
+	}
+	select {
+	case err := <-done:
+		t.Fatal("returned before both directions ended: ", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	upstream.Write([]byte("-end"))
+	upstream.(*net.TCPConn).CloseWrite()
+	data, err = io.ReadAll(user)
+	if nil != err || string(data) != "-end" {
+		t.Fatal("user received", string(data), err)
+	}
+	select {
+	case err := <-done:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exchange does not end after both sides closed")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// UDP数据交换器, 隧道连接上每个数据报前面加2字节长度, 与UDP连接的数据报一一对应
+
+package tcpmsgexchanger
+
+import (
+	"encoding/binary"
+	"errors"
+	"gutils/logtool"
+	"gutils/strtool"
+	"io"
+	"net"
+)
+
+const (
+	// UDPMAXLEN 数据报最大长度
+	UDPMAXLEN = 65535
+	// UDPHEADERLEN 隧道连接上数据报的长度头
+	UDPHEADERLEN = 2
+)
+
+// WriteDatagram 写入一个数据报, 长度头和数据一次写入
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > UDPMAXLEN {
+		return errors.New("datagram too large")
+	}
+	buf := make([]byte, UDPHEADERLEN+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[UDPHEADERLEN:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram 读取一个数据报到buf, buf长度不能小于 UDPMAXLEN
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	header := make([]byte, UDPHEADERLEN)
+	if _, err := io.ReadFull(r, header); nil != err {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, buf[:length]); nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return length, nil
+}
+
+// TCPExchanger4UDP UDP数据交换
+// SRC是承载数据报的隧道连接, DEST是连接到目标的UDP连接
+type TCPExchanger4UDP struct {
+	logger      *logtool.Logger // 日志, 为空时使用默认日志
+	exchengerID string          // 处理id
+}
+
+// debug 输出调试日志, 带有处理id
+func (exchanger *TCPExchanger4UDP) debug(msg string, kv ...interface{}) {
+	if exchanger.logger.Enabled(logtool.DEBUG) {
+		exchanger.logger.With("exchengerID", exchanger.exchengerID).Debug(msg, kv...)
+	}
+}
+
+// SetLogger 设置日志
+func (exchanger *TCPExchanger4UDP) SetLogger(logger *logtool.Logger) {
+	exchanger.logger = logger
+}
+
+// GetID 获取操作ID
+func (exchanger *TCPExchanger4UDP) GetID() string {
+	return exchanger.exchengerID
+}
+
+// ExchangeData 双向交换数据 SRC <-> DEST, SRC读取结束(会话结束)后关闭DEST
+// DEST出错后关闭SRC的写入, 通知对端结束会话
+func (exchanger *TCPExchanger4UDP) ExchangeData(src net.Conn, dest net.Conn) error {
+	exchanger.exchengerID = strtool.GetUUID()
+	exchanger.debug("exchange start", "src", src.RemoteAddr().String(), "dest", dest.RemoteAddr().String())
+	errs := make(chan error, 2)
+	go func() {
+		err := exchanger.toDatagram(src, dest)
+		dest.Close()
+		errs <- err
+	}()
+	go func() {
+		err := exchanger.fromDatagram(dest, src)
+		closeWrite(src)
+		errs <- err
+	}()
+	var err error
+	for i := 0; i < 2; i++ {
+		if e := <-errs; nil != e && nil == err {
+			err = e
+		}
+	}
+	return err
+}
+
+// SendData 单向交换数据 SRC -> DEST, 把SRC上的数据报逐个发送到DEST, 直到SRC读取结束
+func (exchanger *TCPExchanger4UDP) SendData(src net.Conn, dest net.Conn) error {
+	exchanger.exchengerID = strtool.GetUUID()
+	exchanger.debug("send start", "src", src.RemoteAddr().String(), "dest", dest.RemoteAddr().String())
+	return exchanger.toDatagram(src, dest)
+}
+
+// toDatagram 读取隧道连接上的数据报, 发送到UDP连接
+func (exchanger *TCPExchanger4UDP) toDatagram(src net.Conn, dest net.Conn) error {
+	buf := make([]byte, UDPMAXLEN)
+	for {
+		n, err := ReadDatagram(src, buf)
+		if nil != err {
+			exchanger.debug("datagram end", "err", err)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if _, err := dest.Write(buf[:n]); nil != err {
+			return err
+		}
+	}
+}
+
+// fromDatagram 读取UDP连接上的数据报, 写入隧道连接, UDP连接被关闭时正常结束
+func (exchanger *TCPExchanger4UDP) fromDatagram(dest net.Conn, src net.Conn) error {
+	buf := make([]byte, UDPMAXLEN)
+	for {
+		n, err := dest.Read(buf)
+		if nil != err {
+			exchanger.debug("datagram end", "err", err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if err := WriteDatagram(src, buf[:n]); nil != err {
+			return err
+		}
+	}
+}
@@ -10,13 +10,46 @@
 package tcpmsgexchanger
 
 import (
+	"errors"
+	"gutils/logtool"
 	"net"
 )
 
+const (
+	// MODEHTTP HTTP模式, 按HTTP报文交换数据
+	MODEHTTP = "http"
+	// MODERAW 原始TCP模式, 双向同时转发, 适用于任意TCP协议
+	MODERAW = "raw"
+	// MODEUDP UDP模式, 隧道连接承载一个来源地址的UDP数据报
+	MODEUDP = "udp"
+)
+
 // TCPMessageExchanger TCP报文交换
 type TCPMessageExchanger interface {
-	SetDebug() bool                                 // 调试
+	SetLogger(logger *logtool.Logger)               // 日志
 	GetID() string                                  // 处理id
 	SendData(src net.Conn, dest net.Conn) error     // 单向交换数据
 	ExchangeData(src net.Conn, dest net.Conn) error // 双向交换数据
 }
+
+// NewExchanger 根据模式创建数据交换器, 模式为空时使用HTTP模式
+func NewExchanger(mode string) (TCPMessageExchanger, error) {
+	switch mode {
+	case MODEHTTP, "":
+		return &TCPExchanger4HHTTP{}, nil
+	case MODERAW:
+		return &TCPExchanger4Raw{}, nil
+	case MODEUDP:
+		return &TCPExchanger4UDP{}, nil
+	default:
+		return nil, errors.New("unsupported exchange mode: " + mode)
+	}
+}
+
+// closeWrite 关闭连接的写入方向, 不支持单向关闭的连接不做处理
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 客户端配置, 由命令行参数和JSON配置文件组成, 配置文件中的值优先
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gutils/conftool"
+	"os"
+	"strings"
+	"tcptunnel/tcptunnelmanager"
+	"time"
+)
+
+// clientConfig 客户端配置
+// 服务地址、多路复用、认证、TLS、监控指标和日志配置修改后需要重启, 其他配置可以重新加载
+type clientConfig struct {
+	ServerAddr      string                      // 隧道服务地址
+	Targets         map[string]string           // 隧道目标
+	Allows          []string                    // 服务端可以指定的目标
+	AllowList       *tcptunnelmanager.AllowList // 由Allows生成的白名单
+	Forwards        map[string]string           // 反向转发的本地监听
+	Multiplex       bool                        // 是否使用多路复用模式
+	MinIdle         int64                       // 空闲连接低水位, 低于该数量时服务端通知补充
+	MaxCount        int64                       // 每个隧道保持的空闲连接数
+	MuxCount        int64                       // 多路复用模式下保持的物理连接数
+	AuthName        string                      // 认证名称
+	AuthKey         string                      // 认证密钥
+	TLS             bool                        // 是否使用TLS连接
+	TLSCA           string                      // 验证服务端证书的CA
+	TLSCert         string                      // 客户端证书
+	TLSKey          string                      // 客户端私钥
+	TLSName         string                      // 验证的服务端名称
+	MetricsAddr     string                      // 监控指标监听地址
+	LogLevel        string                      // 日志级别
+	LogFormat       string                      // 日志格式
+	Timeouts        tcptunnelmanager.Timeouts   // 各阶段的超时时间
+	Backoff         tcptunnelmanager.Backoff    // 重连的退避间隔
+	ShutdownTimeout time.Duration               // 停止时等待会话结束的最长时间
+}
+
+// needRestart 与另一个配置相比, 是否修改了需要重启才能生效的配置
+func (cfg *clientConfig) needRestart(other *clientConfig) bool {
+	return cfg.ServerAddr != other.ServerAddr || cfg.Multiplex != other.Multiplex ||
+		cfg.AuthName != other.AuthName || cfg.AuthKey != other.AuthKey ||
+		cfg.TLS != other.TLS || cfg.TLSCA != other.TLSCA || cfg.TLSCert != other.TLSCert ||
+		cfg.TLSKey != other.TLSKey || cfg.TLSName != other.TLSName || cfg.MetricsAddr != other.MetricsAddr ||
+		cfg.LogLevel != other.LogLevel || cfg.LogFormat != other.LogFormat
+}
+
+// parseTargets 解析隧道目标: 隧道名称=目标地址, 多个隧道用逗号分隔
+func parseTargets(str string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		index := strings.Index(item, "=")
+		if index <= 0 || index == len(item)-1 {
+			return nil, errors.New("tunnel format error: " + item)
+		}
+		res[item[:index]] = item[index+1:]
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no tunnel defined")
+	}
+	return res, nil
+}
+
+// loadConfigFile 读取JSON配置文件, 文件中存在的配置覆盖base中的值, base不会被修改
+// 配置项: server, tunnels, allow, forwards, mux, pool, auth, tls, metrics, log, timeouts, reconnect, 格式见README
+func loadConfigFile(path string, base *clientConfig) (cfg *clientConfig, err error) {
+	// 配置工具在文件不存在时会创建空文件, 这里要求文件必须存在
+	if st, e := os.Stat(path); nil != e || st.IsDir() {
+		return nil, errors.New("config file not found: " + path)
+	}
+	jsoncfg := &conftool.JSONCFG{}
+	if err = jsoncfg.InitConfig(path); nil != err {
+		return nil, err
+	}
+	// 配置层级和格式不对时(如需要对象的位置写成了字符串)读取会panic, 转换为错误返回
+	defer func() {
+		if e := recover(); nil != e {
+			cfg, err = nil, fmt.Errorf("config format error: %v", e)
+		}
+	}()
+	res := *base
+	res.ServerAddr = jsoncfg.GetConfig("server").ToString(res.ServerAddr)
+	if res.Targets, err = getStringMap(jsoncfg, "tunnels", res.Targets); nil != err {
+		return nil, err
+	}
+	if len(res.Targets) == 0 {
+		return nil, errors.New("no tunnel defined")
+	}
+	if val := jsoncfg.GetConfig("allow").O; nil != val {
+		items, ok := val.([]interface{})
+		if !ok {
+			return nil, errors.New("config allow must be an array")
+		}
+		res.Allows = make([]string, 0, len(items))
+		for _, item := range items {
+			rule, ok := item.(string)
+			if !ok {
+				return nil, errors.New("config allow must be an array of strings")
+			}
+			res.Allows = append(res.Allows, rule)
+		}
+		if res.AllowList, err = tcptunnelmanager.NewAllowList(res.Allows); nil != err {
+			return nil, err
+		}
+	}
+	if res.Forwards, err = getStringMap(jsoncfg, "forwards", res.Forwards); nil != err {
+		return nil, err
+	}
+	res.Multiplex = jsoncfg.GetConfig("mux").ToBool(res.Multiplex)
+	// JSON中的数字为float64
+	res.MinIdle = int64(jsoncfg.GetConfig("pool.minIdle").ToFloat64(float64(res.MinIdle)))
+	res.MaxCount = int64(jsoncfg.GetConfig("pool.maxCount").ToFloat64(float64(res.MaxCount)))
+	res.MuxCount = int64(jsoncfg.GetConfig("pool.muxCount").ToFloat64(float64(res.MuxCount)))
+	res.AuthName = jsoncfg.GetConfig("auth.name").ToString(res.AuthName)
+	res.AuthKey = jsoncfg.GetConfig("auth.key").ToString(res.AuthKey)
+	res.TLS = jsoncfg.GetConfig("tls.enable").ToBool(res.TLS)
+	res.TLSCA = jsoncfg.GetConfig("tls.ca").ToString(res.TLSCA)
+	res.TLSCert = jsoncfg.GetConfig("tls.cert").ToString(res.TLSCert)
+	res.TLSKey = jsoncfg.GetConfig("tls.key").ToString(res.TLSKey)
+	res.TLSName = jsoncfg.GetConfig("tls.name").ToString(res.TLSName)
+	res.MetricsAddr = jsoncfg.GetConfig("metrics.addr").ToString(res.MetricsAddr)
+	res.LogLevel = jsoncfg.GetConfig("log.level").ToString(res.LogLevel)
+	res.LogFormat = jsoncfg.GetConfig("log.format").ToString(res.LogFormat)
+	if res.Timeouts, err = getTimeouts(jsoncfg, res.Timeouts); nil != err {
+		return nil, err
+	}
+	if res.Backoff.Min, err = getDuration(jsoncfg, "reconnect.min", res.Backoff.Min); nil != err {
+		return nil, err
+	}
+	if res.Backoff.Max, err = getDuration(jsoncfg, "reconnect.max", res.Backoff.Max); nil != err {
+		return nil, err
+	}
+	if res.ShutdownTimeout, err = getDuration(jsoncfg, "timeouts.shutdown", res.ShutdownTimeout); nil != err {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// getDuration 读取时长配置, 格式如 10s、1m30s, 不存在时返回d
+func getDuration(jsoncfg *conftool.JSONCFG, key string, d time.Duration) (time.Duration, error) {
+	val := jsoncfg.GetConfig(key).O
+	if nil == val {
+		return d, nil
+	}
+	str, ok := val.(string)
+	if !ok {
+		return 0, errors.New("config " + key + " must be a duration string, e.g. 10s")
+	}
+	res, err := time.ParseDuration(str)
+	if nil != err {
+		return 0, errors.New("config " + key + ": " + err.Error())
+	}
+	return res, nil
+}
+
+// getTimeouts 读取各阶段的超时配置(timeouts.handshake 等), 不存在的项保留d中的值
+func getTimeouts(jsoncfg *conftool.JSONCFG, d tcptunnelmanager.Timeouts) (res tcptunnelmanager.Timeouts, err error) {
+	res = d
+	if res.Handshake, err = getDuration(jsoncfg, "timeouts.handshake", res.Handshake); nil != err {
+		return res, err
+	}
+	if res.Reply, err = getDuration(jsoncfg, "timeouts.reply", res.Reply); nil != err {
+		return res, err
+	}
+	if res.FirstByte, err = getDuration(jsoncfg, "timeouts.firstByte", res.FirstByte); nil != err {
+		return res, err
+	}
+	if res.Idle, err = getDuration(jsoncfg, "timeouts.idle", res.Idle); nil != err {
+		return res, err
+	}
+	if res.Session, err = getDuration(jsoncfg, "timeouts.session", res.Session); nil != err {
+		return res, err
+	}
+	return res, nil
+}
+
+// getStringMap 读取字符串字典配置, 不存在时返回d
+func getStringMap(jsoncfg *conftool.JSONCFG, key string, d map[string]string) (map[string]string, error) {
+	val := jsoncfg.GetConfig(key).O
+	if nil == val {
+		return d, nil
+	}
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("config " + key + " must be an object")
+	}
+	res := make(map[string]string, len(obj))
+	for name, item := range obj {
+		str, ok := item.(string)
+		if !ok {
+			return nil, errors.New("config " + key + ": value of " + name + " must be a string")
+		}
+		res[name] = str
+	}
+	return res, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"gutils/logtool"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tcptunnel/tcptunnelmanager"
+	"testing"
+	"time"
+)
+
+// testBase 模拟命令行参数生成的配置
+func testBase() *clientConfig {
+	return &clientConfig{
+		ServerAddr:      "127.0.0.1:8101",
+		Targets:         map[string]string{"web": "127.0.0.1:80"},
+		MaxCount:        50,
+		AuthName:        "flag",
+		LogLevel:        "info",
+		ShutdownTimeout: 30 * time.Second,
+		Timeouts:        tcptunnelmanager.Timeouts{Handshake: 10 * time.Second, Reply: 10 * time.Second},
+		Backoff:         tcptunnelmanager.Backoff{Min: time.Second, Max: time.Minute},
+	}
+}
+
+// writeConfig 写入配置文件
+func writeConfig(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); nil != err {
+		t.Fatal(err)
+	}
+}
+
+// 测试读取配置文件: 文件中的配置覆盖命令行参数, 不存在的项保留命令行参数, 格式错误时返回错误
+func TestLoadConfigFile(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+		check   func(cfg *clientConfig) bool
+	}{
+		{"empty object keeps flags", `{}`, "", func(cfg *clientConfig) bool {
+			return cfg.ServerAddr == "127.0.0.1:8101" && cfg.Targets["web"] == "127.0.0.1:80" && cfg.MaxCount == 50 && cfg.AuthName == "flag"
+		}},
+		{"file overrides flags", `{"server": "10.0.0.1:8101", "tunnels": {"ssh": "127.0.0.1:22"}, "mux": true, "pool": {"maxCount": 4}, "auth": {"key": "k1"}, "log": {"level": "debug"}}`, "", func(cfg *clientConfig) bool {
+			return cfg.ServerAddr == "10.0.0.1:8101" && len(cfg.Targets) == 1 && cfg.Targets["ssh"] == "127.0.0.1:22" && cfg.Multiplex &&
+				cfg.MaxCount == 4 && cfg.AuthName == "flag" && cfg.AuthKey == "k1" && cfg.LogLevel == "debug"
+		}},
+		{"durations", `{"timeouts": {"reply": "3s", "idle": "5m", "shutdown": "1m"}, "reconnect": {"min": "500ms"}}`, "", func(cfg *clientConfig) bool {
+			return cfg.Timeouts.Reply == 3*time.Second && cfg.Timeouts.Idle == 5*time.Minute && cfg.Timeouts.Handshake == 10*time.Second &&
+				cfg.ShutdownTimeout == time.Minute && cfg.Backoff.Min == 500*time.Millisecond && cfg.Backoff.Max == time.Minute
+		}},
+		{"allow and forwards", `{"allow": ["10.0.0.0/8", "*.corp.local"], "forwards": {"db": "127.0.0.1:15432"}}`, "", func(cfg *clientConfig) bool {
+			return cfg.AllowList.Allow("10.1.2.3:80") && cfg.AllowList.Allow("git.corp.local:22") && !cfg.AllowList.Allow("192.168.1.1:80") &&
+				cfg.Forwards["db"] == "127.0.0.1:15432"
+		}},
+		{"malformed json", `{"server": "10.0.0.1:8101"`, "unexpected end of JSON input", nil},
+		{"bad duration", `{"reconnect": {"max": "soon"}}`, "config reconnect.max", nil},
+		{"duration not string", `{"timeouts": {"handshake": 10}}`, "config timeouts.handshake must be a duration string", nil},
+		{"object expected", `{"pool": "4"}`, "config format error", nil},
+		{"no tunnel", `{"tunnels": {}}`, "no tunnel defined", nil},
+		{"tunnel not string", `{"tunnels": {"web": 80}}`, "config tunnels: value of web must be a string", nil},
+		{"allow not array", `{"allow": "10.0.0.0/8"}`, "config allow must be an array", nil},
+		{"allow not strings", `{"allow": [10]}`, "config allow must be an array of strings", nil},
+		{"bad allow rule", `{"allow": ["10.0.0.0/99"]}`, "allow rule cidr error", nil},
+	}
+	dir := t.TempDir()
+	for i, c := range cases {
+		path := filepath.Join(dir, "config"+strconv.Itoa(i)+".json")
+		writeConfig(t, path, c.content)
+		base := testBase()
+		cfg, err := loadConfigFile(path, base)
+		if len(c.err) > 0 {
+			if nil == err || !strings.Contains(err.Error(), c.err) {
+				t.Fatal(c.name, ": expected error ", c.err, ", got ", err)
+			}
+			continue
+		}
+		if nil != err {
+			t.Fatal(c.name, err)
+		}
+		if !c.check(cfg) {
+			t.Fatalf("%s: %+v", c.name, cfg)
+		}
+		// 命令行参数的配置不被修改
+		if base.ServerAddr != "127.0.0.1:8101" || len(base.Targets) != 1 || base.Targets["web"] != "127.0.0.1:80" {
+			t.Fatalf("%s: base modified: %+v", c.name, base)
+		}
+	}
+	if _, err := loadConfigFile(filepath.Join(dir, "none.json"), testBase()); nil == err || !strings.Contains(err.Error(), "config file not found") {
+		t.Fatal("expected config file not found: ", err)
+	}
+}
+
+// 测试重新加载配置: 成功时应用新配置, 配置文件错误时保留当前配置和注册的隧道
+func TestReload(t *testing.T) {
+	logtool.SetDefault(logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT))
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"tunnels": {"web": "127.0.0.1:80", "ssh": "127.0.0.1:22"}, "pool": {"maxCount": 4}}`)
+	client := &tunnelClient{
+		connector:  &tcptunnelmanager.TCPTunnelConnector{},
+		base:       testBase(),
+		configPath: path,
+		listeners:  make(map[string]io.Closer),
+	}
+	client.reload()
+	cfg := client.getConfig()
+	if nil == cfg || len(cfg.Targets) != 2 || cfg.MaxCount != 4 || len(client.connector.Tunnels) != 2 {
+		t.Fatalf("config not applied: %+v", cfg)
+	}
+	for _, content := range []string{`{"tunnels": {"db": "127.0.0.1:5432"}`, `{"tunnels": {}}`, `{"reconnect": {"min": "1"}}`, `{"pool": 4}`} {
+		writeConfig(t, path, content)
+		client.reload()
+		if client.getConfig() != cfg || len(client.connector.Tunnels) != 2 {
+			t.Fatal("failed reload replaced the config: ", content)
+		}
+	}
+	writeConfig(t, path, `{"tunnels": {"db": "127.0.0.1:5432"}}`)
+	client.reload()
+	if cfg = client.getConfig(); len(cfg.Targets) != 1 || cfg.MaxCount != 50 || len(client.connector.Tunnels) != 1 || client.connector.Tunnels[0] != "db" {
+		t.Fatalf("config not reloaded: %+v", cfg)
+	}
+}
@@ -12,72 +12,415 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"gutils/conftool"
+	"gutils/hstool"
+	"gutils/logtool"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"tcptunnel/tcpmsgexchanger"
 	"tcptunnel/tcptunnelmanager"
 	"time"
 )
 
+const (
+	// CONFIGWATCHINTERVAL 检查配置文件变化的间隔
+	CONFIGWATCHINTERVAL = 2 * time.Second
+)
+
 func main() {
 	// 获取需要加载的配置名字
+	configpath := flag.String("config", "", "json config file, overrides flags and is reloaded on SIGHUP or file change")
 	serveraddr := flag.String("server", "127.0.0.1:8101", "tunnel server addr")
 	proxyaddr := flag.String("proxy", "192.168.2.8:80", "proxy server addr")
+	tunnels := flag.String("tunnels", "", "named tunnel targets, e.g. web=192.168.2.8:80,ssh=192.168.2.8:22")
+	multiplex := flag.Bool("mux", false, "share a few tunnel connections by multiplexing")
+	maxcount := flag.Int64("maxcount", 50, "idle tunnel connections to keep per tunnel")
+	minidle := flag.Int64("minidle", 0, "the server asks for more idle connections below this count, half of -maxcount if 0")
+	muxcount := flag.Int64("muxcount", 1, "tunnel connections to keep in mux mode")
+	authname := flag.String("name", "", "auth name registered on the tunnel server")
+	authkey := flag.String("key", "", "auth key shared with the tunnel server")
+	usetls := flag.Bool("tls", false, "connect to the tunnel server with tls")
+	tlsca := flag.String("tlsca", "", "ca file to verify the server certificate, system roots if empty")
+	tlscert := flag.String("tlscert", "", "client certificate file for mutual tls")
+	tlskey := flag.String("tlskey", "", "client private key file for mutual tls")
+	tlsname := flag.String("tlsname", "", "server name to verify, host of -server if empty")
+	allows := flag.String("allow", "", "destinations the service may ask for (socks5 etc.), e.g. 10.0.0.0/8,*.corp.local,192.168.2.8:22")
+	forwards := flag.String("forwards", "", "reverse forward local listeners, e.g. db=127.0.0.1:15432")
+	metricsaddr := flag.String("metrics", "", "prometheus metrics listen addr, served at /metrics")
+	loglevel := flag.String("loglevel", "info", "log level: debug, info, warn or error")
+	logformat := flag.String("logformat", logtool.FORMATTEXT, "log format: text or json")
+	handshaketimeout := flag.Duration("handshaketimeout", tcptunnelmanager.DEFAULTHANDSHAKETIMEOUT, "max time to finish the tunnel handshake")
+	replytimeout := flag.Duration("replytimeout", tcptunnelmanager.DEFAULTREPLYTIMEOUT, "max time to wait for a control command reply")
+	firstbytetimeout := flag.Duration("firstbytetimeout", 0, "max time from session start to the first byte from the target, 0 disables it")
+	idletimeout := flag.Duration("idletimeout", 0, "close sessions idle longer than this, 0 disables it")
+	sessiontimeout := flag.Duration("sessiontimeout", 0, "max duration of a session, 0 disables it")
+	retrymin := flag.Duration("retrymin", tcptunnelmanager.DEFAULTBACKOFFMIN, "first reconnect interval, doubled after each failure")
+	retrymax := flag.Duration("retrymax", tcptunnelmanager.DEFAULTBACKOFFMAX, "max reconnect interval")
+	shutdowntimeout := flag.Duration("shutdowntimeout", 30*time.Second, "max time to wait for sessions on SIGINT or SIGTERM")
 	flag.Parse()
 
+	// 命令行参数
+	base := &clientConfig{
+		ServerAddr:  *serveraddr,
+		Allows:      strings.Split(*allows, ","),
+		Multiplex:   *multiplex,
+		MinIdle:     *minidle,
+		MaxCount:    *maxcount,
+		MuxCount:    *muxcount,
+		AuthName:    *authname,
+		AuthKey:     *authkey,
+		TLS:         *usetls,
+		TLSCA:       *tlsca,
+		TLSCert:     *tlscert,
+		TLSKey:      *tlskey,
+		TLSName:     *tlsname,
+		Forwards:    make(map[string]string),
+		MetricsAddr: *metricsaddr,
+		LogLevel:    *loglevel,
+		LogFormat:   *logformat,
+		Timeouts: tcptunnelmanager.Timeouts{
+			Handshake: *handshaketimeout,
+			Reply:     *replytimeout,
+			FirstByte: *firstbytetimeout,
+			Idle:      *idletimeout,
+			Session:   *sessiontimeout,
+		},
+		Backoff:         tcptunnelmanager.Backoff{Min: *retrymin, Max: *retrymax},
+		ShutdownTimeout: *shutdowntimeout,
+	}
+	// 没有指定隧道时, 默认隧道转发到 -proxy
+	if len(*tunnels) == 0 {
+		*tunnels = tcptunnelmanager.DEFAULTTUNNEL + "=" + *proxyaddr
+	}
+	var err error
+	if base.Targets, err = parseTargets(*tunnels); nil != err {
+		panic(err)
+	}
+	if base.AllowList, err = tcptunnelmanager.NewAllowList(base.Allows); nil != err {
+		panic(err)
+	}
+	if len(*forwards) > 0 {
+		if base.Forwards, err = parseTargets(*forwards); nil != err {
+			panic(err)
+		}
+	}
+	// 配置文件
+	cfg := base
+	if len(*configpath) > 0 {
+		if cfg, err = loadConfigFile(*configpath, base); nil != err {
+			panic(err)
+		}
+	}
+	// 日志
+	logger, err := newLogger(cfg)
+	if nil != err {
+		panic(err)
+	}
+	logtool.SetDefault(logger)
+	if len(*configpath) > 0 {
+		logger.Info("config file loaded", "path", *configpath)
+	}
+
 	// 服务地址
-	fmt.Println("隧道服务地址:", *serveraddr)
-	fmt.Println("远程代理地址:", *proxyaddr)
-	serviceAddr, err := net.ResolveTCPAddr("tcp4", *serveraddr)
+	logger.Info("tunnel server", "addr", cfg.ServerAddr)
+	serviceAddr, err := net.ResolveTCPAddr("tcp4", cfg.ServerAddr)
 	if nil != err {
 		panic(err)
 	}
 	// 连接管理服务
 	TCPTunnelClient := &tcptunnelmanager.TCPTunnelConnector{
 		ServiceAddr: serviceAddr,
+		AuthName:    cfg.AuthName,
+		AuthKey:     cfg.AuthKey,
+		Multiplex:   cfg.Multiplex,
+	}
+	TCPTunnelClient.SetLogger(logger)
+	if cfg.TLS || len(cfg.TLSCA) > 0 || len(cfg.TLSCert) > 0 {
+		TCPTunnelClient.TLSConfig, err = tcptunnelmanager.NewClientTLSConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey, cfg.TLSName)
+		if nil != err {
+			panic(err)
+		}
+	}
+	client := &tunnelClient{
+		connector:  TCPTunnelClient,
+		base:       base,
+		configPath: *configpath,
+		listeners:  make(map[string]io.Closer),
 	}
 	// 当收到链接后执行
-	TCPTunnelClient.SetTransportCallback(func(remote *net.TCPConn, relase func()) (err error) {
-		defer (func() {
-			relase()
-		})()
-		// 等待连接响应, 阻塞执行
-		_, err = remote.Read(make([]byte, 0))
-		if nil == err {
-			// 连接代理目标服务器
-			destAddr, err := net.ResolveTCPAddr("tcp4", *proxyaddr)
+	TCPTunnelClient.SetTransportCallback(client.doTransport)
+	if err := client.apply(cfg); nil != err {
+		panic(err)
+	}
+	if len(cfg.MetricsAddr) > 0 {
+		listener, err := net.Listen("tcp4", cfg.MetricsAddr)
+		if nil != err {
+			panic(err)
+		}
+		logger.Info("metrics listening", "addr", cfg.MetricsAddr)
+		router := &hstool.ServiceRouter{}
+		router.AddHandler("/metrics", TCPTunnelClient.Metrics().ServeHTTP)
+		go http.Serve(listener, router)
+	}
+	// 连接断开后按退避间隔重连, 直到客户端停止
+	go TCPTunnelClient.Run(context.Background())
+	// 配置文件修改或收到SIGHUP时重新加载, 收到SIGINT或SIGTERM时停止
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	if len(*configpath) > 0 {
+		go conftool.WatchFile(*configpath, CONFIGWATCHINTERVAL, client.reload, nil)
+		signal.Notify(signals, syscall.SIGHUP)
+	}
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		client.reload()
+	}
+	client.shutdown(client.getConfig().ShutdownTimeout, signals)
+}
+
+// newLogger 根据配置创建日志
+func newLogger(cfg *clientConfig) (*logtool.Logger, error) {
+	level, err := logtool.ParseLevel(cfg.LogLevel)
+	if nil != err {
+		return nil, err
+	}
+	format, err := logtool.ParseFormat(cfg.LogFormat)
+	if nil != err {
+		return nil, err
+	}
+	return logtool.NewLogger(os.Stdout, level, format), nil
+}
+
+// tunnelClient 客户端运行状态, 保存当前配置和反向转发的监听
+// 隧道连接的处理函数在收到连接时读取当前配置, 重新加载配置不影响已建立的会话
+type tunnelClient struct {
+	connector  *tcptunnelmanager.TCPTunnelConnector
+	base       *clientConfig        // 命令行参数
+	configPath string               // 配置文件
+	config     *clientConfig        // 当前配置
+	listeners  map[string]io.Closer // 反向转发的监听, key为 隧道名称=监听地址
+	closed     bool                 // 正在停止, 不再启动监听
+	lock       sync.RWMutex
+}
+
+// getConfig 获取当前配置
+func (client *tunnelClient) getConfig() *clientConfig {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	return client.config
+}
+
+// reload 重新读取配置文件并应用, 配置文件错误时保留当前配置
+func (client *tunnelClient) reload() {
+	cfg, err := loadConfigFile(client.configPath, client.base)
+	if nil != err {
+		logtool.Default().Error("reload config failed", "path", client.configPath, "err", err)
+		return
+	}
+	logtool.Default().Info("reload config", "path", client.configPath)
+	if err := client.apply(cfg); nil != err {
+		logtool.Default().Error("apply config failed", "err", err)
+	}
+}
+
+// apply 应用配置: 更新注册的隧道和连接数, 关闭已删除的反向转发监听, 启动新增的监听
+// 返回第一个启动失败的错误, 其他监听仍会启动
+func (client *tunnelClient) apply(cfg *clientConfig) (err error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.closed {
+		return nil
+	}
+	old := client.config
+	client.config = cfg
+	logger := logtool.Default()
+	if nil != old && cfg.needRestart(old) {
+		logger.Warn("server address, mux, auth, TLS, metrics and log settings take effect after restart")
+	}
+	// 反向转发的隧道也需要注册, 服务端只允许连接客户端自己注册的隧道的目标
+	names := make([]string, 0, len(cfg.Targets)+len(cfg.Forwards))
+	for name := range cfg.Targets {
+		names = append(names, name)
+	}
+	for name := range cfg.Forwards {
+		if _, ok := cfg.Targets[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if target, ok := cfg.Targets[name]; ok {
+			logger.Info("tunnel target", "tunnel", name, "target", target)
+		}
+	}
+	client.connector.SetTunnels(names)
+	client.connector.SetPoolSize(cfg.MinIdle, cfg.MaxCount, cfg.MuxCount)
+	client.connector.SetTimeouts(cfg.Timeouts)
+	client.connector.SetBackoff(cfg.Backoff)
+	// 反向转发: 本地监听, 连接转发到服务端的目标
+	for key, closer := range client.listeners {
+		index := strings.Index(key, "=")
+		if addr, ok := cfg.Forwards[key[:index]]; !ok || addr != key[index+1:] {
+			closer.Close()
+			delete(client.listeners, key)
+			logger.Info("forward listener closed", "listener", key)
+		}
+	}
+	keys := make([]string, 0, len(cfg.Forwards))
+	for name, addr := range cfg.Forwards {
+		if _, ok := client.listeners[name+"="+addr]; !ok {
+			keys = append(keys, name+"="+addr)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		index := strings.Index(key, "=")
+		name, addr := key[:index], key[index+1:]
+		listener, e := net.Listen("tcp4", addr)
+		if nil != e {
+			logger.Error("start forward listener failed", "listener", key, "err", e)
 			if nil == err {
-				destConn, err := net.DialTCP("tcp4", nil, destAddr)
-				defer (func() {
-					if nil != destConn {
-						destConn.Close()
-					}
-				})()
-				if nil == err {
-					// TCP消息交换
-					TCPExchanger := &tcpmsgexchanger.TCPExchanger4HHTTP{}
-					TCPExchanger.SetDebug(true)
-					err = TCPExchanger.ExchangeData(remote, destConn)
-				}
+				err = e
 			}
+			continue
 		}
-		if nil != err {
-			fmt.Println("转发数据出现错误: ", err)
+		logger.Info("forward listening", "addr", addr, "tunnel", name)
+		client.listeners[key] = listener
+		go doStartForward(listener, name, client.connector)
+	}
+	return err
+}
+
+// shutdown 停止客户端: 关闭反向转发监听, 等待正在传输的会话结束, 超时或再次收到停止信号时关闭剩余的连接
+func (client *tunnelClient) shutdown(timeout time.Duration, signals chan os.Signal) {
+	logger := logtool.Default()
+	logger.Info("shutting down", "timeout", timeout)
+	client.lock.Lock()
+	client.closed = true
+	for key, closer := range client.listeners {
+		closer.Close()
+		delete(client.listeners, key)
+	}
+	client.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				cancel()
+				return
+			}
+		}
+	}()
+	if err := client.connector.Stop(ctx); nil != err {
+		logger.Warn("sessions closed before they ended", "err", err)
+	}
+}
+
+// doTransport 隧道连接的处理函数, 根据当前配置选择目标地址
+func (client *tunnelClient) doTransport(remote net.Conn, info tcptunnelmanager.TransportInfo, relase func()) error {
+	defer (func() {
+		relase()
+	})()
+	cfg := client.getConfig()
+	target, ok := cfg.Targets[info.Tunnel]
+	if !ok {
+		err := errors.New("tunnel not found: " + info.Tunnel)
+		logtool.Default().Warn("transport failed", "tunnel", info.Tunnel, "err", err)
+		if info.Confirm {
+			tcptunnelmanager.SendDialResult(remote, err)
+		}
+		return err
+	}
+	// 服务端指定了目标地址时, 只连接白名单内的地址
+	if len(info.Dest) > 0 {
+		if !cfg.AllowList.Allow(info.Dest) {
+			err := fmt.Errorf("%w: %s", tcptunnelmanager.ErrDestNotAllowed, info.Dest)
+			logtool.Default().Warn("transport failed", "tunnel", info.Tunnel, "dest", info.Dest, "err", err)
+			if info.Confirm {
+				tcptunnelmanager.SendDialResult(remote, err)
+			}
+			return err
+		}
+		target = info.Dest
+	}
+	err := doTransport(remote, info, target)
+	if nil != err {
+		logtool.Default().Debug("transport error", "tunnel", info.Tunnel, "target", target, "err", err)
+	}
+	return err
+}
+
+// doTransport 连接代理目标服务器并交换数据, 服务端要求确认时先回复连接结果
+func doTransport(remote net.Conn, info tcptunnelmanager.TransportInfo, proxyaddr string) error {
+	// TCP消息交换, 模式由服务端的隧道定义决定
+	TCPExchanger, err := tcpmsgexchanger.NewExchanger(info.Mode)
+	if nil != err {
+		if info.Confirm {
+			tcptunnelmanager.SendDialResult(remote, err)
 		}
 		return err
-	})
+	}
+	// UDP模式连接UDP目标
+	network := "tcp4"
+	if info.Mode == tcpmsgexchanger.MODEUDP {
+		network = "udp4"
+	} else if len(info.Dest) > 0 {
+		// 服务端指定的目标可能是IPv6地址
+		network = "tcp"
+	}
+	destConn, err := net.Dial(network, proxyaddr)
+	if info.Confirm {
+		if e := tcptunnelmanager.SendDialResult(remote, err); nil != e && nil == err {
+			destConn.Close()
+			return e
+		}
+	}
+	if nil != err {
+		return err
+	}
+	defer destConn.Close()
+	TCPExchanger.SetLogger(logtool.Default().With("tunnel", info.Tunnel))
+	return TCPExchanger.ExchangeData(remote, destConn)
+}
+
+// doStartForward 接收本地连接, 每个连接请求服务端连接隧道对应的目标, 监听关闭后返回
+func doStartForward(listener net.Listener, tunnel string, TCPTunnelClient *tcptunnelmanager.TCPTunnelConnector) {
 	for {
-		err := TCPTunnelClient.DoConnect()
+		localConn, err := listener.Accept()
 		if nil != err {
-			fmt.Println(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logtool.Default().Warn("accept failed", "tunnel", tunnel, "err", err)
+			continue
 		}
-		fmt.Println("隧道连接异常,正在重连")
-		time.Sleep(time.Duration(1) * time.Second)
+		go (func() {
+			defer localConn.Close()
+			remote, err := TCPTunnelClient.Forward(tunnel)
+			if nil != err {
+				logtool.Default().Warn("forward failed", "tunnel", tunnel, "err", err)
+				return
+			}
+			defer remote.Close()
+			TCPExchanger, _ := tcpmsgexchanger.NewExchanger(tcpmsgexchanger.MODERAW)
+			TCPExchanger.SetLogger(logtool.Default().With("tunnel", tunnel))
+			if err := TCPExchanger.ExchangeData(localConn, remote); nil != err {
+				logtool.Default().Debug("forward exchange error", "tunnel", tunnel, "err", err)
+			}
+		})()
 	}
-
-	// fmt.Print("Ctrl+C退出程序")
-	// var sc string
-	// fmt.Scan(&sc)
-	// fmt.Println(sc)
 }
@@ -0,0 +1,349 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 服务端配置, 由命令行参数和JSON配置文件组成, 配置文件中的值优先
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gutils/conftool"
+	"net"
+	"os"
+	"strings"
+	"tcptunnel/tcpmsgexchanger"
+	"tcptunnel/tcptunnelentry"
+	"tcptunnel/tcptunnelmanager"
+	"time"
+)
+
+// serviceConfig 服务端配置
+// 隧道地址、TLS证书和日志配置修改后需要重启, 其他配置可以重新加载
+type serviceConfig struct {
+	TunnelAddr      string                      // 隧道监听地址
+	Entries         []entry                     // 公网入口
+	VHostAddr       string                      // 虚拟主机监听地址
+	VHosts          *tcptunnelentry.VHostRouter // 虚拟主机路由
+	AuthKeys        map[string]string           // 客户端认证密钥
+	TLSCert         string                      // 隧道TLS证书
+	TLSKey          string                      // 隧道TLS私钥
+	TLSCA           string                      // 验证客户端证书的CA
+	SocksAddr       string                      // SOCKS5监听地址
+	SocksTunnel     string                      // SOCKS5使用的隧道
+	SocksUsers      map[string]string           // SOCKS5用户
+	HTTPProxyAddr   string                      // HTTP代理监听地址
+	HTTPProxyTunnel string                      // HTTP代理使用的隧道
+	HTTPProxyUsers  map[string]string           // HTTP代理用户
+	Dests           *tcptunnelentry.DestRouter  // 目标地址路由
+	Forwards        map[string]string           // 反向转发目标
+	AdminAddr       string                      // 管理接口监听地址
+	AdminToken      string                      // 管理接口令牌
+	MetricsAddr     string                      // 监控指标监听地址
+	LogLevel        string                      // 日志级别
+	LogFormat       string                      // 日志格式
+	AccessLog       string                      // HTTP访问日志文件, - 为标准输出, 为空时不记录
+	QueueSize       int                         // 每个隧道等待空闲连接的最大请求数, 小于0时不等待
+	QueueTimeout    time.Duration               // 等待空闲连接的最长时间
+	Timeouts        tcptunnelmanager.Timeouts   // 各阶段的超时时间
+	RequestTimeout  time.Duration               // 入口读取请求头的时间
+	UDPIdleTimeout  time.Duration               // UDP会话空闲超时时间
+	ShutdownTimeout time.Duration               // 停止时等待会话结束的最长时间
+}
+
+// needRestart 与另一个配置相比, 是否修改了需要重启才能生效的配置
+func (cfg *serviceConfig) needRestart(other *serviceConfig) bool {
+	return cfg.TunnelAddr != other.TunnelAddr || cfg.TLSCert != other.TLSCert || cfg.TLSKey != other.TLSKey || cfg.TLSCA != other.TLSCA ||
+		cfg.LogLevel != other.LogLevel || cfg.LogFormat != other.LogFormat || cfg.AccessLog != other.AccessLog
+}
+
+// entry 公网入口, 每个入口转发到一个命名隧道
+type entry struct {
+	Tunnel string       // 隧道名称
+	Addr   *net.TCPAddr // 监听地址
+	Mode   string       // 数据交换模式
+}
+
+// key 入口的唯一标识, 重新加载配置时用于判断入口是否变化
+func (val entry) key() string {
+	return "entry:" + val.Tunnel + "=" + val.Addr.String() + "/" + val.Mode
+}
+
+// newEntry 创建入口, 模式为空时使用HTTP模式
+func newEntry(tunnel, addr, mode string) (entry, error) {
+	val := entry{Tunnel: tunnel, Mode: mode}
+	if len(val.Tunnel) == 0 {
+		return val, errors.New("entry tunnel is empty: " + addr)
+	}
+	if len(val.Mode) == 0 {
+		val.Mode = tcpmsgexchanger.MODEHTTP
+	}
+	if _, err := tcpmsgexchanger.NewExchanger(val.Mode); nil != err {
+		return val, err
+	}
+	laddr, err := net.ResolveTCPAddr("tcp4", addr)
+	if nil != err {
+		return val, err
+	}
+	val.Addr = laddr
+	return val, nil
+}
+
+// parseEntries 解析入口定义: 隧道名称=监听地址[/模式], 多个入口用逗号分隔
+func parseEntries(str string) ([]entry, error) {
+	res := make([]entry, 0)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		index := strings.Index(item, "=")
+		if index <= 0 {
+			return nil, errors.New("entry format error: " + item)
+		}
+		tunnel, addr, mode := item[:index], item[index+1:], ""
+		if index = strings.LastIndex(addr, "/"); index > -1 {
+			mode = addr[index+1:]
+			addr = addr[:index]
+		}
+		val, err := newEntry(tunnel, addr, mode)
+		if nil != err {
+			return nil, err
+		}
+		res = append(res, val)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no entry defined")
+	}
+	return res, nil
+}
+
+// parseKeyValues 解析 key=value 列表, 多个用逗号分隔
+func parseKeyValues(str string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		index := strings.Index(item, "=")
+		if index <= 0 || index == len(item)-1 {
+			return nil, errors.New("format error: " + item)
+		}
+		res[item[:index]] = item[index+1:]
+	}
+	return res, nil
+}
+
+// parseVHosts 解析虚拟主机路由: 主机名=隧道名称, 多个路由用逗号分隔, 主机名支持 *.example.com 和 *
+func parseVHosts(str string) (*tcptunnelentry.VHostRouter, error) {
+	routes, err := parseKeyValues(str)
+	if nil != err {
+		return nil, err
+	}
+	return newVHosts(routes), nil
+}
+
+// newVHosts 根据 主机名=隧道名称 创建虚拟主机路由
+func newVHosts(routes map[string]string) *tcptunnelentry.VHostRouter {
+	router := tcptunnelentry.NewVHostRouter()
+	for host, tunnel := range routes {
+		router.AddRoute(host, tunnel)
+	}
+	return router
+}
+
+// parseDests 解析目标地址路由: 规则=目标地址, 多个规则用逗号分隔, 规则为 host:主机名、path:路径前缀 或 port:入口端口
+func parseDests(str string) (*tcptunnelentry.DestRouter, error) {
+	rules, err := parseKeyValues(str)
+	if nil != err {
+		return nil, err
+	}
+	return newDests(rules)
+}
+
+// newDests 根据 规则=目标地址 创建目标地址路由
+func newDests(rules map[string]string) (*tcptunnelentry.DestRouter, error) {
+	router := tcptunnelentry.NewDestRouter()
+	for rule, dest := range rules {
+		if err := router.AddRule(rule, dest); nil != err {
+			return nil, err
+		}
+	}
+	return router, nil
+}
+
+// loadConfigFile 读取JSON配置文件, 文件中存在的配置覆盖base中的值, base不会被修改
+// 配置项: tunel, entries, vhost, auth, tls, socks, httpproxy, dests, forwards, admin, metrics, log, queue, timeouts, 格式见README
+func loadConfigFile(path string, base *serviceConfig) (cfg *serviceConfig, err error) {
+	// 配置工具在文件不存在时会创建空文件, 这里要求文件必须存在
+	if st, e := os.Stat(path); nil != e || st.IsDir() {
+		return nil, errors.New("config file not found: " + path)
+	}
+	jsoncfg := &conftool.JSONCFG{}
+	if err = jsoncfg.InitConfig(path); nil != err {
+		return nil, err
+	}
+	// 配置层级和格式不对时(如需要对象的位置写成了字符串)读取会panic, 转换为错误返回
+	defer func() {
+		if e := recover(); nil != e {
+			cfg, err = nil, fmt.Errorf("config format error: %v", e)
+		}
+	}()
+	res := *base
+	res.TunnelAddr = jsoncfg.GetConfig("tunel").ToString(res.TunnelAddr)
+	if val := jsoncfg.GetConfig("entries").O; nil != val {
+		items, ok := val.([]interface{})
+		if !ok {
+			return nil, errors.New("config entries must be an array")
+		}
+		res.Entries = make([]entry, 0, len(items))
+		for _, item := range items {
+			fields, err := toStringMap(item)
+			if nil != err {
+				return nil, errors.New("config entries: " + err.Error())
+			}
+			val, err := newEntry(fields["tunnel"], fields["addr"], fields["mode"])
+			if nil != err {
+				return nil, err
+			}
+			res.Entries = append(res.Entries, val)
+		}
+		if len(res.Entries) == 0 {
+			return nil, errors.New("no entry defined")
+		}
+	}
+	res.VHostAddr = jsoncfg.GetConfig("vhost.addr").ToString(res.VHostAddr)
+	if val := jsoncfg.GetConfig("vhost.routes").O; nil != val {
+		routes, err := toStringMap(val)
+		if nil != err {
+			return nil, errors.New("config vhost.routes: " + err.Error())
+		}
+		res.VHosts = newVHosts(routes)
+	}
+	if res.AuthKeys, err = getStringMap(jsoncfg, "auth", res.AuthKeys); nil != err {
+		return nil, err
+	}
+	res.TLSCert = jsoncfg.GetConfig("tls.cert").ToString(res.TLSCert)
+	res.TLSKey = jsoncfg.GetConfig("tls.key").ToString(res.TLSKey)
+	res.TLSCA = jsoncfg.GetConfig("tls.ca").ToString(res.TLSCA)
+	res.SocksAddr = jsoncfg.GetConfig("socks.addr").ToString(res.SocksAddr)
+	res.SocksTunnel = jsoncfg.GetConfig("socks.tunnel").ToString(res.SocksTunnel)
+	if res.SocksUsers, err = getStringMap(jsoncfg, "socks.users", res.SocksUsers); nil != err {
+		return nil, err
+	}
+	res.HTTPProxyAddr = jsoncfg.GetConfig("httpproxy.addr").ToString(res.HTTPProxyAddr)
+	res.HTTPProxyTunnel = jsoncfg.GetConfig("httpproxy.tunnel").ToString(res.HTTPProxyTunnel)
+	if res.HTTPProxyUsers, err = getStringMap(jsoncfg, "httpproxy.users", res.HTTPProxyUsers); nil != err {
+		return nil, err
+	}
+	if val := jsoncfg.GetConfig("dests").O; nil != val {
+		rules, err := toStringMap(val)
+		if nil != err {
+			return nil, errors.New("config dests: " + err.Error())
+		}
+		if res.Dests, err = newDests(rules); nil != err {
+			return nil, err
+		}
+	}
+	if res.Forwards, err = getStringMap(jsoncfg, "forwards", res.Forwards); nil != err {
+		return nil, err
+	}
+	res.AdminAddr = jsoncfg.GetConfig("admin.addr").ToString(res.AdminAddr)
+	res.AdminToken = jsoncfg.GetConfig("admin.token").ToString(res.AdminToken)
+	res.MetricsAddr = jsoncfg.GetConfig("metrics.addr").ToString(res.MetricsAddr)
+	res.LogLevel = jsoncfg.GetConfig("log.level").ToString(res.LogLevel)
+	res.LogFormat = jsoncfg.GetConfig("log.format").ToString(res.LogFormat)
+	res.AccessLog = jsoncfg.GetConfig("log.access").ToString(res.AccessLog)
+	res.QueueSize = int(jsoncfg.GetConfig("queue.size").ToFloat64(float64(res.QueueSize)))
+	if res.QueueTimeout, err = getDuration(jsoncfg, "queue.timeout", res.QueueTimeout); nil != err {
+		return nil, err
+	}
+	if res.Timeouts, err = getTimeouts(jsoncfg, res.Timeouts); nil != err {
+		return nil, err
+	}
+	if res.RequestTimeout, err = getDuration(jsoncfg, "timeouts.request", res.RequestTimeout); nil != err {
+		return nil, err
+	}
+	if res.UDPIdleTimeout, err = getDuration(jsoncfg, "timeouts.udpIdle", res.UDPIdleTimeout); nil != err {
+		return nil, err
+	}
+	if res.ShutdownTimeout, err = getDuration(jsoncfg, "timeouts.shutdown", res.ShutdownTimeout); nil != err {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// getTimeouts 读取各阶段的超时配置(timeouts.handshake 等), 不存在的项保留d中的值
+func getTimeouts(jsoncfg *conftool.JSONCFG, d tcptunnelmanager.Timeouts) (res tcptunnelmanager.Timeouts, err error) {
+	res = d
+	if res.Handshake, err = getDuration(jsoncfg, "timeouts.handshake", res.Handshake); nil != err {
+		return res, err
+	}
+	if res.Reply, err = getDuration(jsoncfg, "timeouts.reply", res.Reply); nil != err {
+		return res, err
+	}
+	if res.FirstByte, err = getDuration(jsoncfg, "timeouts.firstByte", res.FirstByte); nil != err {
+		return res, err
+	}
+	if res.Idle, err = getDuration(jsoncfg, "timeouts.idle", res.Idle); nil != err {
+		return res, err
+	}
+	if res.Session, err = getDuration(jsoncfg, "timeouts.session", res.Session); nil != err {
+		return res, err
+	}
+	return res, nil
+}
+
+// getDuration 读取时长配置, 格式如 10s、1m30s, 不存在时返回d
+func getDuration(jsoncfg *conftool.JSONCFG, key string, d time.Duration) (time.Duration, error) {
+	val := jsoncfg.GetConfig(key).O
+	if nil == val {
+		return d, nil
+	}
+	str, ok := val.(string)
+	if !ok {
+		return 0, errors.New("config " + key + " must be a duration string, e.g. 10s")
+	}
+	res, err := time.ParseDuration(str)
+	if nil != err {
+		return 0, errors.New("config " + key + ": " + err.Error())
+	}
+	return res, nil
+}
+
+// getStringMap 读取字符串字典配置, 不存在时返回d
+func getStringMap(jsoncfg *conftool.JSONCFG, key string, d map[string]string) (map[string]string, error) {
+	val := jsoncfg.GetConfig(key).O
+	if nil == val {
+		return d, nil
+	}
+	res, err := toStringMap(val)
+	if nil != err {
+		return nil, errors.New("config " + key + ": " + err.Error())
+	}
+	return res, nil
+}
+
+// toStringMap 将JSON对象转换为字符串字典, 值必须是字符串
+func toStringMap(val interface{}) (map[string]string, error) {
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("must be an object")
+	}
+	res := make(map[string]string, len(obj))
+	for key, item := range obj {
+		str, ok := item.(string)
+		if !ok {
+			return nil, errors.New("value of " + key + " must be a string")
+		}
+		res[key] = str
+	}
+	return res, nil
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"gutils/logtool"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tcptunnel/tcpmsgexchanger"
+	"tcptunnel/tcptunnelmanager"
+	"testing"
+	"time"
+)
+
+// testBase 模拟命令行参数生成的配置
+func testBase() *serviceConfig {
+	return &serviceConfig{
+		TunnelAddr:      "0.0.0.0:8101",
+		SocksTunnel:     tcptunnelmanager.DEFAULTTUNNEL,
+		AuthKeys:        map[string]string{"flag": "secret"},
+		QueueSize:       10,
+		QueueTimeout:    time.Second,
+		RequestTimeout:  10 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		Timeouts:        tcptunnelmanager.Timeouts{Reply: 10 * time.Second, Idle: 5 * time.Minute},
+	}
+}
+
+// writeConfig 写入配置文件
+func writeConfig(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); nil != err {
+		t.Fatal(err)
+	}
+}
+
+// 测试读取配置文件: 文件中的配置覆盖命令行参数, 不存在的项保留命令行参数, 格式错误时返回错误
+func TestLoadConfigFile(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+		check   func(cfg *serviceConfig) bool
+	}{
+		{"empty object keeps flags", `{}`, "", func(cfg *serviceConfig) bool {
+			return cfg.TunnelAddr == "0.0.0.0:8101" && cfg.QueueSize == 10 && cfg.AuthKeys["flag"] == "secret" && cfg.Timeouts.Reply == 10*time.Second
+		}},
+		{"file overrides flags", `{"tunel": "127.0.0.1:9101", "auth": {"c1": "k1"}, "socks": {"addr": "127.0.0.1:1080", "users": {"u": "p"}}, "queue": {"size": 5, "timeout": "2s"}}`, "", func(cfg *serviceConfig) bool {
+			return cfg.TunnelAddr == "127.0.0.1:9101" && len(cfg.AuthKeys) == 1 && cfg.AuthKeys["c1"] == "k1" &&
+				cfg.SocksAddr == "127.0.0.1:1080" && cfg.SocksTunnel == tcptunnelmanager.DEFAULTTUNNEL && cfg.SocksUsers["u"] == "p" &&
+				cfg.QueueSize == 5 && cfg.QueueTimeout == 2*time.Second
+		}},
+		{"durations", `{"timeouts": {"reply": "3s", "firstByte": "500ms", "udpIdle": "1m30s", "shutdown": "1m"}}`, "", func(cfg *serviceConfig) bool {
+			return cfg.Timeouts.Reply == 3*time.Second && cfg.Timeouts.FirstByte == 500*time.Millisecond && cfg.Timeouts.Idle == 5*time.Minute &&
+				cfg.UDPIdleTimeout == 90*time.Second && cfg.ShutdownTimeout == time.Minute && cfg.RequestTimeout == 10*time.Second
+		}},
+		{"entries and routes", `{"entries": [{"tunnel": "web", "addr": "127.0.0.1:8080"}, {"tunnel": "dns", "addr": "127.0.0.1:5353", "mode": "udp"}], "vhost": {"routes": {"*": "web"}}, "dests": {"port:8080": "10.0.0.5:80"}}`, "", func(cfg *serviceConfig) bool {
+			dest, _ := cfg.Dests.MatchPort(8080)
+			tunnel, _ := cfg.VHosts.Match("a.example.com")
+			return len(cfg.Entries) == 2 && cfg.Entries[0].Mode == tcpmsgexchanger.MODEHTTP && cfg.Entries[1].Mode == tcpmsgexchanger.MODEUDP &&
+				dest == "10.0.0.5:80" && tunnel == "web"
+		}},
+		{"malformed json", `{"tunel": "127.0.0.1:9101",`, "unexpected end of JSON input", nil},
+		{"bad duration", `{"timeouts": {"reply": "3 seconds"}}`, "config timeouts.reply", nil},
+		{"duration not string", `{"queue": {"timeout": 5}}`, "config queue.timeout must be a duration string", nil},
+		{"object expected", `{"tls": "server.pem"}`, "config format error", nil},
+		{"map value not string", `{"auth": {"c1": 1}}`, "config auth: value of c1 must be a string", nil},
+		{"no entry", `{"entries": []}`, "no entry defined", nil},
+		{"bad entry mode", `{"entries": [{"tunnel": "web", "addr": "127.0.0.1:8080", "mode": "ftp"}]}`, "ftp", nil},
+	}
+	dir := t.TempDir()
+	for i, c := range cases {
+		path := filepath.Join(dir, "config"+strconv.Itoa(i)+".json")
+		writeConfig(t, path, c.content)
+		base := testBase()
+		cfg, err := loadConfigFile(path, base)
+		if len(c.err) > 0 {
+			if nil == err || !strings.Contains(err.Error(), c.err) {
+				t.Fatal(c.name, ": expected error ", c.err, ", got ", err)
+			}
+			continue
+		}
+		if nil != err {
+			t.Fatal(c.name, err)
+		}
+		if !c.check(cfg) {
+			t.Fatalf("%s: %+v", c.name, cfg)
+		}
+		// 命令行参数的配置不被修改
+		if base.TunnelAddr != "0.0.0.0:8101" || base.QueueSize != 10 || len(base.AuthKeys) != 1 {
+			t.Fatalf("%s: base modified: %+v", c.name, base)
+		}
+	}
+	if _, err := loadConfigFile(filepath.Join(dir, "none.json"), testBase()); nil == err || !strings.Contains(err.Error(), "config file not found") {
+		t.Fatal("expected config file not found: ", err)
+	}
+}
+
+// 测试重新加载配置: 成功时应用新配置, 配置文件错误时保留当前配置
+func TestReload(t *testing.T) {
+	logtool.SetDefault(logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT))
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, `{"queue": {"size": 5}, "timeouts": {"reply": "3s"}}`)
+	server := &tunnelServer{
+		svc:        &tcptunnelmanager.TCPTunnelService{},
+		base:       testBase(),
+		configPath: path,
+		listeners:  make(map[string]io.Closer),
+	}
+	server.reload()
+	cfg := server.getConfig()
+	if nil == cfg || cfg.QueueSize != 5 || cfg.Timeouts.Reply != 3*time.Second {
+		t.Fatalf("config not applied: %+v", cfg)
+	}
+	for _, content := range []string{`{"queue": {"size": 6`, `{"queue": {"size": 6}, "timeouts": {"reply": "3"}}`, `{"queue": "6"}`} {
+		writeConfig(t, path, content)
+		server.reload()
+		if server.getConfig() != cfg {
+			t.Fatal("failed reload replaced the config: ", content)
+		}
+	}
+	writeConfig(t, path, `{"queue": {"size": 7}}`)
+	server.reload()
+	if cfg = server.getConfig(); cfg.QueueSize != 7 || cfg.Timeouts.Reply != 10*time.Second {
+		t.Fatalf("config not reloaded: %+v", cfg)
+	}
+}
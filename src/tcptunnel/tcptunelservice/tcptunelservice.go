@@ -12,82 +12,704 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"fmt"
+	"gutils/conftool"
+	"gutils/hstool"
+	"gutils/logtool"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
 	"tcptunnel/tcpmsgexchanger"
+	"tcptunnel/tcptunnelentry"
 	"tcptunnel/tcptunnelmanager"
+	"time"
 )
 
+const (
+	// CONFIGWATCHINTERVAL 检查配置文件变化的间隔
+	CONFIGWATCHINTERVAL = 2 * time.Second
+	// RETRYAFTER 没有可用的隧道连接时, 建议HTTP客户端重试的间隔(秒)
+	RETRYAFTER = "5"
+)
+
+// accessLog HTTP访问日志, 为空时不记录
+var accessLog *logtool.Logger
+
 func main() {
 	// 获取需要加载的配置名字
+	configpath := flag.String("config", "", "json config file, overrides flags and is reloaded on SIGHUP or file change")
 	listenaddr := flag.String("listen", "0.0.0.0:8080", "web service listen addr")
 	trunneladdr := flag.String("tunel", "0.0.0.0:8101", "tunel service addr")
+	mode := flag.String("mode", tcpmsgexchanger.MODEHTTP, "exchange mode: http, raw or udp")
+	entrys := flag.String("entries", "", "named tunnel entries, e.g. web=0.0.0.0:8080,ssh=0.0.0.0:2222/raw,dns=0.0.0.0:53/udp")
+	vhostaddr := flag.String("vhost", "", "virtual host listen addr, routes by Host header or TLS SNI")
+	vhosts := flag.String("vhosts", "", "virtual host routes, e.g. a.example.com=web,*.example.com=blog,*=default")
+	authkeys := flag.String("auth", "", "client auth keys, e.g. client1=secret1,client2=secret2")
+	tlscert := flag.String("tlscert", "", "tls certificate file of the tunnel port")
+	tlskey := flag.String("tlskey", "", "tls private key file of the tunnel port")
+	tlsca := flag.String("tlsca", "", "ca file to verify client certificates, enables mutual tls")
+	socksaddr := flag.String("socks", "", "socks5 listen addr, destinations are dialed by the tunnel client")
+	sockstunnel := flag.String("sockstunnel", tcptunnelmanager.DEFAULTTUNNEL, "tunnel used by the socks5 entry")
+	socksusers := flag.String("socksusers", "", "socks5 username and password, e.g. user1=pass1,user2=pass2")
+	httpproxyaddr := flag.String("httpproxy", "", "http proxy listen addr (CONNECT and absolute-uri requests)")
+	httpproxytunnel := flag.String("httpproxytunnel", tcptunnelmanager.DEFAULTTUNNEL, "tunnel used by the http proxy entry")
+	httpproxyusers := flag.String("httpproxyusers", "", "http proxy username and password, e.g. user1=pass1")
+	dests := flag.String("dests", "", "per-session destinations dialed by the client, e.g. host:a.example.com=10.0.0.5:80,path:/api=10.0.0.6:8080,port:8081=10.0.0.7:22")
+	forwards := flag.String("forwards", "", "reverse forward targets dialed by the service, e.g. db=10.0.0.5:5432")
+	adminaddr := flag.String("admin", "", "admin api listen addr, e.g. 127.0.0.1:8102")
+	admintoken := flag.String("admintoken", "", "bearer token required by the admin api")
+	metricsaddr := flag.String("metrics", "", "prometheus metrics listen addr, served at /metrics")
+	loglevel := flag.String("loglevel", "info", "log level: debug, info, warn or error")
+	logformat := flag.String("logformat", logtool.FORMATTEXT, "log format: text or json")
+	accesslog := flag.String("accesslog", "", "http access log file, - for stdout, empty disables it")
+	queuesize := flag.Int("queuesize", tcptunnelmanager.DEFAULTQUEUESIZE, "max requests per tunnel waiting for an idle connection, -1 disables waiting")
+	queuetimeout := flag.Duration("queuetimeout", tcptunnelmanager.DEFAULTQUEUETIMEOUT, "max time a request waits for an idle tunnel connection")
+	handshaketimeout := flag.Duration("handshaketimeout", tcptunnelmanager.DEFAULTHANDSHAKETIMEOUT, "max time to finish the tunnel handshake")
+	replytimeout := flag.Duration("replytimeout", tcptunnelmanager.DEFAULTREPLYTIMEOUT, "max time to wait for a control command reply")
+	firstbytetimeout := flag.Duration("firstbytetimeout", 0, "max time from session start to the first byte from the target, 0 disables it")
+	idletimeout := flag.Duration("idletimeout", 0, "close sessions idle longer than this, 0 disables it")
+	sessiontimeout := flag.Duration("sessiontimeout", 0, "max duration of a session, 0 disables it")
+	shutdowntimeout := flag.Duration("shutdowntimeout", 30*time.Second, "max time to wait for sessions on SIGINT or SIGTERM")
+	requesttimeout := flag.Duration("requesttimeout", tcptunnelmanager.CMDRTIMEOUT, "max time to read a request header (http, vhost, socks5 and http proxy entries)")
+	udpidletimeout := flag.Duration("udpidletimeout", tcptunnelentry.UDPIDLETIMEOUT, "end udp sessions idle longer than this")
 	flag.Parse()
 
-	// 服务地址
-	fmt.Println("本地监听地址:", *listenaddr)
-	fmt.Println("隧道监听地址:", *trunneladdr)
-	taddr, err := net.ResolveTCPAddr("tcp4", *trunneladdr)
+	// 命令行参数
+	base := &serviceConfig{
+		TunnelAddr:      *trunneladdr,
+		VHostAddr:       *vhostaddr,
+		TLSCert:         *tlscert,
+		TLSKey:          *tlskey,
+		TLSCA:           *tlsca,
+		SocksAddr:       *socksaddr,
+		SocksTunnel:     *sockstunnel,
+		HTTPProxyAddr:   *httpproxyaddr,
+		HTTPProxyTunnel: *httpproxytunnel,
+		AdminAddr:       *adminaddr,
+		AdminToken:      *admintoken,
+		MetricsAddr:     *metricsaddr,
+		LogLevel:        *loglevel,
+		LogFormat:       *logformat,
+		AccessLog:       *accesslog,
+		QueueSize:       *queuesize,
+		QueueTimeout:    *queuetimeout,
+		RequestTimeout:  *requesttimeout,
+		UDPIdleTimeout:  *udpidletimeout,
+		ShutdownTimeout: *shutdowntimeout,
+		Timeouts: tcptunnelmanager.Timeouts{
+			Handshake: *handshaketimeout,
+			Reply:     *replytimeout,
+			FirstByte: *firstbytetimeout,
+			Idle:      *idletimeout,
+			Session:   *sessiontimeout,
+		},
+	}
+	// 没有指定入口时, 使用 -listen 转发到默认隧道
+	if len(*entrys) == 0 {
+		*entrys = tcptunnelmanager.DEFAULTTUNNEL + "=" + *listenaddr + "/" + *mode
+	}
+	var err error
+	if base.Entries, err = parseEntries(*entrys); nil != err {
+		panic(err)
+	}
+	if base.VHosts, err = parseVHosts(*vhosts); nil != err {
+		panic(err)
+	}
+	if base.AuthKeys, err = parseKeyValues(*authkeys); nil != err {
+		panic(err)
+	}
+	if base.SocksUsers, err = parseKeyValues(*socksusers); nil != err {
+		panic(err)
+	}
+	if base.HTTPProxyUsers, err = parseKeyValues(*httpproxyusers); nil != err {
+		panic(err)
+	}
+	if base.Dests, err = parseDests(*dests); nil != err {
+		panic(err)
+	}
+	if base.Forwards, err = parseKeyValues(*forwards); nil != err {
+		panic(err)
+	}
+	// 配置文件
+	cfg := base
+	if len(*configpath) > 0 {
+		if cfg, err = loadConfigFile(*configpath, base); nil != err {
+			panic(err)
+		}
+	}
+	// 日志
+	logger, err := newLogger(cfg)
 	if nil != err {
 		panic(err)
 	}
-	laddr, err := net.ResolveTCPAddr("tcp4", *listenaddr)
+	logtool.SetDefault(logger)
+	if len(*configpath) > 0 {
+		logger.Info("config file loaded", "path", *configpath)
+	}
+
+	// 服务地址
+	logger.Info("tunnel listening", "addr", cfg.TunnelAddr)
+	taddr, err := net.ResolveTCPAddr("tcp4", cfg.TunnelAddr)
 	if nil != err {
 		panic(err)
 	}
 	// 隧道服务启动
 	TCPTunnelService := &tcptunnelmanager.TCPTunnelService{
 		ServiceAddr: taddr,
+		AuthKeys:    cfg.AuthKeys,
 	}
-	go func() {
-		err := TCPTunnelService.DoStart()
+	TCPTunnelService.SetLogger(logger)
+	if len(cfg.TLSCert) > 0 {
+		TCPTunnelService.TLSConfig, err = tcptunnelmanager.NewServerTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
 		if nil != err {
 			panic(err)
 		}
+		logger.Info("tunnel TLS enabled", "verifyClient", len(cfg.TLSCA) > 0)
+	}
+	server := &tunnelServer{
+		svc:        TCPTunnelService,
+		base:       base,
+		configPath: *configpath,
+		listeners:  make(map[string]io.Closer),
+	}
+	TCPTunnelService.SetForwardCallback(server.doForward)
+	if err := server.apply(cfg); nil != err {
+		panic(err)
+	}
+	if err := TCPTunnelService.Start(context.Background()); nil != err {
+		panic(err)
+	}
+	// 配置文件修改或收到SIGHUP时重新加载, 收到SIGINT或SIGTERM时停止
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	if len(*configpath) > 0 {
+		go conftool.WatchFile(*configpath, CONFIGWATCHINTERVAL, server.reload, nil)
+		signal.Notify(signals, syscall.SIGHUP)
+	}
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		server.reload()
+	}
+	server.shutdown(server.getConfig().ShutdownTimeout, signals)
+}
+
+// newLogger 根据配置创建日志, 同时创建HTTP访问日志
+func newLogger(cfg *serviceConfig) (*logtool.Logger, error) {
+	level, err := logtool.ParseLevel(cfg.LogLevel)
+	if nil != err {
+		return nil, err
+	}
+	format, err := logtool.ParseFormat(cfg.LogFormat)
+	if nil != err {
+		return nil, err
+	}
+	if len(cfg.AccessLog) > 0 {
+		if accessLog, err = logtool.NewFileLogger(cfg.AccessLog, logtool.INFO, format); nil != err {
+			return nil, err
+		}
+	}
+	return logtool.NewLogger(os.Stdout, level, format), nil
+}
+
+// tunnelServer 服务端运行状态, 保存当前配置和已启动的监听
+// 连接的处理函数在接收连接时读取当前配置, 重新加载配置不影响已建立的会话
+type tunnelServer struct {
+	svc        *tcptunnelmanager.TCPTunnelService
+	base       *serviceConfig       // 命令行参数
+	configPath string               // 配置文件
+	config     *serviceConfig       // 当前配置
+	listeners  map[string]io.Closer // 已启动的监听, key为监听的定义
+	closed     bool                 // 正在停止, 不再启动监听
+	lock       sync.RWMutex
+}
+
+// getConfig 获取当前配置
+func (server *tunnelServer) getConfig() *serviceConfig {
+	server.lock.RLock()
+	defer server.lock.RUnlock()
+	return server.config
+}
+
+// reload 重新读取配置文件并应用, 配置文件错误时保留当前配置
+func (server *tunnelServer) reload() {
+	cfg, err := loadConfigFile(server.configPath, server.base)
+	if nil != err {
+		logtool.Default().Error("reload config failed", "path", server.configPath, "err", err)
+		return
+	}
+	logtool.Default().Info("reload config", "path", server.configPath)
+	if err := server.apply(cfg); nil != err {
+		logtool.Default().Error("apply config failed", "err", err)
+	}
+}
+
+// apply 应用配置: 关闭已删除的监听, 启动新增的监听, 未变化的监听和已建立的会话不受影响
+// 返回第一个启动失败的错误, 其他监听仍会启动
+func (server *tunnelServer) apply(cfg *serviceConfig) (err error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.closed {
+		return nil
+	}
+	old := server.config
+	server.config = cfg
+	logger := logtool.Default()
+	if nil != old && cfg.needRestart(old) {
+		logger.Warn("tunnel address, TLS and log settings take effect after restart")
+	}
+	server.svc.SetAuthKeys(cfg.AuthKeys)
+	server.svc.SetQueue(cfg.QueueSize, cfg.QueueTimeout)
+	server.svc.SetTimeouts(cfg.Timeouts)
+	for _, closer := range server.listeners {
+		if val, ok := closer.(*udpEntry); ok {
+			val.relay.SetIdleTimeout(cfg.UDPIdleTimeout)
+		}
+	}
+	for name, target := range cfg.Forwards {
+		logger.Info("forward target", "tunnel", name, "target", target)
+	}
+	if len(cfg.Forwards) > 0 && len(cfg.AuthKeys) == 0 {
+		logger.Warn("no auth keys configured, any client can reach the forward targets")
+	}
+	starts := server.listenerStarts(cfg)
+	for key, closer := range server.listeners {
+		if _, ok := starts[key]; !ok {
+			closer.Close()
+			delete(server.listeners, key)
+			logger.Info("listener closed", "listener", key)
+		}
+	}
+	keys := make([]string, 0, len(starts))
+	for key := range starts {
+		if _, ok := server.listeners[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		closer, e := starts[key]()
+		if nil != e {
+			logger.Error("start listener failed", "listener", key, "err", e)
+			if nil == err {
+				err = e
+			}
+			continue
+		}
+		server.listeners[key] = closer
+	}
+	return err
+}
+
+// shutdown 停止服务: 关闭所有监听, 等待正在传输的会话结束, 超时或再次收到停止信号时关闭剩余的会话
+func (server *tunnelServer) shutdown(timeout time.Duration, signals chan os.Signal) {
+	logger := logtool.Default()
+	logger.Info("shutting down", "timeout", timeout)
+	server.lock.Lock()
+	server.closed = true
+	for key, closer := range server.listeners {
+		closer.Close()
+		delete(server.listeners, key)
+	}
+	server.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				cancel()
+				return
+			}
+		}
 	}()
-	err = doStartService(laddr, TCPTunnelService)
+	if err := server.svc.Stop(ctx); nil != err {
+		logger.Warn("sessions closed before they ended", "err", err)
+	}
+}
+
+// listenerStarts 配置中所有监听的启动函数, key为监听的定义
+func (server *tunnelServer) listenerStarts(cfg *serviceConfig) map[string]func() (io.Closer, error) {
+	starts := make(map[string]func() (io.Closer, error))
+	for _, val := range cfg.Entries {
+		val := val
+		starts[val.key()] = func() (io.Closer, error) {
+			logtool.Default().Info("entry listening", "addr", val.Addr.String(), "tunnel", val.Tunnel, "mode", val.Mode)
+			if val.Mode == tcpmsgexchanger.MODEUDP {
+				return server.doStartUDPService(val)
+			}
+			return server.doStartService(val)
+		}
+	}
+	if len(cfg.VHostAddr) > 0 {
+		addr := cfg.VHostAddr
+		starts["vhost:"+addr] = func() (io.Closer, error) {
+			logtool.Default().Info("vhost listening", "addr", addr)
+			return listen(addr, server.doVHost)
+		}
+	}
+	if len(cfg.SocksAddr) > 0 {
+		addr := cfg.SocksAddr
+		starts["socks:"+addr] = func() (io.Closer, error) {
+			logtool.Default().Info("socks5 listening", "addr", addr, "tunnel", cfg.SocksTunnel, "auth", len(cfg.SocksUsers) > 0)
+			return listen(addr, server.doSocks)
+		}
+	}
+	if len(cfg.HTTPProxyAddr) > 0 {
+		addr := cfg.HTTPProxyAddr
+		starts["httpproxy:"+addr] = func() (io.Closer, error) {
+			logtool.Default().Info("http proxy listening", "addr", addr, "tunnel", cfg.HTTPProxyTunnel, "auth", len(cfg.HTTPProxyUsers) > 0)
+			return listen(addr, server.doHTTPProxy)
+		}
+	}
+	if len(cfg.AdminAddr) > 0 {
+		addr := cfg.AdminAddr
+		starts["admin:"+addr] = func() (io.Closer, error) {
+			logtool.Default().Info("admin api listening", "addr", addr, "auth", len(cfg.AdminToken) > 0)
+			listener, err := net.Listen("tcp4", addr)
+			if nil != err {
+				return nil, err
+			}
+			// 每个请求按当前配置的令牌创建路由, 修改令牌不需要重启监听
+			go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tcptunnelmanager.NewAdminRouter(server.svc, server.getConfig().AdminToken).ServeHTTP(w, r)
+			}))
+			return listener, nil
+		}
+	}
+	if len(cfg.MetricsAddr) > 0 {
+		addr := cfg.MetricsAddr
+		starts["metrics:"+addr] = func() (io.Closer, error) {
+			logtool.Default().Info("metrics listening", "addr", addr)
+			return serveMetrics(addr, server.svc.Metrics())
+		}
+	}
+	return starts
+}
+
+// serveMetrics 启动监控指标端口, 指标地址为 /metrics
+func serveMetrics(addr string, metrics http.Handler) (io.Closer, error) {
+	listener, err := net.Listen("tcp4", addr)
 	if nil != err {
-		panic(err)
+		return nil, err
 	}
-	fmt.Print("Ctrl+C退出程序")
-	var sc string
-	fmt.Scan(&sc)
-	fmt.Println(sc)
+	router := &hstool.ServiceRouter{}
+	router.AddHandler("/metrics", metrics.ServeHTTP)
+	go http.Serve(listener, router)
+	return listener, nil
 }
 
-// doStartService 启动服务端口
-func doStartService(addr *net.TCPAddr, TCPTunnelService *tcptunnelmanager.TCPTunnelService) (err error) {
-	listener, err := net.ListenTCP("tcp", addr)
-	if nil == err {
+// listen 启动监听, 每个连接交给handle处理, 监听关闭后停止接收
+func listen(addr string, handle func(net.Conn)) (io.Closer, error) {
+	laddr, err := net.ResolveTCPAddr("tcp4", addr)
+	if nil != err {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", laddr)
+	if nil != err {
+		return nil, err
+	}
+	go func() {
 		for {
 			// 监听请求
-			srcConn, err := listener.Accept()
+			conn, err := listener.Accept()
 			if nil != err {
-				fmt.Println(err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				logtool.Default().Warn("accept failed", "addr", addr, "err", err)
 				continue
 			}
-			go (func() {
-				destConn := TCPTunnelService.GetConn()
-				if nil != destConn {
-					defer (func() {
-						if nil != srcConn {
-							srcConn.Close()
-						}
-						TCPTunnelService.RelaseConn(destConn)
-					})()
-					// 交换数据
-					TCPExchanger := &tcpmsgexchanger.TCPExchanger4HHTTP{}
-					TCPExchanger.SetDebug(true)
-					err = TCPExchanger.ExchangeData(srcConn, destConn)
-					if nil != err {
-						fmt.Println("交换数据错误: ", err)
-					}
-				} else {
-					srcConn.Close()
-				}
-			})()
+			go handle(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// doStartService 启动入口端口, 收到的连接转发到入口对应的隧道
+// 入口端口有目标地址路由时, 目标地址随传输信息发送; HTTP入口有请求路由时, 每个请求分别选择目标地址
+func (server *tunnelServer) doStartService(val entry) (io.Closer, error) {
+	return listen(val.Addr.String(), func(srcConn net.Conn) {
+		router := server.getConfig().Dests
+		info := tcptunnelmanager.TransportInfo{
+			Tunnel: val.Tunnel,
+			Mode:   val.Mode,
 		}
+		info.Dest, _ = router.MatchPort(val.Addr.Port)
+		if len(info.Dest) == 0 && val.Mode == tcpmsgexchanger.MODEHTTP && router.HasRequestRules() {
+			server.doRouteTransport(srcConn, info, router)
+			return
+		}
+		doTransport(srcConn, info, server.svc)
+	})
+}
+
+// udpEntry 已启动的UDP入口, 重新加载配置时更新会话空闲超时时间
+type udpEntry struct {
+	*net.UDPConn
+	relay *tcptunnelentry.UDPRelay
+}
+
+// doStartUDPService 启动UDP入口端口, 每个来源地址使用一个隧道连接转发数据报
+func (server *tunnelServer) doStartUDPService(val entry) (io.Closer, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: val.Addr.IP, Port: val.Addr.Port})
+	if nil != err {
+		return nil, err
 	}
-	return err
+	relay := tcptunnelentry.NewUDPRelay(conn, func() net.Conn {
+		info := tcptunnelmanager.TransportInfo{
+			Tunnel: val.Tunnel,
+			Mode:   val.Mode,
+		}
+		info.Dest, _ = server.getConfig().Dests.MatchPort(val.Addr.Port)
+		return server.svc.GetConn(info)
+	}, server.svc.RelaseConn)
+	relay.SetIdleTimeout(server.getConfig().UDPIdleTimeout)
+	go func() {
+		if err := relay.Serve(); nil != err && !errors.Is(err, net.ErrClosed) {
+			logtool.Default().Error("udp entry stopped", "addr", val.Addr.String(), "err", err)
+		}
+	}()
+	return &udpEntry{UDPConn: conn, relay: relay}, nil
+}
+
+// doVHost 虚拟主机连接, 根据Host头或SNI选择隧道, 没有主机名时使用默认隧道
+// HTTP连接上的每个请求按各自的Host头选择隧道, 按HTTP模式转发; TLS连接不解密, 按SNI选择一次, 按原始TCP模式转发
+func (server *tunnelServer) doVHost(srcConn net.Conn) {
+	pconn := tcptunnelentry.NewPeekConn(srcConn)
+	pconn.SetReadDeadline(time.Now().Add(server.getConfig().RequestTimeout))
+	host, isTLS, err := tcptunnelentry.SniffHost(pconn)
+	pconn.SetReadDeadline(time.Time{})
+	if nil != err && !errors.Is(err, tcptunnelentry.ErrNoHost) {
+		logtool.Default().Debug("virtual host sniff error", "remote", srcConn.RemoteAddr().String(), "err", err)
+		pconn.Close()
+		return
+	}
+	if !isTLS {
+		server.doRequestTransport(pconn, func(host string, uri string) (tcptunnelmanager.TransportInfo, bool) {
+			tunnel, ok := server.getConfig().VHosts.Match(host)
+			if !ok {
+				logtool.Default().Warn("no tunnel matches the virtual host", "host", host, "remote", srcConn.RemoteAddr().String())
+			}
+			return tcptunnelmanager.TransportInfo{Tunnel: tunnel, Mode: tcpmsgexchanger.MODEHTTP}, ok
+		})
+		return
+	}
+	tunnel, ok := server.getConfig().VHosts.Match(host)
+	if !ok {
+		logtool.Default().Warn("no tunnel matches the virtual host", "host", host, "remote", srcConn.RemoteAddr().String())
+		pconn.Close()
+		return
+	}
+	doTransport(pconn, tcptunnelmanager.TransportInfo{Tunnel: tunnel, Mode: tcpmsgexchanger.MODERAW}, server.svc)
+}
+
+// doSocks SOCKS5连接, 请求的目标地址随传输信息发送给隧道客户端, 由客户端连接
+func (server *tunnelServer) doSocks(srcConn net.Conn) {
+	cfg := server.getConfig()
+	srcConn.SetDeadline(time.Now().Add(cfg.RequestTimeout))
+	dest, err := tcptunnelentry.Socks5Handshake(srcConn, cfg.SocksUsers)
+	srcConn.SetDeadline(time.Time{})
+	if nil != err {
+		logtool.Default().Warn("socks5 handshake failed", "remote", srcConn.RemoteAddr().String(), "err", err)
+		srcConn.Close()
+		return
+	}
+	// 客户端连接目标后回复结果, 据此回复SOCKS客户端
+	info := tcptunnelmanager.TransportInfo{Tunnel: cfg.SocksTunnel, Mode: tcpmsgexchanger.MODERAW, Dest: dest, Confirm: true}
+	destConn := server.svc.GetConn(info)
+	if nil == destConn {
+		tcptunnelentry.Socks5Reply(srcConn, tcptunnelentry.SOCKS5REPFAILURE)
+		srcConn.Close()
+		return
+	}
+	if err := server.svc.ReadDialResult(destConn, info.Tunnel); nil != err {
+		logtool.Default().Warn("socks5 connect failed", "remote", srcConn.RemoteAddr().String(), "dest", dest, "err", err)
+		tcptunnelentry.Socks5Reply(srcConn, tcptunnelentry.Socks5ReplyCode(err))
+		srcConn.Close()
+		server.svc.RelaseConn(destConn)
+		return
+	}
+	if err := tcptunnelentry.Socks5Reply(srcConn, tcptunnelentry.SOCKS5REPSUCCEEDED); nil != err {
+		srcConn.Close()
+		server.svc.RelaseConn(destConn)
+		return
+	}
+	doExchange(srcConn, destConn, info, server.svc)
+}
+
+// doHTTPProxy HTTP代理连接, 请求的目标地址随传输信息发送给隧道客户端, 由客户端连接
+// CONNECT请求按原始TCP模式转发; 绝对地址请求按HTTP模式逐个转发, 每个请求分别获取隧道连接, 可以发往不同的目标
+func (server *tunnelServer) doHTTPProxy(srcConn net.Conn) {
+	pconn := tcptunnelentry.NewPeekConn(srcConn)
+	defer pconn.Close()
+	for first := true; ; first = false {
+		cfg := server.getConfig()
+		pconn.SetReadDeadline(time.Now().Add(cfg.RequestTimeout))
+		req, err := tcptunnelentry.ReadProxyRequest(pconn)
+		pconn.SetReadDeadline(time.Time{})
+		if nil != err {
+			// 保持的连接上客户端关闭或空闲超时时直接结束
+			if first || errors.Is(err, tcptunnelentry.ErrProxyRequest) {
+				logtool.Default().Warn("http proxy request error", "remote", srcConn.RemoteAddr().String(), "err", err)
+				tcptunnelentry.WriteHTTPStatus(pconn, http.StatusBadRequest, nil)
+			}
+			return
+		}
+		if !req.CheckAuth(cfg.HTTPProxyUsers) {
+			tcptunnelentry.WriteHTTPStatus(pconn, http.StatusProxyAuthRequired, map[string]string{
+				"Proxy-Authenticate": `Basic realm="tcptunnel"`,
+			})
+			return
+		}
+		info := tcptunnelmanager.TransportInfo{Tunnel: cfg.HTTPProxyTunnel, Mode: tcpmsgexchanger.MODEHTTP, Dest: req.Dest}
+		if !req.IsConnect {
+			if !server.exchangeRequest(pconn, info) {
+				return
+			}
+			continue
+		}
+		info.Mode = tcpmsgexchanger.MODERAW
+		destConn := server.svc.GetConn(info)
+		if nil == destConn {
+			writeUnavailable(pconn)
+			return
+		}
+		if _, err := pconn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); nil != err {
+			server.svc.RelaseConn(destConn)
+			return
+		}
+		doExchange(pconn, destConn, info, server.svc)
+		return
+	}
+}
+
+// doForward 反向转发: 根据当前配置找到隧道对应的服务端目标
+func (server *tunnelServer) doForward(conn net.Conn, info tcptunnelmanager.TransportInfo) error {
+	target, ok := server.getConfig().Forwards[info.Tunnel]
+	if !ok {
+		logtool.Default().Warn("forward tunnel not found", "tunnel", info.Tunnel)
+		return errors.New("forward tunnel not found: " + info.Tunnel)
+	}
+	return doForwardTarget(conn, info.Tunnel, target)
+}
+
+// doRouteTransport 按HTTP请求选择目标地址, 同一个连接上的每个请求分别获取隧道连接
+// 没有匹配的规则时不指定目标地址, 由客户端使用隧道配置的目标
+func (server *tunnelServer) doRouteTransport(srcConn net.Conn, info tcptunnelmanager.TransportInfo, router *tcptunnelentry.DestRouter) {
+	server.doRequestTransport(tcptunnelentry.NewPeekConn(srcConn), func(host string, uri string) (tcptunnelmanager.TransportInfo, bool) {
+		info.Dest, _ = router.MatchRequest(host, uri)
+		return info, true
+	})
+}
+
+// doRequestTransport 逐个转发连接上的HTTP请求, 每个请求由route根据Host和URI决定传输信息, 分别获取隧道连接
+// route 返回false时回复404并关闭连接
+func (server *tunnelServer) doRequestTransport(pconn *tcptunnelentry.PeekConn, route func(host string, uri string) (tcptunnelmanager.TransportInfo, bool)) {
+	defer pconn.Close()
+	for {
+		pconn.SetReadDeadline(time.Now().Add(server.getConfig().RequestTimeout))
+		host, uri, err := tcptunnelentry.SniffRequest(pconn)
+		pconn.SetReadDeadline(time.Time{})
+		if nil != err {
+			return
+		}
+		info, ok := route(host, uri)
+		if !ok {
+			tcptunnelentry.WriteHTTPStatus(pconn, http.StatusNotFound, nil)
+			return
+		}
+		if !server.exchangeRequest(pconn, info) {
+			return
+		}
+	}
+}
+
+// exchangeRequest 获取隧道连接转发一个HTTP请求和它的响应, 返回入口连接是否可以继续转发下一个请求
+// 没有可用的隧道连接时回复503
+func (server *tunnelServer) exchangeRequest(pconn *tcptunnelentry.PeekConn, info tcptunnelmanager.TransportInfo) bool {
+	TCPExchanger := newExchanger(info).(*tcpmsgexchanger.TCPExchanger4HHTTP)
+	destConn := server.svc.GetConn(info)
+	if nil == destConn {
+		writeUnavailable(pconn)
+		return false
+	}
+	keepAlive, err := TCPExchanger.ExchangeRequest(pconn, destConn)
+	// 通知客户端本次传输不会再有请求, 然后归还隧道连接
+	if cw, ok := destConn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	TCPExchanger.Pending(destConn)
+	server.svc.RelaseConn(destConn)
+	if nil != err {
+		logtool.Default().Debug("exchange error", "tunnel", info.Tunnel, "remote", pconn.RemoteAddr().String(), "err", err)
+		return false
+	}
+	if !keepAlive {
+		return false
+	}
+	// 管道化请求中已读取的下一个请求放回连接
+	pconn.Unread(TCPExchanger.Pending(pconn))
+	return true
+}
+
+// doTransport 获取隧道连接并交换数据, 没有可用的隧道连接时关闭入口连接, HTTP模式先回复503
+func doTransport(srcConn net.Conn, info tcptunnelmanager.TransportInfo, TCPTunnelService *tcptunnelmanager.TCPTunnelService) {
+	destConn := TCPTunnelService.GetConn(info)
+	if nil == destConn {
+		if info.Mode == tcpmsgexchanger.MODEHTTP {
+			writeUnavailable(srcConn)
+		}
+		srcConn.Close()
+		return
+	}
+	doExchange(srcConn, destConn, info, TCPTunnelService)
+}
+
+// writeUnavailable 没有可用的隧道连接(等待超时或隧道未注册)时回复503, 建议稍后重试
+func writeUnavailable(conn net.Conn) {
+	tcptunnelentry.WriteHTTPStatus(conn, http.StatusServiceUnavailable, map[string]string{"Retry-After": RETRYAFTER})
+}
+
+// doExchange 在入口连接和隧道连接之间交换数据, 结束后关闭入口连接并归还隧道连接
+func doExchange(srcConn net.Conn, destConn net.Conn, info tcptunnelmanager.TransportInfo, TCPTunnelService *tcptunnelmanager.TCPTunnelService) {
+	defer (func() {
+		srcConn.Close()
+		TCPTunnelService.RelaseConn(destConn)
+	})()
+	// 交换数据
+	TCPExchanger := newExchanger(info)
+	err := TCPExchanger.ExchangeData(srcConn, destConn)
+	if nil != err {
+		logtool.Default().Debug("exchange error", "tunnel", info.Tunnel, "remote", srcConn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// newExchanger 根据传输信息创建数据交换器, 日志带有隧道名称, HTTP模式按配置记录访问日志
+func newExchanger(info tcptunnelmanager.TransportInfo) tcpmsgexchanger.TCPMessageExchanger {
+	TCPExchanger, _ := tcpmsgexchanger.NewExchanger(info.Mode)
+	TCPExchanger.SetLogger(logtool.Default().With("tunnel", info.Tunnel))
+	if httpExchanger, ok := TCPExchanger.(*tcpmsgexchanger.TCPExchanger4HHTTP); ok && nil != accessLog {
+		httpExchanger.SetAccessLog(accessLog.With("tunnel", info.Tunnel))
+	}
+	return TCPExchanger
+}
+
+// doForwardTarget 反向转发: 连接服务端的目标并交换数据
+func doForwardTarget(conn net.Conn, tunnel string, target string) error {
+	destConn, err := net.Dial("tcp4", target)
+	if nil != err {
+		logtool.Default().Warn("forward dial target failed", "tunnel", tunnel, "target", target, "err", err)
+		return err
+	}
+	defer destConn.Close()
+	TCPExchanger := newExchanger(tcptunnelmanager.TransportInfo{Tunnel: tunnel, Mode: tcpmsgexchanger.MODERAW})
+	return TCPExchanger.ExchangeData(conn, destConn)
 }
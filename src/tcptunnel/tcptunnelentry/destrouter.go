@@ -0,0 +1,146 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 目标地址路由: 服务端为每次传输选择目标地址, 随传输信息发送给隧道客户端
+
+package tcptunnelentry
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tcptunnel/tcpmsgexchanger"
+)
+
+// DestRouter 目标地址路由表
+// 按入口端口选择目标; HTTP请求按路径前缀(最长优先)或主机名选择目标, 路径前缀优先
+type DestRouter struct {
+	hosts    *VHostRouter   // 主机名 -> 目标地址
+	hasHosts bool           // 是否有主机名路由
+	paths    []destPath     // 路径前缀, 按长度从长到短排列
+	ports    map[int]string // 入口端口 -> 目标地址
+	lock     sync.RWMutex
+}
+
+// destPath 路径前缀路由
+type destPath struct {
+	prefix string // 路径前缀, 以/开头
+	dest   string // 目标地址
+}
+
+// NewDestRouter 创建目标地址路由表
+func NewDestRouter() *DestRouter {
+	return &DestRouter{
+		hosts: NewVHostRouter(),
+		ports: make(map[int]string),
+	}
+}
+
+// AddRule 添加规则: host:主机名, path:路径前缀 或 port:入口端口, 例如 path:/api
+func (router *DestRouter) AddRule(rule string, dest string) error {
+	index := strings.IndexByte(rule, ':')
+	if index < 0 || index == len(rule)-1 {
+		return errors.New("dest rule format error: " + rule)
+	}
+	val := rule[index+1:]
+	switch rule[:index] {
+	case "host":
+		router.AddHost(val, dest)
+	case "path":
+		if !strings.HasPrefix(val, "/") {
+			return errors.New("dest path must start with /: " + rule)
+		}
+		router.AddPath(val, dest)
+	case "port":
+		port, err := strconv.Atoi(val)
+		if nil != err {
+			return errors.New("dest port error: " + rule)
+		}
+		router.AddPort(port, dest)
+	default:
+		return errors.New("dest rule type error: " + rule)
+	}
+	return nil
+}
+
+// AddHost 添加主机名路由, 支持通配域名(*.example.com)
+func (router *DestRouter) AddHost(host string, dest string) {
+	router.hosts.AddRoute(host, dest)
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.hasHosts = true
+}
+
+// AddPath 添加路径前缀路由
+func (router *DestRouter) AddPath(prefix string, dest string) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.paths = append(router.paths, destPath{prefix: strings.TrimSuffix(prefix, "/"), dest: dest})
+	sort.SliceStable(router.paths, func(i, j int) bool {
+		return len(router.paths[i].prefix) > len(router.paths[j].prefix)
+	})
+}
+
+// AddPort 添加入口端口路由
+func (router *DestRouter) AddPort(port int, dest string) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.ports[port] = dest
+}
+
+// HasRequestRules 是否有按HTTP请求选择目标的规则
+func (router *DestRouter) HasRequestRules() bool {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	return len(router.paths) > 0 || router.hasHosts
+}
+
+// MatchPort 查找入口端口对应的目标地址
+func (router *DestRouter) MatchPort(port int) (string, bool) {
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	dest, ok := router.ports[port]
+	return dest, ok
+}
+
+// MatchRequest 查找HTTP请求对应的目标地址, 路径前缀按路径段匹配(/api 匹配 /api/v1, 不匹配 /apix)
+func (router *DestRouter) MatchRequest(host string, uri string) (string, bool) {
+	path := uri
+	if parsed, err := url.ParseRequestURI(uri); nil == err {
+		path = parsed.Path
+	}
+	router.lock.RLock()
+	for _, val := range router.paths {
+		if len(val.prefix) == 0 || path == val.prefix || strings.HasPrefix(path, val.prefix+"/") {
+			router.lock.RUnlock()
+			return val.dest, true
+		}
+	}
+	router.lock.RUnlock()
+	return router.hosts.Match(host)
+}
+
+// SniffRequest 预读HTTP请求头, 返回主机名和请求地址, 不消耗数据
+func SniffRequest(pconn *PeekConn) (host string, uri string, err error) {
+	header, err := pconn.PeekUntil([]byte("\r\n\r\n"))
+	if nil != err {
+		return "", "", err
+	}
+	parser := tcpmsgexchanger.NewHTTPParser("")
+	if _, err := parser.Feed(header); nil != err {
+		return "", "", err
+	}
+	if !parser.HeaderDone() || parser.IsResponse() {
+		return "", "", ErrNoHost
+	}
+	return normalizeHost(parser.Header("Host")), parser.URI(), nil
+}
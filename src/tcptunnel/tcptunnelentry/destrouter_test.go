@@ -0,0 +1,58 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelentry
+
+import (
+	"testing"
+)
+
+// 测试目标地址路由: 路径前缀按路径段最长匹配, 路径优先于主机名
+func TestDestRouter(t *testing.T) {
+	router := NewDestRouter()
+	rules := map[string]string{
+		"path:/api":       "10.0.0.6:8080",
+		"path:/api/v2/":   "10.0.0.7:8080",
+		"host:a.corp.com": "10.0.0.5:80",
+		"host:*.corp.com": "10.0.0.9:80",
+		"port:8081":       "10.0.0.8:22",
+	}
+	for rule, dest := range rules {
+		if err := router.AddRule(rule, dest); nil != err {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		host, uri, dest string
+	}{
+		{"a.corp.com", "/api", "10.0.0.6:8080"},
+		{"a.corp.com", "/api/v1?x=/api/v2", "10.0.0.6:8080"},
+		{"a.corp.com", "/api/v2/users", "10.0.0.7:8080"},
+		{"a.corp.com", "/apix", "10.0.0.5:80"},
+		{"b.corp.com", "/", "10.0.0.9:80"},
+		{"other.com", "/", ""},
+	}
+	for _, c := range cases {
+		dest, ok := router.MatchRequest(c.host, c.uri)
+		if dest != c.dest || ok != (len(c.dest) > 0) {
+			t.Fatal(c.host, c.uri, dest)
+		}
+	}
+	if dest, ok := router.MatchPort(8081); !ok || dest != "10.0.0.8:22" {
+		t.Fatal("port", dest)
+	}
+	if !router.HasRequestRules() || NewDestRouter().HasRequestRules() {
+		t.Fatal("request rules")
+	}
+	for _, rule := range []string{"path:api", "port:x", "uri:/", "host:"} {
+		if err := router.AddRule(rule, "x:1"); nil == err {
+			t.Fatal("rule accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// HTTP代理入口: 支持 CONNECT host:port 隧道和绝对地址形式(GET http://host/)的请求
+
+package tcptunnelentry
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"tcptunnel/tcpmsgexchanger"
+)
+
+// ErrProxyRequest 不是代理请求
+var ErrProxyRequest = errors.New("not a proxy request")
+
+// proxyHeaders 只在客户端和代理之间有效的头信息, 转发时删除
+var proxyHeaders = []string{"Proxy-Connection", "Proxy-Authorization", "Connection", "Keep-Alive"}
+
+// ProxyRequest 代理请求
+type ProxyRequest struct {
+	Method    string      // 请求方法
+	Dest      string      // 目标地址(host:port)
+	IsConnect bool        // 是否是CONNECT请求
+	Header    http.Header // 原始头信息
+}
+
+// ReadProxyRequest 读取代理请求头
+// CONNECT请求的头会被消费, 之后的数据直接转发; 绝对地址形式的请求改写为相对地址, 连接是否保持按客户端的意图,
+// 调用方每个请求分别获取隧道连接, 同一个代理连接上的下一个请求可以发往其他目标
+func ReadProxyRequest(pconn *PeekConn) (*ProxyRequest, error) {
+	header, err := pconn.PeekUntil([]byte("\r\n\r\n"))
+	if nil != err {
+		return nil, err
+	}
+	parser := tcpmsgexchanger.NewHTTPParser("")
+	if _, err := parser.Feed(header); nil != err {
+		return nil, err
+	}
+	if !parser.HeaderDone() || parser.IsResponse() {
+		return nil, ErrProxyRequest
+	}
+	req := &ProxyRequest{Method: parser.Method(), Header: parser.Headers()}
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(parser.URI()); nil != err {
+			return nil, ErrProxyRequest
+		}
+		req.IsConnect = true
+		req.Dest = parser.URI()
+		return req, pconn.Rewrite(len(header), nil)
+	}
+	target, err := url.Parse(parser.URI())
+	if nil != err || target.Scheme != "http" || len(target.Host) == 0 {
+		return nil, ErrProxyRequest
+	}
+	port := target.Port()
+	if len(port) == 0 {
+		port = "80"
+	}
+	req.Dest = net.JoinHostPort(target.Hostname(), port)
+	return req, pconn.Rewrite(len(header), rewriteRequest(header, parser, target))
+}
+
+// rewriteRequest 改写请求头: 请求行使用相对地址, 删除代理相关的头信息
+// 代理客户端用 Proxy-Connection 表示是否保持连接, 没有时使用 Connection, 改写为发给目标的 Connection
+func rewriteRequest(header []byte, parser *tcpmsgexchanger.HTTPParser, target *url.URL) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(parser.Method() + " " + target.RequestURI() + " " + parser.Version() + "\r\n")
+	lines := strings.Split(string(header), "\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		index := strings.IndexByte(line, ':')
+		if index <= 0 {
+			continue
+		}
+		name := strings.TrimSpace(line[:index])
+		skip := false
+		for _, val := range proxyHeaders {
+			if strings.EqualFold(name, val) {
+				skip = true
+			}
+		}
+		if !skip {
+			buf.WriteString(line + "\r\n")
+		}
+	}
+	if len(parser.Header("Host")) == 0 {
+		buf.WriteString("Host: " + target.Host + "\r\n")
+	}
+	connection := parser.Header("Proxy-Connection")
+	if len(connection) == 0 {
+		connection = parser.Header("Connection")
+	}
+	connection = strings.ToLower(connection)
+	if strings.Contains(connection, "close") || (parser.Version() == "HTTP/1.0" && !strings.Contains(connection, "keep-alive")) {
+		buf.WriteString("Connection: close\r\n\r\n")
+	} else {
+		buf.WriteString("Connection: keep-alive\r\n\r\n")
+	}
+	return buf.Bytes()
+}
+
+// CheckAuth 检查 Proxy-Authorization 中的用户名密码, users 为空时不需要认证
+func (req *ProxyRequest) CheckAuth(users map[string]string) bool {
+	if len(users) == 0 {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len("Basic "):]))
+	if nil != err {
+		return false
+	}
+	index := strings.IndexByte(string(decoded), ':')
+	if index < 0 {
+		return false
+	}
+	expected, ok := users[string(decoded[:index])]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), decoded[index+1:]) == 1
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelentry
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readProxy 发送数据后读取代理请求, 返回请求和之后从连接读到的所有数据
+func readProxy(t *testing.T, data string) (*ProxyRequest, string, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+	pconn := NewPeekConn(server)
+	req, err := ReadProxyRequest(pconn)
+	if nil != err {
+		return nil, "", err
+	}
+	rest, _ := io.ReadAll(pconn)
+	return req, string(rest), nil
+}
+
+// 测试代理请求: CONNECT 的头被消费, 绝对地址请求被改写
+func TestReadProxyRequest(t *testing.T) {
+	req, rest, err := readProxy(t, "CONNECT git.corp.local:443 HTTP/1.1\r\nHost: git.corp.local:443\r\n\r\nTLS")
+	if nil != err || !req.IsConnect || req.Dest != "git.corp.local:443" || rest != "TLS" {
+		t.Fatal("connect", req, rest, err)
+	}
+	req, rest, err = readProxy(t, "POST http://wiki.corp.local/a/b?c=d HTTP/1.1\r\nHost: wiki.corp.local\r\n"+
+		"Proxy-Connection: keep-alive\r\nProxy-Authorization: Basic eA==\r\nContent-Length: 4\r\n\r\nbody")
+	if nil != err || req.IsConnect || req.Dest != "wiki.corp.local:80" {
+		t.Fatal("absolute", req, err)
+	}
+	expected := "POST /a/b?c=d HTTP/1.1\r\nHost: wiki.corp.local\r\nContent-Length: 4\r\nConnection: keep-alive\r\n\r\nbody"
+	if rest != expected {
+		t.Fatalf("rewrite %q", rest)
+	}
+	// 按客户端的意图保持或关闭连接, Proxy-Connection 优先
+	connections := []struct {
+		version string
+		header  string
+		expect  string
+	}{
+		{"HTTP/1.1", "", "keep-alive"},
+		{"HTTP/1.1", "Proxy-Connection: close\r\nConnection: keep-alive\r\n", "close"},
+		{"HTTP/1.1", "Connection: close\r\n", "close"},
+		{"HTTP/1.0", "", "close"},
+		{"HTTP/1.0", "Proxy-Connection: Keep-Alive\r\n", "keep-alive"},
+	}
+	for _, c := range connections {
+		_, rest, err = readProxy(t, "GET http://wiki.corp.local/ "+c.version+"\r\nHost: wiki.corp.local\r\n"+c.header+"\r\n")
+		if nil != err || !strings.HasSuffix(rest, "\r\nConnection: "+c.expect+"\r\n\r\n") || strings.Count(rest, "Connection:") != 1 {
+			t.Fatalf("connection %s %q: %q %v", c.version, c.header, rest, err)
+		}
+	}
+	req, rest, err = readProxy(t, "GET http://[::1]:8080 HTTP/1.1\r\n\r\n")
+	if nil != err || req.Dest != "[::1]:8080" || !strings.HasPrefix(rest, "GET / HTTP/1.1\r\nHost: [::1]:8080\r\n") {
+		t.Fatal("ipv6", req, rest, err)
+	}
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", "GET https://a/ HTTP/1.1\r\n\r\n", "CONNECT host HTTP/1.1\r\n\r\n"} {
+		if _, _, err := readProxy(t, data); err != ErrProxyRequest {
+			t.Fatal("not a proxy request", data, err)
+		}
+	}
+}
+
+// 测试代理认证
+func TestProxyCheckAuth(t *testing.T) {
+	users := map[string]string{"user": "pa:ss"}
+	req, _, _ := readProxy(t, "CONNECT a:443 HTTP/1.1\r\nProxy-Authorization: Basic "+
+		base64.StdEncoding.EncodeToString([]byte("user:pa:ss"))+"\r\n\r\n")
+	if !req.CheckAuth(users) || !req.CheckAuth(nil) {
+		t.Fatal("auth failed")
+	}
+	req, _, _ = readProxy(t, "CONNECT a:443 HTTP/1.1\r\nProxy-Authorization: Basic "+
+		base64.StdEncoding.EncodeToString([]byte("user:bad"))+"\r\n\r\n")
+	if req.CheckAuth(users) {
+		t.Fatal("auth passed with bad password")
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 入口直接回复的HTTP响应
+
+package tcptunnelentry
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// WriteHTTPStatus 回复只有状态的HTTP响应, 并要求客户端关闭连接
+func WriteHTTPStatus(w io.Writer, code int, headers map[string]string) error {
+	text := http.StatusText(code)
+	res := "HTTP/1.1 " + strconv.Itoa(code) + " " + text + "\r\n"
+	for key, val := range headers {
+		res += key + ": " + val + "\r\n"
+	}
+	res += "Content-Type: text/plain; charset=utf-8\r\n"
+	res += "Content-Length: " + strconv.Itoa(len(text)) + "\r\n"
+	res += "Connection: close\r\n\r\n" + text
+	_, err := io.WriteString(w, res)
+	return err
+}
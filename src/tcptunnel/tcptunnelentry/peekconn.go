@@ -0,0 +1,138 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 可预读的连接: 在不消耗数据的情况下查看连接开头的内容, 用于识别请求
+
+package tcptunnelentry
+
+import (
+	"bytes"
+	"errors"
+	"net"
+)
+
+const (
+	// PEEKMAXLEN 最多预读的字节数
+	PEEKMAXLEN = 1024 * 64
+	// PEEKREADLEN 预读时每次从连接读取的最小字节数
+	PEEKREADLEN = 1024 * 4
+)
+
+// ErrPeekTooLarge 预读超过最大长度仍未找到需要的内容
+var ErrPeekTooLarge = errors.New("peek data too large")
+
+// PeekConn 可预读的连接, 预读的数据在之后的 Read 中仍能读到
+// 预读和放回的数据保存在同一个缓冲中, 多次放回不会嵌套
+type PeekConn struct {
+	net.Conn
+	buf []byte // 已预读或放回、还未被读取的数据
+}
+
+// NewPeekConn 包装连接
+func NewPeekConn(conn net.Conn) *PeekConn {
+	if pconn, ok := conn.(*PeekConn); ok {
+		return pconn
+	}
+	return &PeekConn{Conn: conn}
+}
+
+// Read 读取数据, 优先返回缓冲的数据, 缓冲为空时直接读取连接
+func (pconn *PeekConn) Read(b []byte) (int, error) {
+	if len(pconn.buf) == 0 {
+		return pconn.Conn.Read(b)
+	}
+	n := copy(b, pconn.buf)
+	pconn.buf = pconn.buf[n:]
+	if len(pconn.buf) == 0 {
+		pconn.buf = nil
+	}
+	return n, nil
+}
+
+// Rewrite 丢弃开头的n个字节, 之后的读取先返回b, 用于改写已预读的请求头
+func (pconn *PeekConn) Rewrite(n int, b []byte) error {
+	if err := pconn.fill(n); nil != err {
+		return err
+	}
+	pconn.buf = pconn.buf[n:]
+	pconn.Unread(b)
+	return nil
+}
+
+// Unread 放回已经读取的数据, 之后的读取和预读先返回b
+func (pconn *PeekConn) Unread(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	buf := make([]byte, 0, len(b)+len(pconn.buf))
+	buf = append(buf, b...)
+	pconn.buf = append(buf, pconn.buf...)
+}
+
+// Peek 预读n个字节
+func (pconn *PeekConn) Peek(n int) ([]byte, error) {
+	if n > PEEKMAXLEN {
+		return nil, ErrPeekTooLarge
+	}
+	if err := pconn.fill(n); nil != err {
+		return nil, err
+	}
+	return pconn.buf[:n], nil
+}
+
+// PeekUntil 预读直到出现分隔符, 返回的数据包含分隔符
+func (pconn *PeekConn) PeekUntil(sep []byte) ([]byte, error) {
+	checked := 0
+	for {
+		// 只检查新读取的数据, 分隔符可能跨越两次读取
+		from := checked - len(sep) + 1
+		if from < 0 {
+			from = 0
+		}
+		if index := bytes.Index(pconn.buf[from:], sep); index > -1 {
+			return pconn.buf[:from+index+len(sep)], nil
+		}
+		if len(pconn.buf) >= PEEKMAXLEN {
+			return nil, ErrPeekTooLarge
+		}
+		checked = len(pconn.buf)
+		if err := pconn.fill(checked + 1); nil != err {
+			return nil, err
+		}
+	}
+}
+
+// fill 从连接读取数据, 直到缓冲中至少有n个字节
+func (pconn *PeekConn) fill(n int) error {
+	for len(pconn.buf) < n {
+		if cap(pconn.buf)-len(pconn.buf) < PEEKREADLEN {
+			size := n - len(pconn.buf)
+			if size < PEEKREADLEN {
+				size = PEEKREADLEN
+			}
+			buf := make([]byte, len(pconn.buf), len(pconn.buf)+size)
+			copy(buf, pconn.buf)
+			pconn.buf = buf
+		}
+		m, err := pconn.Conn.Read(pconn.buf[len(pconn.buf):cap(pconn.buf)])
+		pconn.buf = pconn.buf[:len(pconn.buf)+m]
+		if nil != err && len(pconn.buf) < n {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseWrite 关闭写入方向
+func (pconn *PeekConn) CloseWrite() error {
+	if cw, ok := pconn.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelentry
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// 测试预读和放回: 多次放回的数据按顺序读到, 缓冲不会随放回次数增长
+func TestPeekConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		remote.Write([]byte("GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\nbody"))
+		remote.Close()
+	}()
+	pconn := NewPeekConn(local)
+	if NewPeekConn(pconn) != pconn {
+		t.Fatal("peek conn should not be wrapped twice")
+	}
+	header, err := pconn.PeekUntil([]byte("\r\n\r\n"))
+	if nil != err || !strings.HasPrefix(string(header), "GET / HTTP/1.1") || !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		t.Fatal("peek until error: ", string(header), err)
+	}
+	b, err := pconn.Peek(3)
+	if nil != err || string(b) != "GET" {
+		t.Fatal("peek error: ", string(b), err)
+	}
+	// 改写请求行
+	if err := pconn.Rewrite(len("GET /"), []byte("GET /api")); nil != err {
+		t.Fatal(err)
+	}
+	line := make([]byte, len("GET /api HTTP/1.1\r\n"))
+	if _, err := io.ReadFull(pconn, line); nil != err || string(line) != "GET /api HTTP/1.1\r\n" {
+		t.Fatal("rewrite error: ", string(line), err)
+	}
+	// 反复读取一个字节再放回, 缓冲长度保持不变
+	size := len(pconn.buf)
+	one := make([]byte, 1)
+	for i := 0; i < 10000; i++ {
+		if _, err := pconn.Read(one); nil != err {
+			t.Fatal(err)
+		}
+		pconn.Unread(one)
+	}
+	if len(pconn.buf) != size || cap(pconn.buf) > PEEKMAXLEN {
+		t.Fatal("buffer grows with unread: ", len(pconn.buf), cap(pconn.buf))
+	}
+	pconn.Unread([]byte("X-"))
+	rest, err := io.ReadAll(pconn)
+	if nil != err || string(rest) != "X-Host: a.example.com\r\n\r\nbody" {
+		t.Fatal("read error: ", string(rest), err)
+	}
+}
+
+// 测试预读超过最大长度
+func TestPeekTooLarge(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		remote.Write(bytes.Repeat([]byte("a"), PEEKMAXLEN+10))
+		remote.Close()
+	}()
+	pconn := NewPeekConn(local)
+	if _, err := pconn.Peek(PEEKMAXLEN + 1); err != ErrPeekTooLarge {
+		t.Fatal("peek should be too large: ", err)
+	}
+	if _, err := pconn.PeekUntil([]byte("\r\n")); err != ErrPeekTooLarge {
+		t.Fatal("peek until should be too large: ", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// SOCKS5入口(RFC 1928), 只支持 CONNECT 命令, 可选用户名密码认证(RFC 1929)
+
+package tcptunnelentry
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	// SOCKS5VERSION 协议版本
+	SOCKS5VERSION = 0x05
+	// SOCKS5AUTHVERSION 用户名密码认证的协议版本
+	SOCKS5AUTHVERSION = 0x01
+
+	// SOCKS5METHODNOAUTH 不需要认证
+	SOCKS5METHODNOAUTH = 0x00
+	// SOCKS5METHODUSERPASS 用户名密码认证
+	SOCKS5METHODUSERPASS = 0x02
+	// SOCKS5METHODNONE 没有可接受的认证方式
+	SOCKS5METHODNONE = 0xFF
+
+	// SOCKS5CMDCONNECT CONNECT命令
+	SOCKS5CMDCONNECT = 0x01
+
+	// SOCKS5ATYPIPV4 IPv4地址
+	SOCKS5ATYPIPV4 = 0x01
+	// SOCKS5ATYPDOMAIN 域名
+	SOCKS5ATYPDOMAIN = 0x03
+	// SOCKS5ATYPIPV6 IPv6地址
+	SOCKS5ATYPIPV6 = 0x04
+
+	// SOCKS5REPSUCCEEDED 成功
+	SOCKS5REPSUCCEEDED = 0x00
+	// SOCKS5REPFAILURE 一般错误
+	SOCKS5REPFAILURE = 0x01
+	// SOCKS5REPNOTALLOWED 规则不允许
+	SOCKS5REPNOTALLOWED = 0x02
+	// SOCKS5REPHOSTUNREACHABLE 主机不可达
+	SOCKS5REPHOSTUNREACHABLE = 0x04
+	// SOCKS5REPCMDNOTSUPPORTED 不支持的命令
+	SOCKS5REPCMDNOTSUPPORTED = 0x07
+	// SOCKS5REPATYPNOTSUPPORTED 不支持的地址类型
+	SOCKS5REPATYPNOTSUPPORTED = 0x08
+)
+
+var (
+	// ErrSocks5Version 不是SOCKS5协议
+	ErrSocks5Version = errors.New("socks version not supported")
+	// ErrSocks5Auth 认证失败
+	ErrSocks5Auth = errors.New("socks authentication failed")
+)
+
+// Socks5Handshake 处理SOCKS5的认证和请求, 返回请求的目标地址(host:port)
+// users 不为空时要求用户名密码认证; 请求不被支持时会回复错误后返回
+func Socks5Handshake(conn net.Conn, users map[string]string) (string, error) {
+	// 1. 协商认证方式: VER NMETHODS METHODS
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); nil != err {
+		return "", err
+	}
+	if header[0] != SOCKS5VERSION {
+		return "", ErrSocks5Version
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); nil != err {
+		return "", err
+	}
+	method := byte(SOCKS5METHODNOAUTH)
+	if len(users) > 0 {
+		method = SOCKS5METHODUSERPASS
+	}
+	accepted := false
+	for _, val := range methods {
+		if val == method {
+			accepted = true
+		}
+	}
+	if !accepted {
+		conn.Write([]byte{SOCKS5VERSION, SOCKS5METHODNONE})
+		return "", ErrSocks5Auth
+	}
+	if _, err := conn.Write([]byte{SOCKS5VERSION, method}); nil != err {
+		return "", err
+	}
+	// 2. 用户名密码认证
+	if method == SOCKS5METHODUSERPASS {
+		if err := socks5Auth(conn, users); nil != err {
+			return "", err
+		}
+	}
+	// 3. 请求: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); nil != err {
+		return "", err
+	}
+	if request[0] != SOCKS5VERSION {
+		return "", ErrSocks5Version
+	}
+	if request[1] != SOCKS5CMDCONNECT {
+		Socks5Reply(conn, SOCKS5REPCMDNOTSUPPORTED)
+		return "", errors.New("socks command not supported: " + strconv.Itoa(int(request[1])))
+	}
+	var host string
+	switch request[3] {
+	case SOCKS5ATYPIPV4, SOCKS5ATYPIPV6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == SOCKS5ATYPIPV6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); nil != err {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case SOCKS5ATYPDOMAIN:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); nil != err {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); nil != err {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		Socks5Reply(conn, SOCKS5REPATYPNOTSUPPORTED)
+		return "", errors.New("socks address type not supported: " + strconv.Itoa(int(request[3])))
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); nil != err {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5Auth 用户名密码认证: VER ULEN UNAME PLEN PASSWD
+func socks5Auth(conn net.Conn, users map[string]string) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); nil != err {
+		return err
+	}
+	if header[0] != SOCKS5AUTHVERSION {
+		return ErrSocks5Auth
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); nil != err {
+		return err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); nil != err {
+		return err
+	}
+	pass := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, pass); nil != err {
+		return err
+	}
+	expected, ok := users[string(user)]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), pass) != 1 {
+		conn.Write([]byte{SOCKS5AUTHVERSION, 0x01})
+		return ErrSocks5Auth
+	}
+	_, err := conn.Write([]byte{SOCKS5AUTHVERSION, 0x00})
+	return err
+}
+
+// Socks5ReplyCode 根据隧道客户端的目标连接结果选择回复码
+// 带状态码的错误(如 tcptunnelmanager.DialError)中403为规则不允许, 其他为主机不可达; 没有状态码的错误为一般错误
+func Socks5ReplyCode(err error) byte {
+	if nil == err {
+		return SOCKS5REPSUCCEEDED
+	}
+	var coder interface{ StatusCode() int }
+	if !errors.As(err, &coder) {
+		return SOCKS5REPFAILURE
+	}
+	if coder.StatusCode() == 403 {
+		return SOCKS5REPNOTALLOWED
+	}
+	return SOCKS5REPHOSTUNREACHABLE
+}
+
+// Socks5Reply 回复请求结果, 绑定地址固定为 0.0.0.0:0
+func Socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{SOCKS5VERSION, rep, 0x00, SOCKS5ATYPIPV4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelentry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// socks5Client 模拟客户端发送认证和CONNECT请求, 返回服务端回复的所有数据
+func socks5Client(conn net.Conn, auth []byte, request []byte) []byte {
+	go func() {
+		if nil == auth {
+			conn.Write([]byte{SOCKS5VERSION, 1, SOCKS5METHODNOAUTH})
+		} else {
+			conn.Write([]byte{SOCKS5VERSION, 2, SOCKS5METHODNOAUTH, SOCKS5METHODUSERPASS})
+			conn.Write(auth)
+		}
+		conn.Write(request)
+	}()
+	data, _ := io.ReadAll(conn)
+	return data
+}
+
+// 测试SOCKS5握手: 地址类型、用户名密码认证和不支持的命令
+func TestSocks5Handshake(t *testing.T) {
+	users := map[string]string{"user": "pass"}
+	domain := append([]byte{SOCKS5VERSION, SOCKS5CMDCONNECT, 0, SOCKS5ATYPDOMAIN, 11}, []byte("example.com")...)
+	cases := []struct {
+		name    string
+		users   map[string]string
+		auth    []byte
+		request []byte
+		dest    string
+		reply   []byte
+	}{
+		{"ipv4", nil, nil, []byte{5, 1, 0, SOCKS5ATYPIPV4, 10, 0, 0, 1, 0, 22}, "10.0.0.1:22", []byte{5, 0}},
+		{"ipv6", nil, nil, append(append([]byte{5, 1, 0, SOCKS5ATYPIPV6}, net.ParseIP("::1")...), 0, 80), "[::1]:80", []byte{5, 0}},
+		{"domain", users, []byte("\x01\x04user\x04pass"), append(domain, 1, 187), "example.com:443", []byte{5, 2, 1, 0}},
+		{"bad password", users, []byte("\x01\x04user\x04word"), append(domain, 1, 187), "", []byte{5, 2, 1, 1}},
+		{"no auth method", users, nil, nil, "", []byte{5, 0xFF}},
+		{"bind", nil, nil, []byte{5, 2, 0, SOCKS5ATYPIPV4, 10, 0, 0, 1, 0, 22}, "", []byte{5, 0, 5, SOCKS5REPCMDNOTSUPPORTED}},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func() {
+			dest, err := Socks5Handshake(server, c.users)
+			if dest != c.dest || (len(c.dest) > 0) != (nil == err) {
+				t.Error(c.name, dest, err)
+			}
+			server.Close()
+		}()
+		reply := socks5Client(client, c.auth, c.request)
+		if !bytes.HasPrefix(reply, c.reply) {
+			t.Fatal(c.name, reply)
+		}
+		client.Close()
+	}
+}
+
+// statusError 带状态码的错误, 模拟隧道客户端回复的目标连接错误
+type statusError int
+
+// Error 错误信息
+func (err statusError) Error() string {
+	return "status " + strconv.Itoa(int(err))
+}
+
+// StatusCode 状态码
+func (err statusError) StatusCode() int {
+	return int(err)
+}
+
+// 测试CONNECT结果: 目标不允许连接时回复0x02, 不可达时回复0x04, 成功时回复0x00
+func TestSocks5ReplyCode(t *testing.T) {
+	request := []byte{5, 1, 0, SOCKS5ATYPIPV4, 10, 0, 0, 1, 0, 22}
+	cases := []struct {
+		name string
+		err  error
+		rep  byte
+	}{
+		{"succeeded", nil, SOCKS5REPSUCCEEDED},
+		{"denied", fmt.Errorf("dial: %w", statusError(403)), SOCKS5REPNOTALLOWED},
+		{"unreachable", statusError(502), SOCKS5REPHOSTUNREACHABLE},
+		{"reply timeout", errors.New("i/o timeout"), SOCKS5REPFAILURE},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func() {
+			if _, err := Socks5Handshake(server, nil); nil != err {
+				t.Error(c.name, err)
+			}
+			Socks5Reply(server, Socks5ReplyCode(c.err))
+			server.Close()
+		}()
+		reply := socks5Client(client, nil, request)
+		if !bytes.Equal(reply, []byte{5, 0, 5, c.rep, 0, SOCKS5ATYPIPV4, 0, 0, 0, 0, 0, 0}) {
+			t.Fatal(c.name, reply)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// UDP入口: 每个来源地址一个会话, 每个会话使用一个隧道连接转发数据报, 会话空闲超时后结束
+
+package tcptunnelentry
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"tcptunnel/tcpmsgexchanger"
+	"time"
+)
+
+const (
+	// UDPIDLETIMEOUT 会话默认空闲超时时间
+	UDPIDLETIMEOUT = 60 * time.Second
+	// UDPCLOSETIMEOUT 会话结束时等待对端关闭的时间
+	UDPCLOSETIMEOUT = 10 * time.Second
+	// UDPSESSIONBACKLOG 会话等待发送的数据报数量, 超过后丢弃
+	UDPSESSIONBACKLOG = 64
+)
+
+// UDPRelay UDP入口转发
+type UDPRelay struct {
+	IdleTimeout time.Duration          // 会话空闲超时时间
+	conn        net.PacketConn         // UDP监听
+	open        func() net.Conn        // 获取隧道连接
+	release     func(net.Conn)         // 归还隧道连接
+	sessions    map[string]*udpSession // 来源地址 - 会话
+	lock        *sync.Mutex            // 会话锁
+}
+
+// udpSession 一个来源地址的会话
+type udpSession struct {
+	addr       net.Addr    // 来源地址
+	packets    chan []byte // 等待发送的数据报
+	lastActive int64       // 最后活动时间
+}
+
+// touch 刷新最后活动时间
+func (session *udpSession) touch() {
+	atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+}
+
+// idle 空闲时间
+func (session *udpSession) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&session.lastActive))
+}
+
+// SetIdleTimeout 更新会话空闲超时时间, 之后创建的会话生效
+func (relay *UDPRelay) SetIdleTimeout(timeout time.Duration) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	relay.IdleTimeout = timeout
+}
+
+// getIdleTimeout 会话空闲超时时间, 没有设置时使用默认值
+func (relay *UDPRelay) getIdleTimeout() time.Duration {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	if relay.IdleTimeout <= 0 {
+		return UDPIDLETIMEOUT
+	}
+	return relay.IdleTimeout
+}
+
+// NewUDPRelay 创建UDP入口, open 获取隧道连接(没有可用连接时返回nil), release 归还隧道连接
+func NewUDPRelay(conn net.PacketConn, open func() net.Conn, release func(net.Conn)) *UDPRelay {
+	return &UDPRelay{
+		IdleTimeout: UDPIDLETIMEOUT,
+		conn:        conn,
+		open:        open,
+		release:     release,
+		sessions:    make(map[string]*udpSession),
+		lock:        new(sync.Mutex),
+	}
+}
+
+// Serve 接收数据报并分发到来源地址的会话, 直到监听关闭
+func (relay *UDPRelay) Serve() error {
+	buf := make([]byte, tcpmsgexchanger.UDPMAXLEN)
+	for {
+		n, addr, err := relay.conn.ReadFrom(buf)
+		if nil != err {
+			return err
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		session := relay.getSession(addr)
+		select {
+		case session.packets <- packet:
+		default:
+			// 隧道连接发送不过来时丢弃, 与UDP的语义一致
+		}
+	}
+}
+
+// NumSessions 当前会话数量
+func (relay *UDPRelay) NumSessions() int {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	return len(relay.sessions)
+}
+
+// getSession 获取来源地址的会话, 不存在时创建
+func (relay *UDPRelay) getSession(addr net.Addr) *udpSession {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	if session, ok := relay.sessions[addr.String()]; ok {
+		return session
+	}
+	session := &udpSession{
+		addr:    addr,
+		packets: make(chan []byte, UDPSESSIONBACKLOG),
+	}
+	session.touch()
+	relay.sessions[addr.String()] = session
+	go relay.doSession(session)
+	return session
+}
+
+// removeSession 删除会话, 之后同一来源地址的数据报会创建新的会话
+func (relay *UDPRelay) removeSession(session *udpSession) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	if relay.sessions[session.addr.String()] == session {
+		delete(relay.sessions, session.addr.String())
+	}
+}
+
+// doSession 会话处理: 获取隧道连接, 转发数据报直到空闲超时或者对端结束
+func (relay *UDPRelay) doSession(session *udpSession) {
+	conn := relay.open()
+	if nil == conn {
+		relay.removeSession(session)
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		relay.doReply(session, conn)
+		close(done)
+	}()
+	idleTimeout := relay.getIdleTimeout()
+	timer := time.NewTimer(idleTimeout)
+	isDone := false
+	for !isDone {
+		select {
+		case packet := <-session.packets:
+			session.touch()
+			if err := tcpmsgexchanger.WriteDatagram(conn, packet); nil != err {
+				isDone = true
+			}
+		case <-done:
+			isDone = true
+		case <-timer.C:
+			idle := session.idle()
+			if idle >= idleTimeout {
+				isDone = true
+			} else {
+				timer.Reset(idleTimeout - idle)
+			}
+		}
+	}
+	timer.Stop()
+	relay.removeSession(session)
+	// 关闭写入通知对端会话结束, 等待对端关闭后归还连接
+	closeWrite(conn)
+	conn.SetReadDeadline(time.Now().Add(UDPCLOSETIMEOUT))
+	<-done
+	conn.SetReadDeadline(time.Time{})
+	relay.release(conn)
+}
+
+// doReply 读取隧道连接上的数据报, 发送回来源地址
+func (relay *UDPRelay) doReply(session *udpSession, conn net.Conn) {
+	buf := make([]byte, tcpmsgexchanger.UDPMAXLEN)
+	for {
+		n, err := tcpmsgexchanger.ReadDatagram(conn, buf)
+		if nil != err {
+			return
+		}
+		session.touch()
+		relay.conn.WriteTo(buf[:n], session.addr)
+	}
+}
+
+// closeWrite 关闭连接的写入方向, 不支持单向关闭的连接不做处理
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelentry
+
+import (
+	"net"
+	"strings"
+	"tcptunnel/tcpmsgexchanger"
+	"testing"
+	"time"
+)
+
+// 测试UDP入口: 每个来源地址一个会话, 响应回到对应的来源地址, 空闲超时后归还连接
+func TestUDPRelay(t *testing.T) {
+	// UDP目标, 返回 ECHO: + 数据
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+			target.WriteTo(append([]byte("ECHO:"), buf[:n]...), addr)
+		}
+	}()
+	// 隧道连接的另一端使用UDP交换器连接目标
+	tunnel, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	go func() {
+		for {
+			conn, err := tunnel.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				udpConn, err := net.Dial("udp", target.LocalAddr().String())
+				if nil != err {
+					return
+				}
+				(&tcpmsgexchanger.TCPExchanger4UDP{}).ExchangeData(conn, udpConn)
+			}()
+		}
+	}()
+	released := make(chan net.Conn, 2)
+	entry, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer entry.Close()
+	relay := NewUDPRelay(entry, func() net.Conn {
+		conn, err := net.Dial("tcp", tunnel.Addr().String())
+		if nil != err {
+			return nil
+		}
+		return conn
+	}, func(conn net.Conn) {
+		conn.Close()
+		released <- conn
+	})
+	relay.IdleTimeout = 300 * time.Millisecond
+	go relay.Serve()
+
+	// 两个来源地址交替发送
+	users := make([]net.Conn, 2)
+	for i := range users {
+		users[i], err = net.Dial("udp", entry.LocalAddr().String())
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer users[i].Close()
+	}
+	buf := make([]byte, 1024)
+	for round := 0; round < 3; round++ {
+		for i, user := range users {
+			msg := strings.Repeat("x", i+1)
+			user.Write([]byte(msg))
+			user.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := user.Read(buf)
+			if nil != err || string(buf[:n]) != "ECHO:"+msg {
+				t.Fatal("user", i, string(buf[:n]), err)
+			}
+		}
+	}
+	if relay.NumSessions() != 2 {
+		t.Fatal("sessions", relay.NumSessions())
+	}
+	// 空闲超时后两个会话都结束并归还连接
+	for i := 0; i < 2; i++ {
+		select {
+		case <-released:
+		case <-time.After(3 * time.Second):
+			t.Fatal("session not released")
+		}
+	}
+	if relay.NumSessions() != 0 {
+		t.Fatal("sessions after idle", relay.NumSessions())
+	}
+}
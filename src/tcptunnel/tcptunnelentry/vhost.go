@@ -0,0 +1,197 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 虚拟主机: 根据HTTP请求的Host头或者TLS握手的SNI选择隧道
+
+package tcptunnelentry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ErrNoHost 请求中没有主机名
+var ErrNoHost = errors.New("no host found in request")
+
+// SniffHost 预读连接开头的内容获取主机名, 不消耗数据
+// isTLS 为true时主机名来自TLS握手的SNI, 否则来自HTTP请求的Host头
+func SniffHost(pconn *PeekConn) (host string, isTLS bool, err error) {
+	b, err := pconn.Peek(1)
+	if nil != err {
+		return "", false, err
+	}
+	if b[0] == 0x16 {
+		host, err = sniffSNI(pconn)
+		return host, true, err
+	}
+	header, err := pconn.PeekUntil([]byte("\r\n\r\n"))
+	if nil != err {
+		return "", false, err
+	}
+	host, err = parseHost(header)
+	return host, false, err
+}
+
+// parseHost 从HTTP头信息中获取Host, 头名称不区分大小写, 去掉端口
+func parseHost(header []byte) (string, error) {
+	lines := bytes.Split(header, []byte("\r\n"))
+	for i := 1; i < len(lines); i++ {
+		index := bytes.IndexByte(lines[i], ':')
+		if index < 0 {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(string(lines[i][:index])), "Host") {
+			return normalizeHost(string(lines[i][index+1:])), nil
+		}
+	}
+	return "", ErrNoHost
+}
+
+// normalizeHost 统一主机名格式: 去掉端口和空白, 转为小写
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// sniffSNI 解析TLS ClientHello中的SNI扩展
+func sniffSNI(pconn *PeekConn) (string, error) {
+	header, err := pconn.Peek(5)
+	if nil != err {
+		return "", err
+	}
+	record, err := pconn.Peek(5 + int(binary.BigEndian.Uint16(header[3:5])))
+	if nil != err {
+		return "", err
+	}
+	b := record[5:]
+	// 握手类型(1) + 长度(3) + 版本(2) + 随机数(32)
+	if len(b) < 38 || b[0] != 0x01 {
+		return "", errors.New("not a tls client hello")
+	}
+	b = b[38:]
+	// 会话ID
+	if b, err = skipVector(b, 1); nil != err {
+		return "", err
+	}
+	// 加密套件
+	if b, err = skipVector(b, 2); nil != err {
+		return "", err
+	}
+	// 压缩方法
+	if b, err = skipVector(b, 1); nil != err {
+		return "", err
+	}
+	if len(b) < 2 {
+		return "", ErrNoHost
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		extLen := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+extLen {
+			break
+		}
+		ext := b[4 : 4+extLen]
+		b = b[4+extLen:]
+		if extType != 0 {
+			continue
+		}
+		// 名称列表长度(2) + 名称类型(1) + 名称长度(2) + 名称
+		if len(ext) < 5 || ext[2] != 0 {
+			break
+		}
+		nameLen := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+nameLen {
+			break
+		}
+		return normalizeHost(string(ext[5 : 5+nameLen])), nil
+	}
+	return "", ErrNoHost
+}
+
+// skipVector 跳过带长度前缀的字段, size 为长度前缀的字节数
+func skipVector(b []byte, size int) ([]byte, error) {
+	if len(b) < size {
+		return nil, errors.New("tls client hello too short")
+	}
+	length := 0
+	for i := 0; i < size; i++ {
+		length = length<<8 | int(b[i])
+	}
+	if len(b) < size+length {
+		return nil, errors.New("tls client hello too short")
+	}
+	return b[size+length:], nil
+}
+
+// VHostRouter 虚拟主机路由表, 主机名 -> 隧道名称
+// 支持完整域名和通配域名(*.example.com), 都不匹配时使用默认隧道
+type VHostRouter struct {
+	hosts     map[string]string // 完整域名
+	wildcards map[string]string // 通配域名, key为去掉*后的后缀(.example.com)
+	fallback  string            // 默认隧道, 为空时不转发
+	lock      sync.RWMutex
+}
+
+// NewVHostRouter 创建路由表
+func NewVHostRouter() *VHostRouter {
+	return &VHostRouter{
+		hosts:     make(map[string]string),
+		wildcards: make(map[string]string),
+	}
+}
+
+// AddRoute 添加路由, host 为 * 时设置默认隧道
+func (router *VHostRouter) AddRoute(host string, tunnel string) {
+	host = strings.ToLower(strings.TrimSpace(host))
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if host == "*" {
+		router.fallback = tunnel
+	} else if strings.HasPrefix(host, "*.") {
+		router.wildcards[host[1:]] = tunnel
+	} else {
+		router.hosts[host] = tunnel
+	}
+}
+
+// SetDefault 设置默认隧道
+func (router *VHostRouter) SetDefault(tunnel string) {
+	router.AddRoute("*", tunnel)
+}
+
+// Match 查找主机名对应的隧道, 完整域名 > 最长的通配域名 > 默认隧道
+func (router *VHostRouter) Match(host string) (string, bool) {
+	host = normalizeHost(host)
+	router.lock.RLock()
+	defer router.lock.RUnlock()
+	if tunnel, ok := router.hosts[host]; ok {
+		return tunnel, true
+	}
+	matched, tunnel := "", ""
+	for suffix, val := range router.wildcards {
+		if strings.HasSuffix(host, suffix) && len(suffix) > len(matched) {
+			matched, tunnel = suffix, val
+		}
+	}
+	if len(matched) > 0 {
+		return tunnel, true
+	}
+	if len(router.fallback) > 0 {
+		return router.fallback, true
+	}
+	return "", false
+}
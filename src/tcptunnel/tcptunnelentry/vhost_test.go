@@ -0,0 +1,73 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelentry
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// 测试虚拟主机路由匹配顺序
+func TestVHostRouter(t *testing.T) {
+	router := NewVHostRouter()
+	router.AddRoute("www.example.com", "web")
+	router.AddRoute("*.example.com", "wildcard")
+	router.AddRoute("*.api.example.com", "api")
+	cases := map[string]string{
+		"www.example.com":      "web",
+		"WWW.Example.com:8080": "web",
+		"blog.example.com":     "wildcard",
+		"v1.api.example.com":   "api",
+	}
+	for host, want := range cases {
+		if tunnel, ok := router.Match(host); !ok || tunnel != want {
+			t.Fatal("match error: ", host, tunnel, want)
+		}
+	}
+	if _, ok := router.Match("example.org"); ok {
+		t.Fatal("matched without default")
+	}
+	router.SetDefault("fallback")
+	if tunnel, _ := router.Match("example.org"); tunnel != "fallback" {
+		t.Fatal("default error: ", tunnel)
+	}
+}
+
+// 测试从HTTP请求和TLS握手中获取主机名, 预读的数据仍能完整读取
+func TestSniffHost(t *testing.T) {
+	src, dest := net.Pipe()
+	request := "GET / HTTP/1.1\r\nhost: Blog.Example.com:8080\r\nAccept: */*\r\n\r\n"
+	go func() {
+		src.Write([]byte(request[:10]))
+		src.Write([]byte(request[10:]))
+		src.Close()
+	}()
+	pconn := NewPeekConn(dest)
+	host, isTLS, err := SniffHost(pconn)
+	if nil != err || isTLS || host != "blog.example.com" {
+		t.Fatal("sniff http host error: ", host, isTLS, err)
+	}
+	if b, _ := io.ReadAll(pconn); string(b) != request {
+		t.Fatal("peeked data lost: ", string(b))
+	}
+
+	src, dest = net.Pipe()
+	go func() {
+		tls.Client(src, &tls.Config{ServerName: "secure.example.com"}).Handshake()
+	}()
+	host, isTLS, err = SniffHost(NewPeekConn(dest))
+	if nil != err || !isTLS || host != "secure.example.com" {
+		t.Fatal("sniff tls host error: ", host, isTLS, err)
+	}
+	src.Close()
+	dest.Close()
+}
@@ -0,0 +1,182 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 管理接口: 查询客户端、连接池和会话, 断开客户端和关闭会话
+
+package tcptunnelmanager
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"gutils/hstool"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Clients 已连接的客户端, 按客户端ID排序
+func (service *TCPTunnelService) Clients() []ClientStat {
+	service.init()
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	res := make([]ClientStat, 0, len(service.clients))
+	for _, client := range service.clients {
+		res = append(res, ClientStat{
+			ID:          client.id,
+			Name:        client.name,
+			Addr:        client.ctlConn.RemoteAddr().String(),
+			Tunnels:     append([]string(nil), client.tunnels...),
+			MuxCount:    client.numMux(),
+			ConnectedAt: client.started,
+			RTT:         float64(client.hb.getRTT()) / float64(time.Millisecond),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Pools 每个隧道的空闲连接数和补充情况, 按隧道名称排序
+func (service *TCPTunnelService) Pools() []PoolStat {
+	service.init()
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	res := make([]PoolStat, 0, len(service.pools))
+	for name, pool := range service.pools {
+		minIdle, maxIdle := pool.client.poolSize()
+		res = append(res, PoolStat{Tunnel: name, ClientID: pool.client.id, Idle: pool.count(), Pending: pool.numPending(), Waiting: pool.numWaiting(), MinIdle: minIdle, MaxIdle: maxIdle})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Tunnel < res[j].Tunnel })
+	return res
+}
+
+// Sessions 正在传输的会话, 按开始时间排序
+func (service *TCPTunnelService) Sessions() []SessionStat {
+	service.init()
+	service.sessionLock.Lock()
+	defer service.sessionLock.Unlock()
+	res := make([]SessionStat, 0, len(service.sessions))
+	for _, session := range service.sessions {
+		res = append(res, session.stat())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].StartedAt.Before(res[j].StartedAt) })
+	return res
+}
+
+// KickClient 断开客户端, 关闭它的控制连接、连接池和正在传输的会话, 客户端不存在时返回false
+// 客户端断开后通常会自动重连
+func (service *TCPTunnelService) KickClient(id string) bool {
+	service.init()
+	service.lock.RLock()
+	client := service.clients[id]
+	service.lock.RUnlock()
+	if nil == client {
+		return false
+	}
+	service.removeClient(client)
+	service.sessionLock.Lock()
+	defer service.sessionLock.Unlock()
+	for _, session := range service.sessions {
+		if session.clientID == id {
+			session.Close()
+		}
+	}
+	return true
+}
+
+// CloseSession 关闭正在传输的会话, 会话不存在时返回false
+// 只关闭隧道一侧的连接, 入口连接由数据交换结束后关闭
+func (service *TCPTunnelService) CloseSession(id string) bool {
+	service.init()
+	service.sessionLock.Lock()
+	session := service.sessions[id]
+	service.sessionLock.Unlock()
+	if nil == session {
+		return false
+	}
+	session.Close()
+	return true
+}
+
+// NewAdminRouter 创建管理接口的路由, token不为空时请求需要携带 Authorization: Bearer <token>
+// GET  /api/clients              已连接的客户端
+// GET  /api/pools                每个隧道的空闲连接数
+// GET  /api/sessions             正在传输的会话
+// POST /api/clients/kick?id=     断开客户端
+// POST /api/sessions/close?id=   关闭会话
+func NewAdminRouter(service *TCPTunnelService, token string) *hstool.ServiceRouter {
+	router := &hstool.ServiceRouter{}
+	if len(token) > 0 {
+		router.SetGlobalFilter(func(w http.ResponseWriter, r *http.Request, next hstool.FilterNext) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+				writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+			next()
+		})
+	}
+	router.AddHandlers(map[string]hstool.HandlersFunc{
+		"/api/clients": func(w http.ResponseWriter, r *http.Request) {
+			if checkAdminMethod(w, r, http.MethodGet) {
+				writeAdminJSON(w, http.StatusOK, service.Clients())
+			}
+		},
+		"/api/pools": func(w http.ResponseWriter, r *http.Request) {
+			if checkAdminMethod(w, r, http.MethodGet) {
+				writeAdminJSON(w, http.StatusOK, service.Pools())
+			}
+		},
+		"/api/sessions": func(w http.ResponseWriter, r *http.Request) {
+			if checkAdminMethod(w, r, http.MethodGet) {
+				writeAdminJSON(w, http.StatusOK, service.Sessions())
+			}
+		},
+		"/api/clients/kick": func(w http.ResponseWriter, r *http.Request) {
+			if checkAdminMethod(w, r, http.MethodPost) {
+				writeAdminResult(w, service.KickClient(r.FormValue("id")), "client not found")
+			}
+		},
+		"/api/sessions/close": func(w http.ResponseWriter, r *http.Request) {
+			if checkAdminMethod(w, r, http.MethodPost) {
+				writeAdminResult(w, service.CloseSession(r.FormValue("id")), "session not found")
+			}
+		},
+	})
+	router.SetDefaultHandler(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+	})
+	return router
+}
+
+// checkAdminMethod 检查请求方法, 不一致时返回405
+func checkAdminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return false
+}
+
+// writeAdminResult 输出操作结果, 操作的对象不存在时返回404
+func writeAdminResult(w http.ResponseWriter, ok bool, notFound string) {
+	if !ok {
+		writeAdminJSON(w, http.StatusNotFound, map[string]string{"error": notFound})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// writeAdminJSON 输出JSON响应
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 测试管理接口: 查询客户端、连接池和会话, 关闭会话, 断开客户端, 以及会话的监控指标
+func TestAdminRouter(t *testing.T) {
+	service := &TCPTunnelService{}
+	service.init()
+	ctlConn, ctlPeer := net.Pipe()
+	defer ctlPeer.Close()
+	client := newTunnelClient("c1", "client1", ctlConn, []string{"web"})
+	pool := newTunnelPool("web", client)
+	service.clients[client.id] = client
+	service.pools["web"] = pool
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	pool.put(conn, 0)
+	// 模拟隧道客户端: 确认开始传输, 读取5个字节后回复2个字节
+	go func() {
+		if frame, err := ReadFrame(peer); nil != err || frame.Type != CMDTRANSPORTSTART {
+			return
+		}
+		WriteFrame(peer, CMDOK, nil)
+		tconn := newTunnelConn(peer)
+		buf := make([]byte, 5)
+		io.ReadFull(tconn, buf)
+		tconn.Write([]byte("hi"))
+	}()
+	session := service.GetConn(TransportInfo{Tunnel: "web", Mode: "raw"})
+	if nil == session {
+		t.Fatal("no conn")
+	}
+	session.Write([]byte("hello"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(session, buf); nil != err {
+		t.Fatal(err)
+	}
+
+	router := NewAdminRouter(service, "token")
+	do := func(method, url string, v interface{}) int {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if nil != v {
+			json.Unmarshal(w.Body.Bytes(), v)
+		}
+		return w.Code
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/clients", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("request without token:", w.Code)
+	}
+	var clients []ClientStat
+	if code := do(http.MethodGet, "/api/clients", &clients); code != http.StatusOK || len(clients) != 1 || clients[0].ID != "c1" || clients[0].Tunnels[0] != "web" {
+		t.Fatal("clients:", code, clients)
+	}
+	var pools []PoolStat
+	if code := do(http.MethodGet, "/api/pools", &pools); code != http.StatusOK || len(pools) != 1 || pools[0].Idle != 0 {
+		t.Fatal("pools:", code, pools)
+	}
+	var sessions []SessionStat
+	if code := do(http.MethodGet, "/api/sessions", &sessions); code != http.StatusOK || len(sessions) != 1 {
+		t.Fatal("sessions:", code, sessions)
+	}
+	if sessions[0].Tunnel != "web" || sessions[0].ClientID != "c1" || sessions[0].BytesSent != 5 || sessions[0].BytesReceived != 2 {
+		t.Fatal("session stat:", sessions[0])
+	}
+	if code := do(http.MethodGet, "/api/sessions/close?id="+sessions[0].ID, nil); code != http.StatusMethodNotAllowed {
+		t.Fatal("close with get:", code)
+	}
+	if code := do(http.MethodPost, "/api/sessions/close?id="+sessions[0].ID, nil); code != http.StatusOK {
+		t.Fatal("close session:", code)
+	}
+	if _, err := session.Read(buf); nil == err {
+		t.Fatal("session is not closed")
+	}
+	service.RelaseConn(session)
+	if code := do(http.MethodGet, "/api/sessions", &sessions); code != http.StatusOK || len(sessions) != 0 {
+		t.Fatal("sessions after release:", code, sessions)
+	}
+	// 会话结束后的监控指标
+	service.GetConn(TransportInfo{Tunnel: "ssh"})
+	text := service.Metrics().Text()
+	for _, line := range []string{
+		`tcptunnel_bytes_total{tunnel="web",direction="sent"} 5`,
+		`tcptunnel_bytes_total{tunnel="web",direction="received"} 2`,
+		`tcptunnel_sessions_total{tunnel="web"} 1`,
+		`tcptunnel_sessions_active{tunnel="web"} 0`,
+		`tcptunnel_getconn_misses_total{tunnel="ssh"} 1`,
+		`tcptunnel_pool_idle{tunnel="web"} 0`,
+		`tcptunnel_exchange_duration_seconds_count{tunnel="web",mode="raw"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatal("missing metric: ", line, "\n", text)
+		}
+	}
+	if code := do(http.MethodPost, "/api/clients/kick?id=c1", nil); code != http.StatusOK {
+		t.Fatal("kick client:", code)
+	}
+	if code := do(http.MethodPost, "/api/clients/kick?id=c1", nil); code != http.StatusNotFound {
+		t.Fatal("kick removed client:", code)
+	}
+	if code := do(http.MethodGet, "/api/pools", &pools); code != http.StatusOK || len(pools) != 0 {
+		t.Fatal("pools after kick:", code, pools)
+	}
+}
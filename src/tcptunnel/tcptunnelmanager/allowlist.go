@@ -0,0 +1,98 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 目标地址白名单: 服务端指定目标地址时, 客户端只连接白名单内的地址
+
+package tcptunnelmanager
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AllowList 目标地址白名单
+// 规则格式: 主机[:端口], 主机可以是 IP、CIDR(10.0.0.0/8)、域名、通配域名(*.example.com) 或 *
+// 没有端口时允许所有端口, CIDR 只匹配IP形式的目标地址, 不解析域名
+type AllowList struct {
+	rules []allowRule
+}
+
+// allowRule 白名单规则
+type allowRule struct {
+	host  string     // 主机名或通配域名, 小写
+	ipnet *net.IPNet // CIDR或IP
+	port  string     // 端口, 为空时允许所有端口
+}
+
+// NewAllowList 创建白名单, 规则为空时拒绝所有地址
+func NewAllowList(rules []string) (*AllowList, error) {
+	list := &AllowList{rules: make([]allowRule, 0, len(rules))}
+	for _, item := range rules {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		rule := allowRule{}
+		host := item
+		if h, p, err := net.SplitHostPort(item); nil == err {
+			host, rule.port = h, p
+		}
+		if _, err := strconv.ParseUint(rule.port, 10, 16); len(rule.port) > 0 && nil != err {
+			return nil, errors.New("allow rule port error: " + item)
+		}
+		if len(host) == 0 {
+			return nil, errors.New("allow rule format error: " + item)
+		}
+		if _, ipnet, err := net.ParseCIDR(host); nil == err {
+			rule.ipnet = ipnet
+		} else if ip := net.ParseIP(host); nil != ip {
+			bits := 8 * len(ip.To16())
+			if nil != ip.To4() {
+				ip, bits = ip.To4(), 32
+			}
+			rule.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if strings.Contains(host, "/") {
+			return nil, errors.New("allow rule cidr error: " + item)
+		} else {
+			rule.host = strings.ToLower(host)
+		}
+		list.rules = append(list.rules, rule)
+	}
+	return list, nil
+}
+
+// Allow 目标地址(host:port)是否在白名单内
+func (list *AllowList) Allow(dest string) bool {
+	host, port, err := net.SplitHostPort(dest)
+	if nil != err {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, rule := range list.rules {
+		if len(rule.port) > 0 && rule.port != port {
+			continue
+		}
+		if nil != rule.ipnet {
+			if nil != ip && rule.ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if rule.host == "*" || rule.host == host {
+			return true
+		}
+		if strings.HasPrefix(rule.host, "*.") && nil == ip && strings.HasSuffix(host, rule.host[1:]) {
+			return true
+		}
+	}
+	return false
+}
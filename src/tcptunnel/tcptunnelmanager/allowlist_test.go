@@ -0,0 +1,51 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"testing"
+)
+
+// 测试目标地址白名单的匹配规则
+func TestAllowList(t *testing.T) {
+	list, err := NewAllowList([]string{"10.0.0.0/8", "192.168.2.8:22", "*.corp.local", "wiki.example.com:443", "[::1]:80"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"10.1.2.3:80":          true,
+		"11.1.2.3:80":          false,
+		"192.168.2.8:22":       true,
+		"192.168.2.8:23":       false,
+		"git.corp.local:22":    true,
+		"GIT.Corp.Local:22":    true,
+		"corp.local:22":        false,
+		"evilcorp.local:22":    false,
+		"wiki.example.com:443": true,
+		"wiki.example.com:80":  false,
+		"[::1]:80":             true,
+		"[::1]:81":             false,
+		"10.0.0.1":             false,
+	}
+	for dest, allowed := range cases {
+		if list.Allow(dest) != allowed {
+			t.Fatal(dest, allowed)
+		}
+	}
+	empty, _ := NewAllowList(nil)
+	if empty.Allow("10.1.2.3:80") {
+		t.Fatal("empty allow list allowed")
+	}
+	for _, rule := range []string{"host:port", "10.0.0.0/33", ":80"} {
+		if _, err := NewAllowList([]string{rule}); nil == err {
+			t.Fatal("rule accepted", rule)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 隧道认证: 服务端在连接建立后发送随机挑战码, 客户端用共享密钥对挑战码和全部握手信息计算HMAC签名
+// 签名随握手信息一起发送, 服务端使用该客户端的密钥验证, 每个连接的挑战码都不同, 签名无法重放
+
+package tcptunnelmanager
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+const (
+	// AUTHNONCELEN 挑战码长度
+	AUTHNONCELEN = 32
+)
+
+// newNonce 生成随机挑战码
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, AUTHNONCELEN)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// signHandshake 计算握手签名: HMAC-SHA256(密钥, 挑战码 + 指令 + 客户端ID + 认证名称 + 隧道名称 + 注册的隧道 + 低水位 + 保持的数量)
+// 签名覆盖握手信息的所有字段, 没有TLS时中间人也不能修改注册的隧道或连接池大小
+func signHandshake(key string, nonce []byte, cmd byte, hs handshake) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(nonce)
+	mac.Write([]byte{cmd})
+	for _, val := range []string{hs.ClientID, hs.Name, hs.Tunnel} {
+		mac.Write([]byte(val))
+		mac.Write([]byte{0})
+	}
+	num := make([]byte, 8)
+	binary.BigEndian.PutUint64(num, uint64(len(hs.Tunnels)))
+	mac.Write(num)
+	for _, val := range hs.Tunnels {
+		mac.Write([]byte(val))
+		mac.Write([]byte{0})
+	}
+	for _, val := range []int{hs.MinIdle, hs.MaxIdle} {
+		binary.BigEndian.PutUint64(num, uint64(val))
+		mac.Write(num)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyHandshake 验证握手签名, 没有配置密钥时不验证
+func verifyHandshake(keys map[string]string, nonce []byte, cmd byte, hs handshake) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	key, ok := keys[hs.Name]
+	if !ok || len(key) == 0 {
+		return false
+	}
+	return hmac.Equal([]byte(signHandshake(key, nonce, cmd, hs)), []byte(hs.Sign))
+}
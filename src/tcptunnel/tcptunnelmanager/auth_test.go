@@ -0,0 +1,63 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"testing"
+)
+
+// 测试握手签名, 密钥、挑战码或握手信息不一致时验证失败
+func TestVerifyHandshake(t *testing.T) {
+	keys := map[string]string{"client1": "secret1", "client2": "secret2"}
+	nonce, _ := newNonce()
+	hs := handshake{ClientID: "id1", Name: "client1", Tunnel: "web"}
+	hs.Sign = signHandshake("secret1", nonce, CMDCONNECT, hs)
+	if !verifyHandshake(keys, nonce, CMDCONNECT, hs) {
+		t.Fatal("verify failed")
+	}
+	if verifyHandshake(keys, nonce, CMDCONNECTCTRL, hs) {
+		t.Fatal("verify passed with another cmd")
+	}
+	other, _ := newNonce()
+	if verifyHandshake(keys, other, CMDCONNECT, hs) {
+		t.Fatal("verify passed with another nonce")
+	}
+	forged := hs
+	forged.Name = "client2"
+	if verifyHandshake(keys, nonce, CMDCONNECT, forged) {
+		t.Fatal("verify passed with another name")
+	}
+	forged = hs
+	forged.Tunnel = "ssh"
+	if verifyHandshake(keys, nonce, CMDCONNECT, forged) {
+		t.Fatal("verify passed with another tunnel")
+	}
+	// 控制连接注册的隧道和连接池大小也在签名范围内
+	ctl := handshake{ClientID: "id1", Name: "client1", Tunnels: []string{"web"}, MinIdle: 1, MaxIdle: 2}
+	ctl.Sign = signHandshake("secret1", nonce, CMDCONNECTCTRL, ctl)
+	if !verifyHandshake(keys, nonce, CMDCONNECTCTRL, ctl) {
+		t.Fatal("verify control handshake failed")
+	}
+	for _, modify := range []func(hs *handshake){
+		func(hs *handshake) { hs.Tunnels = []string{"web", "ssh"} },
+		func(hs *handshake) { hs.Tunnels = []string{"ssh"} },
+		func(hs *handshake) { hs.MinIdle = 0 },
+		func(hs *handshake) { hs.MaxIdle = 100 },
+	} {
+		forged = ctl
+		modify(&forged)
+		if verifyHandshake(keys, nonce, CMDCONNECTCTRL, forged) {
+			t.Fatal("verify passed with modified control handshake: ", forged)
+		}
+	}
+	if !verifyHandshake(nil, nonce, CMDCONNECT, handshake{}) {
+		t.Fatal("verify failed without keys")
+	}
+}
@@ -10,25 +10,54 @@
 package tcptunnelmanager
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"gutils/logtool"
+	"gutils/metrictool"
 	"gutils/strtool"
-	"io"
 	"net"
-	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// onTransport 当链接上隧道后的回调函数, conn: 链接对象, release: 释放资源
-type onTransport func(conn *net.TCPConn, release func()) error
+// onTransport 当链接上隧道后的回调函数, conn: 链接对象(只传输数据帧), info: 传输信息, release: 释放资源
+type onTransport func(conn net.Conn, info TransportInfo, release func()) error
 
 // TCPTunnelConnector TCP隧道客户端
 type TCPTunnelConnector struct {
-	ServiceAddr  *net.TCPAddr
-	OnTransport  onTransport
-	MaxCount     int64  // 保持空闲连接数
-	connectorID  string // 实例ID
-	currentCount int64
-	isDebug      bool // 是否输出调试信息
+	ServiceAddr *net.TCPAddr
+	OnTransport onTransport
+	Tunnels     []string             // 注册的隧道名称, 为空时注册默认隧道
+	AuthName    string               // 认证名称, 服务端据此查找密钥
+	AuthKey     string               // 认证密钥, 与服务端配置的密钥一致
+	TLSConfig   *tls.Config          // 连接隧道服务的TLS配置, 为空时不加密
+	MinIdle     int64                // 空闲连接低水位, 低于该数量时服务端通知补充, 为0时使用MaxCount的一半
+	MaxCount    int64                // 每个隧道保持的空闲连接数, 服务端通知补充时补充到该数量
+	Multiplex   bool                 // 是否使用多路复用模式, 多个请求共享少量物理连接
+	MuxCount    int64                // 多路复用模式下保持的物理连接数
+	Timeouts    Timeouts             // 各阶段的超时时间, 运行时通过 SetTimeouts 更新
+	Backoff     Backoff              // 重连的退避间隔, 运行时通过 SetBackoff 更新
+	connectorID string               // 实例ID
+	muxCount    int64                // 当前的多路复用连接数
+	connects    int64                // 注册客户端的次数, 大于1次时为重连
+	metrics     *tunnelMetrics       // 监控指标
+	conns       map[net.Conn]bool    // 连接池中的连接, 值为是否空闲(等待传输), 由connLock保护
+	muxes       map[*MuxSession]bool // 多路复用连接, 由connLock保护
+	active      int64                // 正在传输的会话数, 由connLock保护
+	stopping    bool                 // 正在停止, 不再补充连接和接受传输, 由connLock保护
+	stopped     chan struct{}        // 停止完成后关闭
+	changed     chan struct{}        // 隧道、连接数变化或多路复用连接断开时通知控制循环
+	ctlBeat     *heartbeat           // 当前控制连接的心跳, 由lock保护
+	state       ConnectorState       // 连接状态, 由lock保护
+	onState     onStateChange        // 连接状态变化的回调, 由lock保护
+	initOnce    sync.Once            // 初始化默认值
+	stopOnce    sync.Once            // 只停止一次
+	lock        sync.Mutex           // 隧道和连接数锁, 运行时可以更新
+	connLock    sync.Mutex           // 连接记录锁
+	logger      *logtool.Logger      // 日志, 为空时使用默认日志
 }
 
 // SetTransportCallback 设置当链接上隧道后的回调函数
@@ -36,11 +65,14 @@ func (connector *TCPTunnelConnector) SetTransportCallback(fuc onTransport) {
 	connector.OnTransport = fuc
 }
 
-// printInfo 打印信息
-func (connector *TCPTunnelConnector) printInfo(a ...interface{}) {
-	if connector.isDebug {
-		fmt.Println("["+connector.connectorID+"]", a)
-	}
+// SetLogger 设置日志
+func (connector *TCPTunnelConnector) SetLogger(logger *logtool.Logger) {
+	connector.logger = logger
+}
+
+// log 日志, 带有实例ID
+func (connector *TCPTunnelConnector) log() *logtool.Logger {
+	return connector.logger.With("connectorID", connector.connectorID)
 }
 
 // GetID 获取实例ID
@@ -49,85 +81,558 @@ func (connector *TCPTunnelConnector) GetID() string {
 }
 
 // getCMD 读取隧道响应消息
-func (connector *TCPTunnelConnector) getCMD(conn net.Conn) string {
-	b := make([]byte, CMDMAXLEN)
-	n, err := conn.Read(b)
-	if nil == err || err == io.EOF {
-		return string(b[:n])
+func (connector *TCPTunnelConnector) getCMD(conn net.Conn) (*Frame, error) {
+	return ReadFrame(conn)
+}
+
+// sendCMD 发送控制指令, 超过 CMDWTIMEOUT 没有写入时返回错误
+func (connector *TCPTunnelConnector) sendCMD(conn net.Conn, cmd byte, payload []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+	defer conn.SetWriteDeadline(time.Time{})
+	return WriteFrame(conn, cmd, payload)
+}
+
+// dial 连接隧道服务, 使用服务端的挑战码签名后发送握手指令
+// 返回的连接带有握手超时的读写期限, 调用方读取回复后需要清除
+func (connector *TCPTunnelConnector) dial(cmd byte, hs handshake) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	timeout := connector.getTimeouts().Handshake
+	dialer := &net.Dialer{Timeout: timeout}
+	if nil != connector.TLSConfig {
+		conn, err = tls.DialWithDialer(dialer, "tcp4", connector.ServiceAddr.String(), connector.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp4", connector.ServiceAddr.String())
+	}
+	if nil != err {
+		return nil, phaseError(connector.metrics, hs.Tunnel, PHASEHANDSHAKE, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	frame, err := connector.getCMD(conn)
+	if nil == err && frame.Type != CMDCHALLENGE {
+		err = errors.New("tunnel service did not send challenge")
+	}
+	if nil == err {
+		hs.ClientID = connector.connectorID
+		hs.Name = connector.AuthName
+		if len(connector.AuthKey) > 0 {
+			hs.Sign = signHandshake(connector.AuthKey, frame.Payload, cmd, hs)
+		}
+		err = WriteFrame(conn, cmd, encodeHandshake(hs))
+	}
+	if nil != err {
+		conn.Close()
+		return nil, phaseError(connector.metrics, hs.Tunnel, PHASEHANDSHAKE, err)
 	}
-	return ""
+	return conn, nil
 }
 
-// DoConnect 连接隧道服务
-func (connector *TCPTunnelConnector) DoConnect() (err error) {
-	if connector.MaxCount == 0 {
-		connector.MaxCount = 50
+// init 初始化默认值和实例ID, 实例ID在重连时保持不变
+func (connector *TCPTunnelConnector) init() {
+	connector.initOnce.Do(func() {
+		connector.changed = make(chan struct{}, 1)
+		connector.SetPoolSize(connector.MinIdle, connector.MaxCount, connector.MuxCount)
+		connector.metrics = newTunnelMetrics()
+		connector.conns = make(map[net.Conn]bool)
+		connector.muxes = make(map[*MuxSession]bool)
+		connector.stopped = make(chan struct{})
+		if len(connector.connectorID) == 0 {
+			connector.connectorID = strtool.GetUUID()
+		}
+	})
+}
+
+// Metrics 监控指标, 可以注册为 /metrics 的处理器
+func (connector *TCPTunnelConnector) Metrics() *metrictool.Registry {
+	connector.init()
+	return connector.metrics.registry
+}
+
+// SetTunnels 更新注册的隧道名称, 已连接时在控制连接上通知服务端, 其他隧道的连接不受影响
+func (connector *TCPTunnelConnector) SetTunnels(tunnels []string) {
+	connector.lock.Lock()
+	connector.Tunnels = tunnels
+	connector.lock.Unlock()
+	connector.notifyChanged()
+}
+
+// SetPoolSize 更新空闲连接低水位、每个隧道保持的空闲连接数和多路复用连接数, 为0时使用默认值
+// 已连接时在控制连接上通知服务端
+func (connector *TCPTunnelConnector) SetPoolSize(minIdle int64, maxCount int64, muxCount int64) {
+	if maxCount <= 0 {
+		maxCount = 50
 	}
-	if len(connector.connectorID) == 0 {
-		connector.connectorID = strtool.GetUUID()
+	if minIdle <= 0 {
+		minIdle = maxCount / 2
 	}
-	conn, err := net.DialTCP("tcp4", nil, connector.ServiceAddr)
-	defer (func() {
-		if nil != conn {
-			conn.Close()
+	if minIdle <= 0 || minIdle > maxCount {
+		minIdle = maxCount
+	}
+	if muxCount <= 0 {
+		muxCount = 1
+	}
+	connector.lock.Lock()
+	connector.MinIdle = minIdle
+	connector.MaxCount = maxCount
+	connector.MuxCount = muxCount
+	connector.lock.Unlock()
+	connector.notifyChanged()
+}
+
+// SetTimeouts 更新各阶段的超时时间, 只影响之后的连接和会话
+func (connector *TCPTunnelConnector) SetTimeouts(timeouts Timeouts) {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	connector.Timeouts = timeouts
+}
+
+// getTimeouts 各阶段的超时时间, 没有设置时使用默认值
+func (connector *TCPTunnelConnector) getTimeouts() Timeouts {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	return connector.Timeouts.withDefaults()
+}
+
+// RTT 控制连接心跳的往返时间, 还没有连接或收到回复时为0
+func (connector *TCPTunnelConnector) RTT() time.Duration {
+	connector.lock.Lock()
+	hb := connector.ctlBeat
+	connector.lock.Unlock()
+	if nil == hb {
+		return 0
+	}
+	return hb.getRTT()
+}
+
+// getPoolSize 获取空闲连接低水位、每个隧道保持的空闲连接数和多路复用连接数
+func (connector *TCPTunnelConnector) getPoolSize() (int64, int64, int64) {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	return connector.MinIdle, connector.MaxCount, connector.MuxCount
+}
+
+// notifyChanged 通知控制循环检查隧道和连接数, 已有通知未处理时忽略
+func (connector *TCPTunnelConnector) notifyChanged() {
+	select {
+	case connector.changed <- struct{}{}:
+	default:
+	}
+}
+
+// ctlHandshake 控制连接的握手信息, 多路复用模式不使用连接池, 不需要服务端通知补充
+func (connector *TCPTunnelConnector) ctlHandshake(tunnels []string, minIdle int64, maxCount int64) handshake {
+	if connector.Multiplex {
+		return handshake{Tunnels: tunnels}
+	}
+	return handshake{Tunnels: tunnels, MinIdle: int(minIdle), MaxIdle: int(maxCount)}
+}
+
+// Forward 反向转发, 请求服务端连接隧道对应的服务端目标
+// 需要先通过 DoConnect 注册客户端, tunnel 必须是注册的隧道之一, 返回的连接只传输数据帧, 使用完后关闭即可
+func (connector *TCPTunnelConnector) Forward(tunnel string) (net.Conn, error) {
+	connector.init()
+	if connector.isStopping() {
+		return nil, errors.New("tunnel connector is stopping")
+	}
+	conn, err := connector.dial(CMDFORWARD, handshake{Tunnel: tunnel})
+	if nil != err {
+		return nil, err
+	}
+	if _, err = connector.readReply(conn); nil != err {
+		conn.Close()
+		return nil, phaseError(connector.metrics, tunnel, PHASEHANDSHAKE, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return newTunnelConn(conn), nil
+}
+
+// DoConnect 连接隧道服务, 控制连接断开或客户端停止后返回
+func (connector *TCPTunnelConnector) DoConnect() error {
+	return connector.Connect(context.Background())
+}
+
+// Connect 连接隧道服务并保持连接池, 控制连接断开时返回错误, 调用方可以重连
+// ctx 取消时立即停止客户端, 不等待正在传输的会话, 返回 ctx.Err(); 调用 Stop 停止后返回nil
+func (connector *TCPTunnelConnector) Connect(ctx context.Context) (err error) {
+	connector.init()
+	if connector.isStopping() {
+		return errors.New("tunnel connector is stopped")
+	}
+	connector.setState(STATECONNECTING, nil)
+	defer func() {
+		connector.setState(STATEDISCONNECTED, err)
+	}()
+	// 1. 注册客户端和隧道, 服务端会清空该客户端之前的连接; 同时告知空闲连接数, 服务端据此通知补充
+	tunnels := connector.getTunnels()
+	minIdle, maxCount, _ := connector.getPoolSize()
+	conn, err := connector.dial(CMDCONNECTCTRL, connector.ctlHandshake(tunnels, minIdle, maxCount))
+	if nil != err {
+		return err
+	}
+	defer conn.Close()
+	// ctx 取消时停止客户端, 停止完成后下面的循环返回
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connector.Stop(ctx)
+		case <-done:
 		}
-	})()
-	if nil == err {
-		// 说明连接上服务端了
-		// 1. 先清空服务端现有隧道连接缓存
-		_, err = conn.Write([]byte(CMDCONNECTCTRL))
-		if nil == err {
-			for {
-				// 2. 查询服务端的连接情况
-				_, err = conn.Write([]byte(CMDCOUNTCONN))
-				if nil == err {
-					connector.currentCount, err = strconv.ParseInt(connector.getCMD(conn), 10, 64)
-				}
-				if nil == err {
-					// 3. 如果个数不够则需要创建新连接
-					if connector.MaxCount > connector.currentCount {
-						connector.doAddConnect()
-					} else {
-						time.Sleep(time.Duration(500) * time.Millisecond)
-					}
+	}()
+	// 说明连接上服务端了
+	if _, err = connector.readReply(conn); nil != err {
+		return phaseError(connector.metrics, "", PHASEHANDSHAKE, err)
+	}
+	conn.SetDeadline(time.Time{})
+	if atomic.AddInt64(&connector.connects, 1) > 1 {
+		connector.metrics.reconnects.Inc()
+	}
+	connector.setState(STATECONNECTED, nil)
+	// 2. 服务端在空闲连接不足时推送补充通知, 由单独的协程读取
+	ctl := newControlConn(conn, connector.metrics, connector.getTimeouts().Reply)
+	go ctl.readLoop(connector.onDemand)
+	connector.lock.Lock()
+	connector.ctlBeat = ctl.hb
+	connector.lock.Unlock()
+	requested := tunnels
+	// 定时发送心跳, 超过 HEARTTIMEOUT 没有收到服务端的指令时认为连接已断开
+	heart := time.NewTicker(HEARTINTERVAL)
+	defer heart.Stop()
+	for {
+		// 正在停止时不再补充连接, 等待停止完成
+		if !connector.isStopping() {
+			// 隧道名称或连接数有变化时通知服务端, 失败时保持之前的设置, 直到再次变化
+			want := connector.getTunnels()
+			wantMin, wantMax, muxCount := connector.getPoolSize()
+			if !sameTunnels(want, requested) || wantMin != minIdle || wantMax != maxCount {
+				requested, minIdle, maxCount = want, wantMin, wantMax
+				if _, err := ctl.request(CMDUPDATETUNNELS, encodeHandshake(connector.ctlHandshake(want, wantMin, wantMax))); nil != err {
+					connector.log().Warn("update tunnels failed", "tunnels", strings.Join(want, ","), "err", err)
+				} else {
+					tunnels = want
 				}
-				if nil != err {
+			}
+			// 3. 多路复用模式下补充物理连接, 连接断开时会再次通知
+			for connector.Multiplex && muxCount > atomic.LoadInt64(&connector.muxCount) {
+				if err = connector.doAddMuxConnect(); nil != err {
 					return err
 				}
 			}
 		}
+		select {
+		case <-connector.stopped:
+			return ctx.Err()
+		case <-ctl.done:
+			return ctl.err
+		case <-connector.changed:
+		case <-heart.C:
+			if ctl.hb.expired(HEARTTIMEOUT) {
+				connector.metrics.timeouts.Inc("", PHASEHEARTBEAT)
+				return &TimeoutError{Phase: PHASEHEARTBEAT}
+			}
+			if err = ctl.write(CMDPING, ctl.hb.next()); nil != err {
+				return err
+			}
+		}
 	}
+}
+
+// onDemand 处理服务端的补充通知, 同时新建多个连接预热连接池
+func (connector *TCPTunnelConnector) onDemand(demand poolDemand) {
+	if connector.Multiplex || connector.isStopping() {
+		return
+	}
+	_, maxCount, _ := connector.getPoolSize()
+	count := int64(demand.Count)
+	if count > maxCount {
+		count = maxCount
+	}
+	connector.log().Debug("pool demand", "tunnel", demand.Tunnel, "count", count)
+	go connector.doAddConnects(demand.Tunnel, int(count))
+}
+
+// Stop 停止客户端: 不再补充连接, 关闭空闲连接并拒绝新的传输, 等待正在传输的会话结束
+// ctx 结束时关闭剩余的连接并返回 ctx.Err(), 最后断开控制连接使 Connect 返回, 停止后不能再次连接
+func (connector *TCPTunnelConnector) Stop(ctx context.Context) (err error) {
+	connector.init()
+	connector.stopOnce.Do(func() {
+		connector.connLock.Lock()
+		connector.stopping = true
+		for conn, idle := range connector.conns {
+			if idle {
+				conn.Close()
+			}
+		}
+		active := connector.active
+		connector.connLock.Unlock()
+		connector.log().Info("tunnel connector stopping", "sessions", active)
+		err = connector.drain(ctx)
+		connector.connLock.Lock()
+		for conn := range connector.conns {
+			conn.Close()
+		}
+		for session := range connector.muxes {
+			session.Close()
+		}
+		connector.connLock.Unlock()
+		close(connector.stopped)
+		connector.log().Info("tunnel connector stopped")
+	})
 	return err
 }
 
+// Done 客户端停止后关闭的通道
+func (connector *TCPTunnelConnector) Done() <-chan struct{} {
+	connector.init()
+	return connector.stopped
+}
+
+// isStopping 是否正在停止或已停止
+func (connector *TCPTunnelConnector) isStopping() bool {
+	connector.connLock.Lock()
+	defer connector.connLock.Unlock()
+	return connector.stopping
+}
+
+// drain 等待正在传输的会话结束, ctx 结束时返回 ctx.Err()
+func (connector *TCPTunnelConnector) drain(ctx context.Context) error {
+	ticker := time.NewTicker(DRAININTERVAL)
+	defer ticker.Stop()
+	for {
+		connector.connLock.Lock()
+		active := connector.active
+		connector.connLock.Unlock()
+		if active <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// beginTransport 开始一次传输, 正在停止时返回false; conn 为连接池中的连接, 逻辑流传入nil
+func (connector *TCPTunnelConnector) beginTransport(conn net.Conn) bool {
+	connector.connLock.Lock()
+	defer connector.connLock.Unlock()
+	if connector.stopping {
+		return false
+	}
+	if nil != conn {
+		connector.conns[conn] = false
+	}
+	connector.active++
+	return true
+}
+
+// endTransport 结束一次传输, 返回连接是否可以继续等待下一次传输, 正在停止时返回false
+func (connector *TCPTunnelConnector) endTransport(conn net.Conn) bool {
+	connector.connLock.Lock()
+	defer connector.connLock.Unlock()
+	connector.active--
+	if _, exist := connector.conns[conn]; exist && nil != conn {
+		connector.conns[conn] = true
+	}
+	return !connector.stopping
+}
+
+// getTunnels 需要注册的隧道名称, 没有设置时使用默认隧道
+func (connector *TCPTunnelConnector) getTunnels() []string {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	if len(connector.Tunnels) == 0 {
+		return []string{DEFAULTTUNNEL}
+	}
+	return connector.Tunnels
+}
+
+// sameTunnels 两组隧道名称是否相同, 不考虑顺序
+func sameTunnels(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	names := make(map[string]bool, len(a))
+	for _, name := range a {
+		names[name] = true
+	}
+	for _, name := range b {
+		if !names[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// readReply 读取服务端回复, 回复错误时返回错误信息
+func (connector *TCPTunnelConnector) readReply(conn net.Conn) ([]byte, error) {
+	frame, err := connector.getCMD(conn)
+	if nil != err {
+		return nil, err
+	}
+	if frame.Type != CMDOK {
+		return nil, errors.New("tunnel service replied: " + string(frame.Payload))
+	}
+	return frame.Payload, nil
+}
+
+// controlConn 客户端的控制连接, 服务端会主动推送补充通知, 由 readLoop 读取后分发
+type controlConn struct {
+	conn    net.Conn
+	metrics *tunnelMetrics // 监控指标, 记录回复超时和心跳往返时间
+	timeout time.Duration  // 等待回复的时间
+	hb      *heartbeat     // 控制连接心跳
+	replies chan *Frame    // 指令回复
+	done    chan struct{}  // 读取失败后关闭
+	err     error          // 读取失败的原因, done关闭后可以读取
+	wlock   sync.Mutex     // 写锁, 指令和心跳回复可能同时写入
+}
+
+// newControlConn 创建控制连接, timeout 为等待指令回复的时间
+func newControlConn(conn net.Conn, metrics *tunnelMetrics, timeout time.Duration) *controlConn {
+	return &controlConn{
+		conn:    conn,
+		metrics: metrics,
+		timeout: timeout,
+		hb:      newHeartbeat(),
+		replies: make(chan *Frame, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// readLoop 读取控制连接, 补充通知交给onDemand处理, 回复服务端的心跳, 其他指令作为回复
+func (ctl *controlConn) readLoop(onDemand func(demand poolDemand)) {
+	defer close(ctl.done)
+	for {
+		frame, err := ReadFrame(ctl.conn)
+		if nil != err {
+			ctl.err = err
+			return
+		}
+		ctl.hb.seen()
+		switch frame.Type {
+		case CMDPOOLDEMAND:
+			if demand, err := decodePoolDemand(frame.Payload); nil == err {
+				onDemand(demand)
+			}
+			continue
+		case CMDPING:
+			// 写入失败时连接已断开, 下一次读取会返回错误
+			ctl.write(CMDPONG, frame.Payload)
+			continue
+		case CMDPONG:
+			if rtt, err := ctl.hb.pong(frame.Payload); nil == err {
+				ctl.metrics.controlRTT.Observe(rtt.Seconds())
+			}
+			continue
+		}
+		// 没有等待回复的指令时丢弃
+		select {
+		case ctl.replies <- frame:
+		default:
+		}
+	}
+}
+
+// write 写入指令, 超过 CMDWTIMEOUT 没有写入时返回错误
+func (ctl *controlConn) write(cmd byte, payload []byte) error {
+	ctl.wlock.Lock()
+	defer ctl.wlock.Unlock()
+	ctl.conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+	defer ctl.conn.SetWriteDeadline(time.Time{})
+	return WriteFrame(ctl.conn, cmd, payload)
+}
+
+// request 发送指令并等待回复, 回复错误时返回错误信息
+func (ctl *controlConn) request(cmd byte, payload []byte) ([]byte, error) {
+	// 丢弃之前超时的指令的回复
+	select {
+	case <-ctl.replies:
+	default:
+	}
+	if err := ctl.write(cmd, payload); nil != err {
+		return nil, err
+	}
+	select {
+	case frame := <-ctl.replies:
+		if frame.Type != CMDOK {
+			return nil, errors.New("tunnel service replied: " + string(frame.Payload))
+		}
+		return frame.Payload, nil
+	case <-ctl.done:
+		return nil, ctl.err
+	case <-time.After(ctl.timeout):
+		ctl.metrics.timeouts.Inc("", PHASEREPLY)
+		return nil, &TimeoutError{Phase: PHASEREPLY}
+	}
+}
+
 // doListen 监听是否是有数据发送过来
-func (connector *TCPTunnelConnector) doListen(conn *net.TCPConn) {
+func (connector *TCPTunnelConnector) doListen(conn net.Conn) {
+	defer func() {
+		connector.connLock.Lock()
+		delete(connector.conns, conn)
+		connector.connLock.Unlock()
+	}()
 	if nil != conn {
 		for {
-			cmd := connector.getCMD(conn)
-			connector.printInfo("Listen-MSG: ", cmd)
-			if cmd == CMDTRANSPORTSTART {
-				_, err := conn.Write([]byte(CMDOK))
+			// 空闲时服务端定时发送心跳, 超过 HEARTTIMEOUT 没有收到指令时认为连接已断开
+			conn.SetReadDeadline(time.Now().Add(HEARTTIMEOUT))
+			frame, err := connector.getCMD(conn)
+			conn.SetReadDeadline(time.Time{})
+			if nil != err {
+				conn.Close()
+				break
+			}
+			connector.log().Debug("listen cmd", "cmd", frame.Type)
+			if frame.Type == CMDTRANSPORTSTART {
+				info, err := decodeTransportInfo(frame.Payload)
 				if nil != err {
+					connector.sendCMD(conn, CMDERROR, []byte(err.Error()))
 					conn.Close()
 					break
 				}
-				if nil != connector.OnTransport {
-					connector.OnTransport(conn, func() {
-						_, err := conn.Write([]byte(CMDRESET))
-						if nil != err {
-							conn.Close()
-						} else {
-							connector.doListen(conn)
-						}
+				if !connector.beginTransport(conn) {
+					connector.sendCMD(conn, CMDERROR, []byte("503: tunnel client is stopping"))
+					conn.Close()
+					break
+				}
+				err = connector.sendCMD(conn, CMDOK, nil)
+				if nil != err {
+					conn.Close()
+					break
+				}
+				// 传输结束后发送重置指令, 回调没有释放时这里补充释放
+				tconn := newTunnelConn(conn)
+				session := newSessionConn(tconn, connector.connectorID, info, connector.metrics, connector.getTimeouts())
+				var once sync.Once
+				release := func() {
+					once.Do(func() {
+						session.finish()
+						conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+						err = tconn.sendReset()
+						conn.SetWriteDeadline(time.Time{})
 					})
 				}
-			} else if cmd == CMDCONNHEART {
-				_, err := conn.Write([]byte(CMDOK))
+				if nil != connector.OnTransport {
+					connector.OnTransport(session, info, release)
+				}
+				release()
+				if !connector.endTransport(conn) || nil != err {
+					conn.Close()
+					break
+				}
+			} else if frame.Type == CMDCONNHEART {
+				err := connector.sendCMD(conn, CMDOK, nil)
 				if nil != err {
 					conn.Close()
 					break
 				}
+			} else if frame.Type == CMDDATA || frame.Type == CMDEOF {
+				// 提前释放后服务端仍在发送的数据, 丢弃
+				continue
 			} else {
 				// 不识别的信号, 断开链接
 				conn.Close()
@@ -137,19 +642,121 @@ func (connector *TCPTunnelConnector) doListen(conn *net.TCPConn) {
 	}
 }
 
-// doAddConnect 添加隧道空闲连接
-func (connector *TCPTunnelConnector) doAddConnect() error {
-	conn, err := net.DialTCP("tcp4", nil, connector.ServiceAddr)
+// doAddConnect 为指定隧道添加空闲连接
+func (connector *TCPTunnelConnector) doAddConnect(tunnel string) error {
+	// 发送连接请求
+	conn, err := connector.dial(CMDCONNECT, handshake{Tunnel: tunnel})
 	if nil != err {
 		return err
 	}
-	// 发送连接请求
-	_, err = conn.Write([]byte(CMDCONNECT))
-	if nil != err {
+	conn.SetDeadline(time.Time{})
+	connector.connLock.Lock()
+	if connector.stopping {
+		connector.connLock.Unlock()
 		conn.Close()
-		return err
+		return errors.New("tunnel connector is stopping")
 	}
+	connector.conns[conn] = true
+	connector.connLock.Unlock()
 	// 执行回调
 	go connector.doListen(conn)
 	return nil
 }
+
+// doAddConnects 为指定隧道同时新建多个空闲连接, 同时进行的连接数不超过 PREWARMPARALLEL
+// 有连接新建失败时进入 STATEDEGRADED 状态, 之后全部成功时恢复为 STATECONNECTED
+func (connector *TCPTunnelConnector) doAddConnects(tunnel string, count int) {
+	sem := make(chan struct{}, PREWARMPARALLEL)
+	var failed int64
+	var lastErr atomic.Value
+	var wg sync.WaitGroup
+	for i := 0; i < count && !connector.isStopping(); i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := connector.doAddConnect(tunnel); nil != err {
+				atomic.AddInt64(&failed, 1)
+				lastErr.Store(err)
+				connector.log().Debug("add connect failed", "tunnel", tunnel, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed == 0 {
+		connector.setState(STATECONNECTED, nil, STATEDEGRADED)
+		return
+	}
+	err := lastErr.Load().(error)
+	if connector.isStopping() {
+		return
+	}
+	connector.log().Warn("add connects failed", "tunnel", tunnel, "failed", failed, "total", count, "err", err)
+	connector.setState(STATEDEGRADED, err, STATECONNECTED)
+}
+
+// doAddMuxConnect 添加多路复用连接, 服务端在该连接上打开逻辑流进行传输
+func (connector *TCPTunnelConnector) doAddMuxConnect() error {
+	conn, err := connector.dial(CMDMUXCONNECT, handshake{})
+	if nil != err {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	session := NewMuxSession(conn, true)
+	connector.connLock.Lock()
+	if connector.stopping {
+		connector.connLock.Unlock()
+		session.Close()
+		return errors.New("tunnel connector is stopping")
+	}
+	connector.muxes[session] = true
+	connector.connLock.Unlock()
+	atomic.AddInt64(&connector.muxCount, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&connector.muxCount, -1)
+			connector.connLock.Lock()
+			delete(connector.muxes, session)
+			connector.connLock.Unlock()
+			connector.notifyChanged()
+		}()
+		for {
+			stream, err := session.AcceptStream()
+			if nil != err {
+				connector.log().Debug("mux closed", "err", err)
+				return
+			}
+			go connector.doStreamTransport(stream)
+		}
+	}()
+	return nil
+}
+
+// doStreamTransport 处理服务端打开的逻辑流, 释放时关闭逻辑流
+func (connector *TCPTunnelConnector) doStreamTransport(stream *MuxStream) {
+	var once sync.Once
+	var session *sessionConn
+	release := func() {
+		once.Do(func() {
+			if nil != session {
+				session.finish()
+			}
+			stream.Close()
+		})
+	}
+	info, err := decodeTransportInfo(stream.Info())
+	if nil != err {
+		connector.log().Debug("stream info error", "err", err)
+	} else if !connector.beginTransport(nil) {
+		connector.log().Debug("stream refused, tunnel client is stopping")
+	} else {
+		if nil != connector.OnTransport {
+			session = newSessionConn(stream, connector.connectorID, info, connector.metrics, connector.getTimeouts())
+			connector.OnTransport(session, info, release)
+		}
+		release()
+		connector.endTransport(nil)
+	}
+	release()
+}
@@ -14,27 +14,90 @@ import (
 )
 
 const (
-	// CMDMAXLEN 管理命令最大字符数
-	CMDMAXLEN = 1024
+	// CMDMAXLEN 帧负载最大字节数, 超过该长度的数据需要拆分成多帧发送
+	CMDMAXLEN = 1024 * 32
+	// FRAMEHEADERLEN 帧头长度: 类型(1字节) + 负载长度(4字节, 大端)
+	FRAMEHEADERLEN = 5
+
 	// CMDCONNECTCTRL 管理线程链接
-	CMDCONNECTCTRL = "\r- doconnectctrl -\n"
+	CMDCONNECTCTRL byte = 0x01
 	// CMDCONNECT 创建连接
-	CMDCONNECT = "\r- doconnect -\n"
-	// CMDCOUNTCONN 统计连接数
-	CMDCOUNTCONN = "\r- countconn -\n"
+	CMDCONNECT byte = 0x02
+	// CMDCOUNTCONN 统计连接数, 客户端已改为接收 CMDPOOLDEMAND 通知和使用 CMDPING 心跳, 保留用于兼容旧的客户端
+	CMDCOUNTCONN byte = 0x03
 	// CMDCLEARCONN 清理连接池
-	CMDCLEARCONN = "\r- clearconn -\n"
+	CMDCLEARCONN byte = 0x04
 	// CMDTRANSPORTSTART 开始传输
-	CMDTRANSPORTSTART = "\r- transportstart -\n"
-	// CMDCONNHEART 心跳包
-	CMDCONNHEART = "\r- connheart -\n"
-	// CMDOK 准备就绪
-	CMDOK = "\r- ok -\n"
-	// CMDRESET 重置链接
-	CMDRESET = "\r- reset -\n"
+	CMDTRANSPORTSTART byte = 0x05
+	// CMDCONNHEART 空闲连接心跳包, 服务端先从连接池取出连接再发送, 心跳期间不会开始传输
+	CMDCONNHEART byte = 0x06
+	// CMDOK 准备就绪, 负载为回复内容
+	CMDOK byte = 0x07
+	// CMDRESET 重置链接, 表示本次传输结束
+	CMDRESET byte = 0x08
+	// CMDERROR 错误回复, 负载为错误信息
+	CMDERROR byte = 0x09
+	// CMDDATA 传输数据, 负载为隧道内的数据
+	CMDDATA byte = 0x0A
+	// CMDMUXCONNECT 创建多路复用连接, 该连接上的所有帧交由 MuxSession 处理
+	CMDMUXCONNECT byte = 0x0B
+	// CMDSTREAMOPEN 打开逻辑流, 负载: 流ID(4字节) + 附加信息
+	CMDSTREAMOPEN byte = 0x0C
+	// CMDSTREAMDATA 逻辑流数据, 负载: 流ID(4字节) + 数据
+	CMDSTREAMDATA byte = 0x0D
+	// CMDSTREAMCLOSE 逻辑流单向关闭, 负载: 流ID(4字节)
+	CMDSTREAMCLOSE byte = 0x0E
+	// CMDSTREAMWINDOW 逻辑流接收窗口增量, 负载: 流ID(4字节) + 增量(4字节)
+	CMDSTREAMWINDOW byte = 0x0F
+	// CMDEOF 单向关闭, 对端读取时返回 io.EOF, 但本次传输还未结束
+	CMDEOF byte = 0x10
+	// CMDCHALLENGE 认证挑战码, 连接建立后服务端首先发送, 负载为随机数
+	CMDCHALLENGE byte = 0x11
+	// CMDFORWARD 反向转发, 客户端请求服务端连接隧道对应的服务端目标, 成功后连接只传输数据帧
+	CMDFORWARD byte = 0x12
+	// CMDUPDATETUNNELS 控制连接上更新客户端注册的隧道, 负载为握手信息(只使用隧道名称和空闲连接数)
+	CMDUPDATETUNNELS byte = 0x13
+	// CMDPOOLDEMAND 服务端在控制连接上通知客户端补充空闲连接, 负载为补充通知(隧道名称和连接数)
+	CMDPOOLDEMAND byte = 0x14
+	// CMDPING 控制连接心跳, 双方都会发送, 负载为序号(8字节, 大端)
+	CMDPING byte = 0x15
+	// CMDPONG 控制连接心跳回复, 负载为收到的 CMDPING 的序号
+	CMDPONG byte = 0x16
+
+	// MUXWINDOWSIZE 逻辑流接收窗口大小, 对端最多发送这么多未被读取的数据
+	MUXWINDOWSIZE = 1024 * 256
+	// MUXACCEPTBACKLOG 等待处理的逻辑流个数, 已满时拒绝对端新打开的逻辑流
+	MUXACCEPTBACKLOG = 128
+	// MUXHEARTINTERVAL 多路复用连接心跳间隔, 超过3个间隔没有收到任何帧则断开
+	MUXHEARTINTERVAL = time.Second * 5
+
+	// DEFAULTTUNNEL 默认隧道名称, 客户端没有指定隧道时注册该名称
+	DEFAULTTUNNEL = "default"
 
-	// CMDWTIMEOUT TCP写入超时
+	// CMDWTIMEOUT TCP写入超时, 写入控制指令时使用
 	CMDWTIMEOUT = time.Second * 30
-	// CMDRTIMEOUT TCP读取超时
+	// CMDRTIMEOUT TCP读取超时, 入口读取请求头时使用
 	CMDRTIMEOUT = time.Second * 60
+	// DEFAULTHANDSHAKETIMEOUT 新连接完成握手的默认时间
+	DEFAULTHANDSHAKETIMEOUT = time.Second * 10
+	// DEFAULTREPLYTIMEOUT 等待指令回复的默认时间
+	DEFAULTREPLYTIMEOUT = time.Second * 10
+	// PREWARMPARALLEL 客户端补充空闲连接时同时新建的连接数
+	PREWARMPARALLEL = 8
+	// HEARTINTERVAL 心跳间隔, 控制连接和空闲连接都按该间隔发送心跳
+	HEARTINTERVAL = time.Second * 5
+	// HEARTTIMEOUT 超过该时间没有收到对端的指令时认为连接已断开
+	HEARTTIMEOUT = HEARTINTERVAL * 3
+	// DEMANDTIMEOUT 通知补充后等待连接到达的时间, 超时后没有到达的连接不再计算, 重新通知
+	DEMANDTIMEOUT = time.Second * 10
+	// DEFAULTQUEUESIZE 每个隧道等待空闲连接的默认最大请求数
+	DEFAULTQUEUESIZE = 256
+	// DEFAULTQUEUETIMEOUT 等待空闲连接的默认最长时间
+	DEFAULTQUEUETIMEOUT = time.Second * 10
+	// DEFAULTBACKOFFMIN 控制连接断开后第一次重连的默认间隔
+	DEFAULTBACKOFFMIN = time.Second
+	// DEFAULTBACKOFFMAX 连续重连失败时的默认最大间隔
+	DEFAULTBACKOFFMAX = time.Minute
+	// DRAININTERVAL 停止时检查会话是否已全部结束的间隔
+	DRAININTERVAL = time.Millisecond * 100
 )
@@ -0,0 +1,71 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 目标连接结果: 服务端在传输信息中要求确认时, 客户端连接目标后先回复结果再交换数据
+// 成功回复 CMDOK, 失败回复 CMDERROR, 负载为 "状态码: 错误信息"
+
+package tcptunnelmanager
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDestNotAllowed 目标地址不在白名单内
+var ErrDestNotAllowed = errors.New("destination not allowed")
+
+// DialError 客户端回复的目标连接错误
+type DialError struct {
+	Code int    // 状态码, 403为不允许连接, 其他为连接失败
+	Msg  string // 错误信息
+}
+
+// Error 错误信息
+func (err *DialError) Error() string {
+	return strconv.Itoa(err.Code) + ": " + err.Msg
+}
+
+// StatusCode 状态码
+func (err *DialError) StatusCode() int {
+	return err.Code
+}
+
+// SendDialResult 回复目标连接结果, 不允许连接(ErrDestNotAllowed)时状态码为403, 其他错误为502
+func SendDialResult(conn net.Conn, err error) error {
+	conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+	defer conn.SetWriteDeadline(time.Time{})
+	if nil == err {
+		return WriteFrame(conn, CMDOK, nil)
+	}
+	code := "502: "
+	if errors.Is(err, ErrDestNotAllowed) {
+		code = "403: "
+	}
+	return WriteFrame(conn, CMDERROR, []byte(code+err.Error()))
+}
+
+// parseDialResult 解析目标连接结果, 成功时返回nil
+func parseDialResult(frame *Frame) error {
+	switch frame.Type {
+	case CMDOK:
+		return nil
+	case CMDERROR:
+		res := &DialError{Code: 502, Msg: string(frame.Payload)}
+		if index := strings.Index(res.Msg, ": "); index > 0 {
+			if code, err := strconv.Atoi(res.Msg[:index]); nil == err {
+				res.Code, res.Msg = code, res.Msg[index+2:]
+			}
+		}
+		return res
+	}
+	return errors.New("unexpected dial result: " + strconv.Itoa(int(frame.Type)))
+}
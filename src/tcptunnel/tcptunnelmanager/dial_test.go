@@ -0,0 +1,114 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gutils/logtool"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试目标连接结果: 客户端连接目标后回复结果, 不允许的目标为403, 连接失败为502, 成功后交换数据
+func TestDialResult(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	// 关闭监听得到一个连接会被拒绝的地址
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+	allows, err := NewAllowList([]string{"127.0.0.1"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, multiplex := range []bool{false, true} {
+		logger := logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT)
+		service := &TCPTunnelService{ServiceAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+		service.SetLogger(logger)
+		if err := service.Start(context.Background()); nil != err {
+			t.Fatal(err)
+		}
+		connector := &TCPTunnelConnector{ServiceAddr: service.Addr().(*net.TCPAddr), MaxCount: 2, Multiplex: multiplex, MuxCount: 1}
+		connector.SetLogger(logger)
+		connector.SetTransportCallback(func(conn net.Conn, info TransportInfo, release func()) error {
+			defer release()
+			if !allows.Allow(info.Dest) {
+				return SendDialResult(conn, fmt.Errorf("%w: %s", ErrDestNotAllowed, info.Dest))
+			}
+			dest, err := net.Dial("tcp", info.Dest)
+			if e := SendDialResult(conn, err); nil != err || nil != e {
+				return err
+			}
+			defer dest.Close()
+			go func() {
+				io.Copy(dest, conn)
+				dest.(*net.TCPConn).CloseWrite()
+			}()
+			io.Copy(conn, dest)
+			return nil
+		})
+		go connector.Connect(context.Background())
+		for i := 0; i < 50 && len(service.Clients()) == 0; i++ {
+			time.Sleep(DRAININTERVAL)
+		}
+		cases := []struct {
+			dest string
+			code int
+		}{
+			{target.Addr().String(), 0},
+			{"10.0.0.1:80", 403},
+			{unreachable, 502},
+		}
+		for _, c := range cases {
+			conn := service.GetConn(TransportInfo{Dest: c.dest, Confirm: true})
+			if nil == conn {
+				t.Fatal("no conn, multiplex: ", multiplex)
+			}
+			err := service.ReadDialResult(conn, "")
+			if c.code == 0 {
+				if nil != err {
+					t.Fatal(c.dest, err)
+				}
+				echo(t, conn, "ping")
+				finish(service, conn)
+				continue
+			}
+			var dialErr *DialError
+			if !errors.As(err, &dialErr) || dialErr.StatusCode() != c.code {
+				t.Fatal(c.dest, " expected ", c.code, ": ", err)
+			}
+			service.RelaseConn(conn)
+		}
+		connector.Stop(context.Background())
+		service.Stop(context.Background())
+	}
+}
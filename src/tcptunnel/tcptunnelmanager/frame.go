@@ -0,0 +1,175 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 隧道协议帧: 类型(1字节) + 负载长度(4字节, 大端) + 负载
+// 控制指令和隧道内的数据都以帧的形式传输, 读取时按长度完整读取,
+// 因此指令之间、指令与数据之间都不会出现粘连或截断
+
+package tcptunnelmanager
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Frame 隧道协议帧
+type Frame struct {
+	Type    byte   // 帧类型, 即 CMDXXX 指令
+	Payload []byte // 负载
+}
+
+// EncodeFrame 编码一帧
+func EncodeFrame(t byte, payload []byte) ([]byte, error) {
+	if len(payload) > CMDMAXLEN {
+		return nil, errors.New("frame payload too large: " + strconv.Itoa(len(payload)))
+	}
+	b := make([]byte, FRAMEHEADERLEN+len(payload))
+	b[0] = t
+	binary.BigEndian.PutUint32(b[1:FRAMEHEADERLEN], uint32(len(payload)))
+	copy(b[FRAMEHEADERLEN:], payload)
+	return b, nil
+}
+
+// WriteFrame 编码并写入一帧, 整帧一次写入
+func WriteFrame(w io.Writer, t byte, payload []byte) error {
+	b, err := EncodeFrame(t, payload)
+	if nil != err {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadFrame 读取一帧, 帧不完整或长度非法时返回错误
+func ReadFrame(r io.Reader) (*Frame, error) {
+	header := make([]byte, FRAMEHEADERLEN)
+	if _, err := io.ReadFull(r, header); nil != err {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > CMDMAXLEN {
+		return nil, errors.New("frame payload too large: " + strconv.FormatUint(uint64(length), 10))
+	}
+	frame := &Frame{Type: header[0], Payload: make([]byte, length)}
+	if _, err := io.ReadFull(r, frame.Payload); nil != err {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// TunnelConn 隧道传输连接, 写入的数据封装成数据帧发送, 读取时只返回数据帧的负载
+// 收到 CMDEOF 或 CMDRESET 后 Read 返回 io.EOF, 收到 CMDRESET 视为本次传输结束
+type TunnelConn struct {
+	net.Conn
+	readBuf     []byte     // 未读完的数据帧负载
+	readEOF     bool       // 对端是否已关闭写入
+	isReset     bool       // 是否已收到重置指令
+	writeClosed bool       // 本端是否已关闭写入
+	wlock       sync.Mutex // 写锁, 保证帧完整写入
+}
+
+// newTunnelConn 包装一个已经开始传输的连接
+func newTunnelConn(conn net.Conn) *TunnelConn {
+	return &TunnelConn{Conn: conn}
+}
+
+// Read 读取隧道数据
+func (tconn *TunnelConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(tconn.readBuf) == 0 {
+		if tconn.readEOF {
+			return 0, io.EOF
+		}
+		if err := tconn.readFrame(); nil != err {
+			return 0, err
+		}
+	}
+	n := copy(b, tconn.readBuf)
+	tconn.readBuf = tconn.readBuf[n:]
+	return n, nil
+}
+
+// Write 写入隧道数据, 超过帧长度时拆分发送
+func (tconn *TunnelConn) Write(b []byte) (n int, err error) {
+	tconn.wlock.Lock()
+	defer tconn.wlock.Unlock()
+	if tconn.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
+	for n < len(b) {
+		end := n + CMDMAXLEN
+		if end > len(b) {
+			end = len(b)
+		}
+		if err = WriteFrame(tconn.Conn, CMDDATA, b[n:end]); nil != err {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+// CloseWrite 关闭写入, 对端读取完剩余数据后收到 io.EOF, 连接本身不会关闭
+func (tconn *TunnelConn) CloseWrite() error {
+	tconn.wlock.Lock()
+	defer tconn.wlock.Unlock()
+	if tconn.writeClosed {
+		return nil
+	}
+	tconn.writeClosed = true
+	return WriteFrame(tconn.Conn, CMDEOF, nil)
+}
+
+// sendReset 发送重置指令, 通知对端本次传输结束
+func (tconn *TunnelConn) sendReset() error {
+	tconn.wlock.Lock()
+	defer tconn.wlock.Unlock()
+	return WriteFrame(tconn.Conn, CMDRESET, nil)
+}
+
+// waitReset 丢弃剩余数据直到收到重置指令
+func (tconn *TunnelConn) waitReset() error {
+	tconn.readBuf = nil
+	for !tconn.isReset {
+		if err := tconn.readFrame(); nil != err {
+			return err
+		}
+		tconn.readBuf = nil
+	}
+	return nil
+}
+
+// readFrame 读取一帧并刷新状态
+func (tconn *TunnelConn) readFrame() error {
+	frame, err := ReadFrame(tconn.Conn)
+	if nil != err {
+		return err
+	}
+	switch frame.Type {
+	case CMDDATA:
+		tconn.readBuf = frame.Payload
+	case CMDEOF:
+		tconn.readEOF = true
+	case CMDRESET:
+		tconn.readEOF = true
+		tconn.isReset = true
+	default:
+		return errors.New("unexpected frame in transport: " + strconv.Itoa(int(frame.Type)))
+	}
+	return nil
+}
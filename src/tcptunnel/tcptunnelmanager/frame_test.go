@@ -0,0 +1,76 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// 测试帧的编码和解码, 多帧粘连和分段到达都能正确解析
+func TestFrameCodec(t *testing.T) {
+	buf := new(bytes.Buffer)
+	WriteFrame(buf, CMDCONNECTCTRL, nil)
+	WriteFrame(buf, CMDCOUNTCONN, nil)
+	WriteFrame(buf, CMDOK, []byte("50"))
+	// 一次全部写入, 逐帧读取
+	for _, want := range []byte{CMDCONNECTCTRL, CMDCOUNTCONN, CMDOK} {
+		frame, err := ReadFrame(buf)
+		if nil != err || frame.Type != want {
+			t.Fatal("read frame error: ", frame, err)
+		}
+		if frame.Type == CMDOK && string(frame.Payload) != "50" {
+			t.Fatal("payload error: ", string(frame.Payload))
+		}
+	}
+	// 分段到达
+	b, _ := EncodeFrame(CMDERROR, []byte("401: cmd not support!"))
+	src, dest := net.Pipe()
+	go func() {
+		for i := 0; i < len(b); i++ {
+			src.Write(b[i : i+1])
+		}
+	}()
+	frame, err := ReadFrame(dest)
+	if nil != err || frame.Type != CMDERROR || string(frame.Payload) != "401: cmd not support!" {
+		t.Fatal("read split frame error: ", frame, err)
+	}
+	// 超长负载
+	if _, err := EncodeFrame(CMDDATA, make([]byte, CMDMAXLEN+1)); nil == err {
+		t.Fatal("payload length is not checked")
+	}
+}
+
+// 测试传输连接, 数据帧与重置指令互不干扰
+func TestTunnelConn(t *testing.T) {
+	src, dest := net.Pipe()
+	data := bytes.Repeat([]byte("\r\n0\r\n"), CMDMAXLEN)
+	go func() {
+		tconn := newTunnelConn(src)
+		tconn.Write(data)
+		tconn.sendReset()
+		WriteFrame(src, CMDCONNHEART, nil)
+	}()
+	tconn := newTunnelConn(dest)
+	received, err := io.ReadAll(tconn)
+	if nil != err || !bytes.Equal(received, data) {
+		t.Fatal("read tunnel data error: ", len(received), err)
+	}
+	if err := tconn.waitReset(); nil != err {
+		t.Fatal(err)
+	}
+	// 传输结束后的指令不应被当作数据读取
+	frame, err := ReadFrame(dest)
+	if nil != err || frame.Type != CMDCONNHEART {
+		t.Fatal("read cmd after reset error: ", frame, err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 控制连接心跳: 双方定时发送带序号的 CMDPING, 对端回复相同序号的 CMDPONG, 用于测量往返时间
+// 收到对端的任何指令都说明连接可用, 超过 HEARTTIMEOUT 什么都没有收到时认为是半开连接, 断开后由客户端重新连接
+
+package tcptunnelmanager
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// heartbeat 一条控制连接上本端发起的心跳状态
+type heartbeat struct {
+	seq      uint64        // 最近一次发送的序号
+	sentAt   time.Time     // 最近一次发送的时间
+	lastSeen time.Time     // 最近一次收到对端指令的时间, 开始时为创建时间
+	rtt      time.Duration // 最近一次的往返时间
+	lock     sync.Mutex
+}
+
+// newHeartbeat 创建心跳状态
+func newHeartbeat() *heartbeat {
+	return &heartbeat{lastSeen: time.Now()}
+}
+
+// next 生成下一次心跳的负载: 序号(8字节, 大端)
+func (hb *heartbeat) next() []byte {
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	hb.seq++
+	hb.sentAt = time.Now()
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, hb.seq)
+	return payload
+}
+
+// seen 收到对端的指令, 连接仍然可用
+func (hb *heartbeat) seen() {
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	hb.lastSeen = time.Now()
+}
+
+// pong 处理对端的回复, 只接受最近一次发送的序号, 返回本次的往返时间
+// 过期的回复(对端回复慢于心跳间隔)返回错误, 不更新状态
+func (hb *heartbeat) pong(payload []byte) (time.Duration, error) {
+	if len(payload) != 8 {
+		return 0, errors.New("pong payload length error")
+	}
+	seq := binary.BigEndian.Uint64(payload)
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	if seq != hb.seq {
+		return 0, errors.New("pong seq mismatch")
+	}
+	hb.rtt = time.Since(hb.sentAt)
+	return hb.rtt, nil
+}
+
+// expired 超过timeout没有收到对端的指令, 对端可能已经断开而本端没有收到通知
+func (hb *heartbeat) expired(timeout time.Duration) bool {
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	return time.Since(hb.lastSeen) > timeout
+}
+
+// getRTT 最近一次的往返时间, 还没有收到回复时为0
+func (hb *heartbeat) getRTT() time.Duration {
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	return hb.rtt
+}
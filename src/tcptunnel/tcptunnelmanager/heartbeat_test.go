@@ -0,0 +1,107 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试心跳序号: 只接受最近一次发送的序号, 收到任何指令都刷新连接状态
+func TestHeartbeat(t *testing.T) {
+	hb := newHeartbeat()
+	first := hb.next()
+	second := hb.next()
+	if _, err := hb.pong(first); nil == err {
+		t.Fatal("stale pong should be ignored")
+	}
+	if _, err := hb.pong([]byte{1}); nil == err {
+		t.Fatal("short pong should be ignored")
+	}
+	if _, err := hb.pong(second); nil != err {
+		t.Fatal(err)
+	}
+	if hb.expired(time.Second) {
+		t.Fatal("heartbeat should not expire")
+	}
+	hb.lastSeen = time.Now().Add(-2 * time.Second)
+	if !hb.expired(time.Second) {
+		t.Fatal("heartbeat should expire")
+	}
+	hb.seen()
+	if hb.expired(time.Second) {
+		t.Fatal("seen should refresh the heartbeat")
+	}
+}
+
+// 测试空闲连接心跳期间不会被取出, 结束后交给等待的请求
+func TestPoolCheckout(t *testing.T) {
+	pool := newTunnelPool("web", nil)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	key := conn.RemoteAddr().String()
+	pool.put(conn, 0)
+	if !pool.checkout(key, conn) || pool.checkout(key, conn) {
+		t.Fatal("conn should be checked out once")
+	}
+	if nil != pool.take() || pool.count() != 1 {
+		t.Fatal("checked out conn should be counted but not taken")
+	}
+	waiter := pool.wait(1)
+	if !pool.checkin(key, conn, true, 1) {
+		t.Fatal("checkin failed")
+	}
+	if got := <-waiter; got != conn {
+		t.Fatal("checked in conn should be handed to the waiter")
+	}
+	pool.put(conn, 0)
+	pool.checkout(key, conn)
+	if pool.checkin(key, conn, false, 0) || pool.count() != 0 {
+		t.Fatal("failed heartbeat should remove the conn")
+	}
+}
+
+// 测试控制连接心跳: 客户端回复服务端的 CMDPING, 服务端记录往返时间; 长时间没有收到指令时断开客户端
+func TestControlHeartbeat(t *testing.T) {
+	service, connector, errs := startTunnel(t)
+	defer service.Stop(context.Background())
+	defer connector.Stop(context.Background())
+	service.lock.RLock()
+	var client *tunnelClient
+	for _, val := range service.clients {
+		client = val
+	}
+	service.lock.RUnlock()
+	service.pingClient(client)
+	for i := 0; i < 50 && client.hb.getRTT() == 0; i++ {
+		time.Sleep(DRAININTERVAL / 10)
+	}
+	if client.hb.getRTT() == 0 || len(service.Clients()) != 1 || service.Clients()[0].RTT <= 0 {
+		t.Fatal("control rtt not measured")
+	}
+	// 模拟半开连接: 超过 HEARTTIMEOUT 没有收到客户端的指令
+	client.hb.lock.Lock()
+	client.hb.lastSeen = time.Now().Add(-HEARTTIMEOUT - time.Second)
+	client.hb.lock.Unlock()
+	service.pingClient(client)
+	select {
+	case err := <-errs:
+		if nil == err {
+			t.Fatal("connect should return an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client not disconnected")
+	}
+	if val := service.metrics.timeouts.With("", PHASEHEARTBEAT).Get(); val != 1 {
+		t.Fatal("heartbeat timeout metric: ", val)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 隧道的监控指标, 以Prometheus文本格式输出
+
+package tcptunnelmanager
+
+import (
+	"gutils/metrictool"
+)
+
+var (
+	// 传输时长的桶(秒)
+	exchangeBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800}
+	// 心跳往返时间的桶(秒)
+	heartbeatBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	// 等待空闲连接的桶(秒)
+	waitBuckets = []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// tunnelMetrics 隧道的监控指标, 服务端和客户端各自统计
+type tunnelMetrics struct {
+	registry          *metrictool.Registry
+	bytes             *metrictool.Counter   // 隧道连接上传输的字节数, 标签: tunnel, direction
+	sessions          *metrictool.Counter   // 会话总数, 标签: tunnel
+	activeSessions    *metrictool.Gauge     // 正在传输的会话数, 标签: tunnel
+	misses            *metrictool.Counter   // 没有可用连接的次数, 标签: tunnel
+	demands           *metrictool.Counter   // 服务端通知客户端补充的连接数, 标签: tunnel
+	waiting           *metrictool.Gauge     // 正在等待空闲连接的请求数, 标签: tunnel
+	timeouts          *metrictool.Counter   // 各阶段超时的次数, 标签: tunnel, phase
+	waitDuration      *metrictool.Histogram // 等待空闲连接的时长, 标签: tunnel
+	heartbeatFailures *metrictool.Counter   // 心跳失败次数, 标签: tunnel
+	heartbeatRTT      *metrictool.Histogram // 心跳往返时间, 标签: tunnel
+	controlRTT        *metrictool.Histogram // 控制连接心跳往返时间
+	reconnects        *metrictool.Counter   // 重连次数
+	exchangeDuration  *metrictool.Histogram // 传输时长, 标签: tunnel, mode
+}
+
+// newTunnelMetrics 创建并注册监控指标
+func newTunnelMetrics() *tunnelMetrics {
+	registry := metrictool.NewRegistry()
+	return &tunnelMetrics{
+		registry:          registry,
+		bytes:             registry.NewCounter("tcptunnel_bytes_total", "Bytes sent to and received from tunnel connections.", "tunnel", "direction"),
+		sessions:          registry.NewCounter("tcptunnel_sessions_total", "Transport sessions started.", "tunnel"),
+		activeSessions:    registry.NewGauge("tcptunnel_sessions_active", "Transport sessions in progress.", "tunnel"),
+		misses:            registry.NewCounter("tcptunnel_getconn_misses_total", "Requests dropped because no tunnel connection was available.", "tunnel"),
+		demands:           registry.NewCounter("tcptunnel_pool_demand_total", "Idle connections requested from the tunnel client.", "tunnel"),
+		waiting:           registry.NewGauge("tcptunnel_getconn_waiting", "Requests waiting for an idle tunnel connection.", "tunnel"),
+		waitDuration:      registry.NewHistogram("tcptunnel_getconn_wait_seconds", "Time spent waiting for an idle tunnel connection.", waitBuckets, "tunnel"),
+		timeouts:          registry.NewCounter("tcptunnel_timeouts_total", "Deadlines fired, by phase (handshake, reply, first_byte, idle, session, heartbeat).", "tunnel", "phase"),
+		heartbeatFailures: registry.NewCounter("tcptunnel_heartbeat_failures_total", "Heartbeats without a valid reply.", "tunnel"),
+		heartbeatRTT:      registry.NewHistogram("tcptunnel_heartbeat_rtt_seconds", "Heartbeat round-trip time.", heartbeatBuckets, "tunnel"),
+		controlRTT:        registry.NewHistogram("tcptunnel_control_rtt_seconds", "Control connection ping round-trip time.", heartbeatBuckets),
+		reconnects:        registry.NewCounter("tcptunnel_reconnects_total", "Control connections re-established by a known client."),
+		exchangeDuration:  registry.NewHistogram("tcptunnel_exchange_duration_seconds", "Duration of transport sessions.", exchangeBuckets, "tunnel", "mode"),
+	}
+}
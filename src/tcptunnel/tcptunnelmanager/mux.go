@@ -0,0 +1,521 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 多路复用: 多个逻辑流共享一个物理连接
+// 每个逻辑流有独立的打开/关闭/窗口帧, 发送方不会超出接收方的窗口发送数据
+
+package tcptunnelmanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMuxClosed 多路复用连接已关闭
+var ErrMuxClosed = errors.New("mux session is closed")
+
+// timeoutError 读写超时, 实现 net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// MuxSession 多路复用连接, 独占物理连接的读取
+type MuxSession struct {
+	conn       net.Conn
+	nextID     uint32                // 下一个流ID, 客户端使用奇数, 服务端使用偶数
+	streams    map[uint32]*MuxStream // 活动的逻辑流
+	accepts    chan *MuxStream       // 对端打开的逻辑流
+	lastActive int64                 // 最后一次收到帧的时间(UnixNano)
+	lock       sync.Mutex
+	wlock      sync.Mutex
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewMuxSession 在物理连接上创建多路复用会话, isClient 用于区分流ID避免冲突
+func NewMuxSession(conn net.Conn, isClient bool) *MuxSession {
+	session := &MuxSession{
+		conn:       conn,
+		streams:    make(map[uint32]*MuxStream),
+		accepts:    make(chan *MuxStream, MUXACCEPTBACKLOG),
+		lastActive: time.Now().UnixNano(),
+		closed:     make(chan struct{}),
+	}
+	if isClient {
+		session.nextID = 1
+	} else {
+		session.nextID = 2
+	}
+	go session.recvLoop()
+	go session.keepAlive()
+	return session
+}
+
+// OpenStream 打开一个逻辑流, info 会随打开帧发送给对端
+func (session *MuxSession) OpenStream(info []byte) (*MuxStream, error) {
+	session.lock.Lock()
+	if session.IsClosed() {
+		session.lock.Unlock()
+		return nil, ErrMuxClosed
+	}
+	id := session.nextID
+	session.nextID += 2
+	stream := newMuxStream(session, id, info)
+	session.streams[id] = stream
+	session.lock.Unlock()
+	if err := session.writeFrame(CMDSTREAMOPEN, id, info); nil != err {
+		session.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream 等待对端打开的逻辑流
+func (session *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case stream := <-session.accepts:
+		return stream, nil
+	case <-session.closed:
+		return nil, ErrMuxClosed
+	}
+}
+
+// NumStreams 活动的逻辑流个数
+func (session *MuxSession) NumStreams() int {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return len(session.streams)
+}
+
+// CloseChan 连接关闭时该通道会被关闭
+func (session *MuxSession) CloseChan() <-chan struct{} {
+	return session.closed
+}
+
+// IsClosed 是否已关闭
+func (session *MuxSession) IsClosed() bool {
+	select {
+	case <-session.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 关闭物理连接和所有逻辑流
+func (session *MuxSession) Close() error {
+	var err error
+	session.closeOnce.Do(func() {
+		close(session.closed)
+		err = session.conn.Close()
+		session.lock.Lock()
+		streams := session.streams
+		session.streams = make(map[uint32]*MuxStream)
+		session.lock.Unlock()
+		for _, stream := range streams {
+			stream.notify()
+		}
+	})
+	return err
+}
+
+// RemoteAddr 物理连接的对端地址
+func (session *MuxSession) RemoteAddr() net.Addr {
+	return session.conn.RemoteAddr()
+}
+
+// writeFrame 发送逻辑流帧, 负载: 流ID + 数据
+func (session *MuxSession) writeFrame(t byte, id uint32, data []byte) error {
+	payload := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(payload, id)
+	copy(payload[4:], data)
+	session.wlock.Lock()
+	defer session.wlock.Unlock()
+	if session.IsClosed() {
+		return ErrMuxClosed
+	}
+	return WriteFrame(session.conn, t, payload)
+}
+
+// writeWindow 通知对端逻辑流可以继续发送的字节数
+func (session *MuxSession) writeWindow(id uint32, increment uint32) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, increment)
+	return session.writeFrame(CMDSTREAMWINDOW, id, b)
+}
+
+// writeCMD 发送会话级别的指令
+func (session *MuxSession) writeCMD(t byte) error {
+	session.wlock.Lock()
+	defer session.wlock.Unlock()
+	return WriteFrame(session.conn, t, nil)
+}
+
+// getStream 查找逻辑流
+func (session *MuxSession) getStream(id uint32) *MuxStream {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.streams[id]
+}
+
+// removeStream 移除逻辑流
+func (session *MuxSession) removeStream(id uint32) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	delete(session.streams, id)
+}
+
+// recvLoop 读取物理连接上的帧并分发到逻辑流
+func (session *MuxSession) recvLoop() {
+	defer session.Close()
+	for {
+		frame, err := ReadFrame(session.conn)
+		if nil != err {
+			return
+		}
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+		switch frame.Type {
+		case CMDCONNHEART:
+			if err := session.writeCMD(CMDOK); nil != err {
+				return
+			}
+			continue
+		case CMDOK:
+			continue
+		}
+		if len(frame.Payload) < 4 {
+			return
+		}
+		id := binary.BigEndian.Uint32(frame.Payload)
+		data := frame.Payload[4:]
+		switch frame.Type {
+		case CMDSTREAMOPEN:
+			stream := newMuxStream(session, id, data)
+			session.lock.Lock()
+			_, exist := session.streams[id]
+			if !exist {
+				session.streams[id] = stream
+			}
+			session.lock.Unlock()
+			if exist {
+				return
+			}
+			// 等待处理的逻辑流已满时拒绝打开, 不能阻塞其他逻辑流的数据和窗口帧
+			select {
+			case session.accepts <- stream:
+			default:
+				session.removeStream(id)
+				if err := session.writeFrame(CMDSTREAMCLOSE, id, nil); nil != err {
+					return
+				}
+			}
+		case CMDSTREAMDATA:
+			if stream := session.getStream(id); nil != stream {
+				stream.receive(data)
+			} else if err := session.writeWindow(id, uint32(len(data))); nil != err {
+				// 已关闭或被拒绝的流, 丢弃数据并归还窗口避免对端阻塞
+				return
+			}
+		case CMDSTREAMCLOSE:
+			if stream := session.getStream(id); nil != stream {
+				stream.receiveClose()
+			}
+		case CMDSTREAMWINDOW:
+			if len(data) < 4 {
+				return
+			}
+			if stream := session.getStream(id); nil != stream {
+				stream.receiveWindow(binary.BigEndian.Uint32(data))
+			}
+		default:
+			// 不识别的帧, 断开链接
+			return
+		}
+	}
+}
+
+// keepAlive 定时发送心跳, 长时间没有收到任何帧时断开连接
+func (session *MuxSession) keepAlive() {
+	ticker := time.NewTicker(MUXHEARTINTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.closed:
+			return
+		case <-ticker.C:
+			lastActive := time.Unix(0, atomic.LoadInt64(&session.lastActive))
+			if time.Since(lastActive) > MUXHEARTINTERVAL*3 {
+				session.Close()
+				return
+			}
+			if err := session.writeCMD(CMDCONNHEART); nil != err {
+				session.Close()
+				return
+			}
+		}
+	}
+}
+
+// MuxStream 逻辑流, 实现 net.Conn
+type MuxStream struct {
+	id            uint32
+	session       *MuxSession
+	info          []byte       // 打开时附带的信息
+	readBuf       bytes.Buffer // 已接收未读取的数据
+	readEOF       bool         // 对端已关闭写入
+	writeClosed   bool         // 本端已关闭写入
+	closed        bool         // 本端已关闭
+	sendWindow    uint32       // 对端剩余的接收窗口
+	recvConsumed  uint32       // 已读取但未通知对端的字节数
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lock          sync.Mutex
+	cond          *sync.Cond
+}
+
+// newMuxStream 创建逻辑流
+func newMuxStream(session *MuxSession, id uint32, info []byte) *MuxStream {
+	stream := &MuxStream{
+		id:         id,
+		session:    session,
+		info:       info,
+		sendWindow: MUXWINDOWSIZE,
+	}
+	stream.cond = sync.NewCond(&stream.lock)
+	return stream
+}
+
+// ID 流ID
+func (stream *MuxStream) ID() uint32 {
+	return stream.id
+}
+
+// Info 打开时附带的信息
+func (stream *MuxStream) Info() []byte {
+	return stream.info
+}
+
+// Read 读取数据, 对端关闭写入后返回 io.EOF
+func (stream *MuxStream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	stream.lock.Lock()
+	for stream.readBuf.Len() == 0 {
+		if stream.closed {
+			stream.lock.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if stream.readEOF {
+			stream.lock.Unlock()
+			return 0, io.EOF
+		}
+		if stream.session.IsClosed() {
+			stream.lock.Unlock()
+			return 0, ErrMuxClosed
+		}
+		if !stream.readDeadline.IsZero() && !time.Now().Before(stream.readDeadline) {
+			stream.lock.Unlock()
+			return 0, timeoutError{}
+		}
+		stream.cond.Wait()
+	}
+	n, _ := stream.readBuf.Read(b)
+	stream.recvConsumed += uint32(n)
+	var increment uint32
+	if stream.recvConsumed >= MUXWINDOWSIZE/2 {
+		increment = stream.recvConsumed
+		stream.recvConsumed = 0
+	}
+	stream.lock.Unlock()
+	if increment > 0 {
+		stream.sendWindowUpdate(increment)
+	}
+	return n, nil
+}
+
+// Write 写入数据, 对端窗口用完时阻塞等待
+func (stream *MuxStream) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		stream.lock.Lock()
+		for stream.sendWindow == 0 {
+			if err = stream.writeErr(); nil != err {
+				stream.lock.Unlock()
+				return n, err
+			}
+			stream.cond.Wait()
+		}
+		if err = stream.writeErr(); nil != err {
+			stream.lock.Unlock()
+			return n, err
+		}
+		size := uint32(len(b) - n)
+		if size > stream.sendWindow {
+			size = stream.sendWindow
+		}
+		if size > CMDMAXLEN-4 {
+			size = CMDMAXLEN - 4
+		}
+		stream.sendWindow -= size
+		stream.lock.Unlock()
+		if err = stream.session.writeFrame(CMDSTREAMDATA, stream.id, b[n:n+int(size)]); nil != err {
+			return n, err
+		}
+		n += int(size)
+	}
+	return n, nil
+}
+
+// writeErr 检查是否还能写入, 需持有锁
+func (stream *MuxStream) writeErr() error {
+	if stream.closed || stream.writeClosed {
+		return io.ErrClosedPipe
+	}
+	if stream.session.IsClosed() {
+		return ErrMuxClosed
+	}
+	if !stream.writeDeadline.IsZero() && !time.Now().Before(stream.writeDeadline) {
+		return timeoutError{}
+	}
+	return nil
+}
+
+// CloseWrite 关闭写入, 对端读取完剩余数据后收到 io.EOF
+func (stream *MuxStream) CloseWrite() error {
+	stream.lock.Lock()
+	if stream.writeClosed {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.writeClosed = true
+	finished := stream.readEOF
+	stream.lock.Unlock()
+	stream.cond.Broadcast()
+	if finished {
+		stream.session.removeStream(stream.id)
+	}
+	return stream.session.writeFrame(CMDSTREAMCLOSE, stream.id, nil)
+}
+
+// Close 关闭逻辑流并立即从会话中移除, 不等待对端关闭, 之后收到的数据会被丢弃
+func (stream *MuxStream) Close() error {
+	stream.lock.Lock()
+	if stream.closed {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.closed = true
+	stream.readBuf.Reset()
+	stream.lock.Unlock()
+	stream.session.removeStream(stream.id)
+	return stream.CloseWrite()
+}
+
+// LocalAddr 物理连接的本地地址
+func (stream *MuxStream) LocalAddr() net.Addr {
+	return stream.session.conn.LocalAddr()
+}
+
+// RemoteAddr 物理连接的对端地址
+func (stream *MuxStream) RemoteAddr() net.Addr {
+	return stream.session.conn.RemoteAddr()
+}
+
+// SetDeadline 设置读写超时
+func (stream *MuxStream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 设置读超时
+func (stream *MuxStream) SetReadDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.readDeadline = t
+	stream.lock.Unlock()
+	stream.wakeAt(t)
+	return nil
+}
+
+// SetWriteDeadline 设置写超时
+func (stream *MuxStream) SetWriteDeadline(t time.Time) error {
+	stream.lock.Lock()
+	stream.writeDeadline = t
+	stream.lock.Unlock()
+	stream.wakeAt(t)
+	return nil
+}
+
+// String 用于调试输出
+func (stream *MuxStream) String() string {
+	return stream.RemoteAddr().String() + "#" + strconv.FormatUint(uint64(stream.id), 10)
+}
+
+// wakeAt 到达超时时间时唤醒等待中的读写
+func (stream *MuxStream) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), stream.notify)
+}
+
+// notify 唤醒等待中的读写
+func (stream *MuxStream) notify() {
+	stream.lock.Lock()
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+}
+
+// sendWindowUpdate 通知对端可以继续发送
+func (stream *MuxStream) sendWindowUpdate(increment uint32) {
+	stream.session.writeWindow(stream.id, increment)
+}
+
+// receive 收到数据
+func (stream *MuxStream) receive(data []byte) {
+	stream.lock.Lock()
+	discard := stream.closed
+	if !discard {
+		stream.readBuf.Write(data)
+	}
+	stream.lock.Unlock()
+	stream.cond.Broadcast()
+	// 已关闭的流不再读取, 直接归还窗口避免对端阻塞
+	if discard {
+		stream.sendWindowUpdate(uint32(len(data)))
+	}
+}
+
+// receiveClose 对端关闭写入
+func (stream *MuxStream) receiveClose() {
+	stream.lock.Lock()
+	stream.readEOF = true
+	finished := stream.writeClosed
+	stream.lock.Unlock()
+	stream.cond.Broadcast()
+	if finished {
+		stream.session.removeStream(stream.id)
+	}
+}
+
+// receiveWindow 对端窗口增加
+func (stream *MuxStream) receiveWindow(increment uint32) {
+	stream.lock.Lock()
+	stream.sendWindow += increment
+	stream.lock.Unlock()
+	stream.cond.Broadcast()
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试多个逻辑流共享一个连接, 数据量超过窗口时也能完整传输
+func TestMuxSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, true)
+	server := NewMuxSession(c2, false)
+	defer client.Close()
+	defer server.Close()
+
+	// 客户端回显所有逻辑流的数据
+	go func() {
+		for {
+			stream, err := client.AcceptStream()
+			if nil != err {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.CloseWrite()
+			}()
+		}
+	}()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := server.OpenStream([]byte("web"))
+			if nil != err {
+				t.Error(err)
+				return
+			}
+			data := bytes.Repeat([]byte{byte(i)}, MUXWINDOWSIZE*3+i)
+			go func() {
+				stream.Write(data)
+				stream.CloseWrite()
+			}()
+			received, err := io.ReadAll(stream)
+			if nil != err || !bytes.Equal(received, data) {
+				t.Error("stream data error: ", i, len(received), err)
+			}
+			stream.Close()
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 100 && server.NumStreams() > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := server.NumStreams(); n != 0 {
+		t.Fatal("streams not removed: ", n)
+	}
+	// 物理连接断开后读写都应该返回错误
+	stream, _ := server.OpenStream(nil)
+	client.Close()
+	if _, err := stream.Read(make([]byte, 1)); nil == err {
+		t.Fatal("read from closed session")
+	}
+}
+
+// 测试等待处理的逻辑流已满: 新打开的逻辑流被拒绝, 已有逻辑流的数据不受影响; 本端关闭的逻辑流立即移除
+func TestMuxAcceptBacklog(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxSession(c1, true)
+	server := NewMuxSession(c2, false)
+	defer client.Close()
+	defer server.Close()
+	opened, err := server.OpenStream(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	accepted, err := client.AcceptStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	// 填满客户端等待处理的逻辑流
+	for i := 0; i < MUXACCEPTBACKLOG; i++ {
+		if _, err := server.OpenStream(nil); nil != err {
+			t.Fatal(err)
+		}
+	}
+	rejected, err := server.OpenStream(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("stream should be rejected: ", err)
+	}
+	// 拒绝后的数据被丢弃, 窗口归还给发送方
+	rejected.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Write(make([]byte, MUXWINDOWSIZE*2)); nil != err {
+		t.Fatal("write to rejected stream: ", err)
+	}
+	rejected.Close()
+	go func() {
+		opened.Write([]byte("ping"))
+	}()
+	buf := make([]byte, 4)
+	accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(accepted, buf); nil != err || string(buf) != "ping" {
+		t.Fatal("accepted stream is blocked: ", string(buf), err)
+	}
+	// 本端关闭后立即移除, 不等待对端关闭
+	streams := client.NumStreams()
+	accepted.Close()
+	if n := client.NumStreams(); n != streams-1 {
+		t.Fatal("closed stream is not removed: ", streams, n)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 隧道客户端和命名隧道的连接池
+
+package tcptunnelmanager
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tunnelClient 已连接的隧道客户端, 一个客户端可以注册多个命名隧道
+type tunnelClient struct {
+	id      string                 // 客户端ID
+	name    string                 // 认证名称
+	ctlConn net.Conn               // 控制连接
+	tunnels []string               // 注册的隧道名称
+	muxes   map[string]*MuxSession // 多路复用连接, 该客户端的所有隧道共用
+	started time.Time              // 连接时间
+	minIdle int                    // 空闲连接低水位, 低于该数量时通知客户端补充, 由lock保护
+	maxIdle int                    // 每个隧道保持的空闲连接数, 为0时客户端自行补充, 由lock保护
+	ready   bool                   // 已回复注册结果, 之后才能推送补充通知, 由ctlLock保护
+	hb      *heartbeat             // 控制连接心跳
+	lock    sync.Mutex
+	ctlLock sync.Mutex // 控制连接写锁, 指令回复和补充通知可能同时写入
+}
+
+// newTunnelClient 创建客户端记录
+func newTunnelClient(id string, name string, ctlConn net.Conn, tunnels []string) *tunnelClient {
+	return &tunnelClient{
+		id:      id,
+		name:    name,
+		ctlConn: ctlConn,
+		tunnels: tunnels,
+		muxes:   make(map[string]*MuxSession),
+		started: time.Now(),
+		hb:      newHeartbeat(),
+	}
+}
+
+// setPoolSize 设置空闲连接的低水位和保持的数量, maxIdle为0时不通知补充
+// 低水位至少为1, 不超过保持的数量
+func (client *tunnelClient) setPoolSize(minIdle int, maxIdle int) {
+	if maxIdle < 0 {
+		maxIdle = 0
+	}
+	if minIdle > maxIdle {
+		minIdle = maxIdle
+	}
+	if minIdle <= 0 && maxIdle > 0 {
+		minIdle = 1
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.minIdle = minIdle
+	client.maxIdle = maxIdle
+}
+
+// poolSize 空闲连接的低水位和保持的数量
+func (client *tunnelClient) poolSize() (int, int) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.minIdle, client.maxIdle
+}
+
+// send 在控制连接上发送指令, 超过 CMDWTIMEOUT 没有写入时返回错误
+func (client *tunnelClient) send(cmd byte, payload []byte) error {
+	client.ctlLock.Lock()
+	defer client.ctlLock.Unlock()
+	client.ctlConn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+	defer client.ctlConn.SetWriteDeadline(time.Time{})
+	return WriteFrame(client.ctlConn, cmd, payload)
+}
+
+// sendReady 回复注册成功, 之后可以推送补充通知
+func (client *tunnelClient) sendReady() error {
+	client.ctlLock.Lock()
+	defer client.ctlLock.Unlock()
+	client.ctlConn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+	defer client.ctlConn.SetWriteDeadline(time.Time{})
+	err := WriteFrame(client.ctlConn, CMDOK, []byte(client.id))
+	client.ready = nil == err
+	return err
+}
+
+// isReady 是否已回复注册成功
+func (client *tunnelClient) isReady() bool {
+	client.ctlLock.Lock()
+	defer client.ctlLock.Unlock()
+	return client.ready
+}
+
+// addMux 记录多路复用连接
+func (client *tunnelClient) addMux(key string, session *MuxSession) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.muxes[key] = session
+}
+
+// removeMux 移除多路复用连接
+func (client *tunnelClient) removeMux(key string, session *MuxSession) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.muxes[key] == session {
+		delete(client.muxes, key)
+	}
+}
+
+// pickMux 选择负载最少的多路复用连接, 没有时返回nil
+func (client *tunnelClient) pickMux() *MuxSession {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	var session *MuxSession
+	for _, val := range client.muxes {
+		if nil == session || val.NumStreams() < session.NumStreams() {
+			session = val
+		}
+	}
+	return session
+}
+
+// numMux 多路复用连接数
+func (client *tunnelClient) numMux() int {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return len(client.muxes)
+}
+
+// close 断开控制连接和所有多路复用连接
+func (client *tunnelClient) close() {
+	client.ctlConn.Close()
+	client.lock.Lock()
+	muxes := client.muxes
+	client.muxes = make(map[string]*MuxSession)
+	client.lock.Unlock()
+	for _, val := range muxes {
+		val.Close()
+	}
+}
+
+// tunnelPool 命名隧道的空闲连接池
+type tunnelPool struct {
+	name     string              // 隧道名称
+	client   *tunnelClient       // 注册该隧道的客户端
+	conns    map[string]net.Conn // 空闲连接
+	checking map[string]net.Conn // 正在心跳的空闲连接, 心跳期间不会被取出
+	closed   bool                // 客户端断开后连接池关闭, 归还的连接直接关闭
+	pending  int                 // 已通知客户端补充、还未到达的连接数
+	demandAt time.Time           // 最近一次通知补充的时间
+	waiters  []chan net.Conn     // 等待空闲连接的请求, 按先后顺序, 连接池关闭时收到nil
+	lock     sync.Mutex
+}
+
+// newTunnelPool 创建连接池
+func newTunnelPool(name string, client *tunnelClient) *tunnelPool {
+	return &tunnelPool{
+		name:     name,
+		client:   client,
+		conns:    make(map[string]net.Conn),
+		checking: make(map[string]net.Conn),
+	}
+}
+
+// put 放入归还的空闲连接, 有等待的请求时直接交给最早的请求
+// 连接池已关闭或空闲连接达到limit(大于0时)返回false
+func (pool *tunnelPool) put(conn net.Conn, limit int) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.closed {
+		return false
+	}
+	return pool.putLocked(conn, limit)
+}
+
+// putLocked 放入空闲连接或交给最早的等待请求, 调用前需持有锁
+func (pool *tunnelPool) putLocked(conn net.Conn, limit int) bool {
+	if pool.handoff(conn) {
+		return true
+	}
+	if limit > 0 && len(pool.conns)+len(pool.checking) >= limit {
+		return false
+	}
+	pool.conns[conn.RemoteAddr().String()] = conn
+	return true
+}
+
+// checkout 取出空闲连接用于心跳, 连接已被取出时返回false
+// 心跳期间连接仍计入空闲连接数, 但不会交给请求, 只有心跳协程读取该连接
+func (pool *tunnelPool) checkout(key string, conn net.Conn) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.closed || pool.conns[key] != conn {
+		return false
+	}
+	delete(pool.conns, key)
+	pool.checking[key] = conn
+	return true
+}
+
+// checkin 心跳结束, ok 时放回连接池或交给最早的等待请求
+// 心跳失败、连接池已关闭或空闲连接达到limit(大于0时)返回false, 调用方需要关闭连接
+func (pool *tunnelPool) checkin(key string, conn net.Conn, ok bool, limit int) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	delete(pool.checking, key)
+	if !ok || pool.closed {
+		return false
+	}
+	return pool.putLocked(conn, limit)
+}
+
+// handoff 把连接交给最早的等待请求, 没有等待的请求时返回false, 调用前需持有锁
+func (pool *tunnelPool) handoff(conn net.Conn) bool {
+	if len(pool.waiters) == 0 {
+		return false
+	}
+	waiter := pool.waiters[0]
+	pool.waiters = pool.waiters[1:]
+	waiter <- conn
+	return true
+}
+
+// wait 加入等待队列, 有空闲连接时立即交给返回的通道, 连接池已关闭或队列已满(size个)时返回nil
+func (pool *tunnelPool) wait(size int) chan net.Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.closed || len(pool.waiters) >= size {
+		return nil
+	}
+	waiter := make(chan net.Conn, 1)
+	for key, conn := range pool.conns {
+		delete(pool.conns, key)
+		waiter <- conn
+		return waiter
+	}
+	pool.waiters = append(pool.waiters, waiter)
+	return waiter
+}
+
+// cancelWait 离开等待队列, 离开前已经交给该请求的连接会返回, 调用方需要使用或归还
+func (pool *tunnelPool) cancelWait(waiter chan net.Conn) net.Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for i, val := range pool.waiters {
+		if val == waiter {
+			pool.waiters = append(pool.waiters[:i], pool.waiters[i+1:]...)
+			return nil
+		}
+	}
+	select {
+	case conn := <-waiter:
+		return conn
+	default:
+		return nil
+	}
+}
+
+// wakeWaiters 唤醒所有等待的请求, 请求收到nil
+func (pool *tunnelPool) wakeWaiters() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.wakeWaitersLocked()
+}
+
+// wakeWaitersLocked 唤醒所有等待的请求, 调用前需持有锁
+func (pool *tunnelPool) wakeWaitersLocked() {
+	for _, waiter := range pool.waiters {
+		waiter <- nil
+	}
+	pool.waiters = nil
+}
+
+// numWaiting 等待空闲连接的请求数
+func (pool *tunnelPool) numWaiting() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.waiters)
+}
+
+// add 放入客户端新建的空闲连接, 已通知补充的连接数减1, 有等待的请求时直接交给最早的请求
+// 连接池已关闭时返回false
+func (pool *tunnelPool) add(conn net.Conn) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.closed {
+		return false
+	}
+	if pool.pending > 0 {
+		pool.pending--
+	}
+	if !pool.handoff(conn) {
+		pool.conns[conn.RemoteAddr().String()] = conn
+	}
+	return true
+}
+
+// demand 空闲连接加上已通知补充的连接低于低水位时, 返回补充到maxIdle需要新建的连接数, 并记为已通知
+func (pool *tunnelPool) demand(minIdle int, maxIdle int) int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	have := len(pool.conns) + len(pool.checking) + pool.pending
+	if pool.closed || maxIdle <= 0 || have >= minIdle {
+		return 0
+	}
+	pool.pending += maxIdle - have
+	pool.demandAt = time.Now()
+	return maxIdle - have
+}
+
+// expirePending 通知补充超过age后还没有到达的连接不再计算, 客户端可能新建失败, 之后会重新通知
+func (pool *tunnelPool) expirePending(age time.Duration) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.pending > 0 && time.Since(pool.demandAt) > age {
+		pool.pending = 0
+	}
+}
+
+// numPending 已通知补充、还未到达的连接数
+func (pool *tunnelPool) numPending() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.pending
+}
+
+// take 取出一个空闲连接, 没有时返回nil
+func (pool *tunnelPool) take() net.Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for key, conn := range pool.conns {
+		delete(pool.conns, key)
+		return conn
+	}
+	return nil
+}
+
+// count 空闲连接数, 包括正在心跳的连接
+func (pool *tunnelPool) count() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.conns) + len(pool.checking)
+}
+
+// list 空闲连接的快照, 不包括正在心跳的连接
+func (pool *tunnelPool) list() map[string]net.Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	res := make(map[string]net.Conn, len(pool.conns))
+	for key, conn := range pool.conns {
+		res[key] = conn
+	}
+	return res
+}
+
+// close 关闭连接池和所有空闲连接, 等待的请求收到nil, 正在心跳的连接关闭后由心跳协程移除
+func (pool *tunnelPool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.closed = true
+	pool.wakeWaitersLocked()
+	for key, conn := range pool.conns {
+		delete(pool.conns, key)
+		conn.Close()
+	}
+	for _, conn := range pool.checking {
+		conn.Close()
+	}
+}
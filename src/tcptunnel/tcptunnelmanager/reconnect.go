@@ -0,0 +1,173 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 客户端重连: 控制连接断开后按指数退避加随机抖动的间隔重连, 并通知连接状态的变化
+
+package tcptunnelmanager
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectorState 客户端的连接状态
+type ConnectorState string
+
+const (
+	// STATECONNECTING 正在连接隧道服务
+	STATECONNECTING ConnectorState = "connecting"
+	// STATECONNECTED 已注册, 连接池正常补充
+	STATECONNECTED ConnectorState = "connected"
+	// STATEDEGRADED 已注册, 但新建隧道连接失败, 连接池可能无法补充
+	STATEDEGRADED ConnectorState = "degraded"
+	// STATEDISCONNECTED 控制连接已断开或客户端已停止
+	STATEDISCONNECTED ConnectorState = "disconnected"
+)
+
+// onStateChange 连接状态变化的回调, err 为进入该状态的原因, 可能为空
+type onStateChange func(state ConnectorState, err error)
+
+// Backoff 重连的退避间隔: 从 Min 开始每次乘以 Multiplier, 不超过 Max, 再加上 ±Jitter 比例的随机抖动
+// 为0的项使用默认值
+type Backoff struct {
+	Min        time.Duration // 第一次重连的间隔
+	Max        time.Duration // 最大的重连间隔
+	Multiplier float64       // 每次失败后间隔的倍数
+	Jitter     float64       // 随机抖动的比例, 0.2 表示 ±20%
+}
+
+// withDefaults 填充默认值
+func (backoff Backoff) withDefaults() Backoff {
+	if backoff.Min <= 0 {
+		backoff.Min = DEFAULTBACKOFFMIN
+	}
+	if backoff.Max <= 0 {
+		backoff.Max = DEFAULTBACKOFFMAX
+	}
+	if backoff.Max < backoff.Min {
+		backoff.Max = backoff.Min
+	}
+	if backoff.Multiplier < 1 {
+		backoff.Multiplier = 2
+	}
+	if backoff.Jitter <= 0 || backoff.Jitter >= 1 {
+		backoff.Jitter = 0.2
+	}
+	return backoff
+}
+
+// next 第attempt次(从0开始)连续失败后的等待时间
+func (backoff Backoff) next(attempt int) time.Duration {
+	backoff = backoff.withDefaults()
+	wait := float64(backoff.Min)
+	for i := 0; i < attempt && wait < float64(backoff.Max); i++ {
+		wait *= backoff.Multiplier
+	}
+	if wait > float64(backoff.Max) {
+		wait = float64(backoff.Max)
+	}
+	// 多个客户端同时断开时错开重连的时间
+	wait += wait * backoff.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(wait)
+}
+
+// SetBackoff 更新重连的退避间隔, 下一次重连时生效
+func (connector *TCPTunnelConnector) SetBackoff(backoff Backoff) {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	connector.Backoff = backoff
+}
+
+// getBackoff 重连的退避间隔
+func (connector *TCPTunnelConnector) getBackoff() Backoff {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	return connector.Backoff
+}
+
+// SetStateCallback 设置连接状态变化的回调, 回调在状态变化的协程中执行, 不能阻塞
+func (connector *TCPTunnelConnector) SetStateCallback(fuc onStateChange) {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	connector.onState = fuc
+}
+
+// State 当前的连接状态
+func (connector *TCPTunnelConnector) State() ConnectorState {
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	if len(connector.state) == 0 {
+		return STATEDISCONNECTED
+	}
+	return connector.state
+}
+
+// setState 更新连接状态, from 不为空时只在当前状态是其中之一时更新, 状态变化时记录日志并执行回调
+func (connector *TCPTunnelConnector) setState(state ConnectorState, err error, from ...ConnectorState) {
+	connector.lock.Lock()
+	old := connector.state
+	if len(old) == 0 {
+		old = STATEDISCONNECTED
+	}
+	allowed := len(from) == 0
+	for _, val := range from {
+		allowed = allowed || val == old
+	}
+	if !allowed || old == state {
+		connector.lock.Unlock()
+		return
+	}
+	connector.state = state
+	callback := connector.onState
+	connector.lock.Unlock()
+	switch {
+	case state == STATECONNECTING || old == STATECONNECTING && state == STATEDISCONNECTED:
+		// 重连失败由 Run 记录日志
+		connector.log().Debug("tunnel connector state changed", "from", string(old), "to", string(state), "err", err)
+	case nil != err:
+		connector.log().Warn("tunnel connector state changed", "from", string(old), "to", string(state), "err", err)
+	default:
+		connector.log().Info("tunnel connector state changed", "from", string(old), "to", string(state))
+	}
+	if nil != callback {
+		callback(state, err)
+	}
+}
+
+// Run 连接隧道服务并在控制连接断开后重连, 直到客户端停止或 ctx 取消
+// 连续失败时按 Backoff 增加重连间隔, 注册成功后断开时从最小间隔重新开始
+// ctx 取消时返回 ctx.Err(), 调用 Stop 停止后返回nil
+func (connector *TCPTunnelConnector) Run(ctx context.Context) error {
+	connector.init()
+	attempt := 0
+	for {
+		connects := atomic.LoadInt64(&connector.connects)
+		err := connector.Connect(ctx)
+		if connector.isStopping() {
+			<-connector.stopped
+			return ctx.Err()
+		}
+		if atomic.LoadInt64(&connector.connects) > connects {
+			attempt = 0
+		}
+		wait := connector.getBackoff().next(attempt)
+		attempt++
+		connector.log().Warn("tunnel connection lost, reconnecting", "server", connector.ServiceAddr.String(), "attempt", attempt, "wait", wait.String(), "err", err)
+		select {
+		case <-connector.stopped:
+			return ctx.Err()
+		case <-ctx.Done():
+			connector.Stop(ctx)
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"context"
+	"errors"
+	"gutils/logtool"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试退避间隔: 每次失败翻倍, 不超过最大间隔, 抖动在比例范围内
+func TestBackoff(t *testing.T) {
+	backoff := Backoff{Min: 100 * time.Millisecond, Max: time.Second, Jitter: 0.1}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			wait := backoff.next(attempt)
+			if wait < want*9/10 || wait > want*11/10 {
+				t.Fatal("attempt ", attempt, " wait ", wait, " want about ", want)
+			}
+		}
+	}
+	if wait := (Backoff{}).next(100); wait > DEFAULTBACKOFFMAX*6/5 {
+		t.Fatal("default max exceeded: ", wait)
+	}
+}
+
+// 测试重连: 服务不可用时按退避间隔重试, 服务启动后连接成功, 状态依次变化
+func TestConnectorRun(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+	logger := logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT)
+	connector := &TCPTunnelConnector{ServiceAddr: addr, MaxCount: 2}
+	connector.SetLogger(logger)
+	connector.SetBackoff(Backoff{Min: 20 * time.Millisecond, Max: 50 * time.Millisecond})
+	var lock sync.Mutex
+	states := make([]ConnectorState, 0)
+	connected := make(chan struct{}, 1)
+	connector.SetStateCallback(func(state ConnectorState, err error) {
+		lock.Lock()
+		states = append(states, state)
+		lock.Unlock()
+		if state == STATECONNECTED {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- connector.Run(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if connector.State() == STATECONNECTED {
+		t.Fatal("should not be connected")
+	}
+	service := &TCPTunnelService{ServiceAddr: addr}
+	service.SetLogger(logger)
+	if err := service.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	defer service.Stop(context.Background())
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connector not connected")
+	}
+	lock.Lock()
+	if len(states) < 4 || states[0] != STATECONNECTING || states[1] != STATEDISCONNECTED || states[len(states)-1] != STATECONNECTED {
+		t.Fatal("unexpected states: ", states)
+	}
+	lock.Unlock()
+	connector.Stop(context.Background())
+	if err := <-done; nil != err {
+		t.Fatal("run should return nil after stop: ", err)
+	}
+	if connector.State() != STATEDISCONNECTED {
+		t.Fatal("state after stop: ", connector.State())
+	}
+	// 新建连接失败只影响已连接的状态
+	connector.setState(STATEDEGRADED, errors.New("dial failed"), STATECONNECTED)
+	if connector.State() != STATEDISCONNECTED {
+		t.Fatal("degraded should only follow connected: ", connector.State())
+	}
+}
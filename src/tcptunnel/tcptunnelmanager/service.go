@@ -10,31 +10,120 @@
 package tcptunnelmanager
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
+	"gutils/logtool"
+	"gutils/metrictool"
 	"gutils/strtool"
-	"io"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// onForward 客户端请求反向转发时的回调函数, conn: 链接对象(只传输数据帧), info: 传输信息
+// 回调返回后连接会被关闭
+type onForward func(conn net.Conn, info TransportInfo) error
+
 // TCPTunnelService TCP隧道服务端
+// 可同时接入多个客户端, 每个客户端注册一个或多个命名隧道, 每个隧道有独立的连接池
 type TCPTunnelService struct {
-	ServiceAddr *net.TCPAddr            // 管道服务端口
-	conns       map[string]*net.TCPConn // 连上来的线程
-	ctlConn     *net.TCPConn            // 控制线程, 只能连接一次
-	isDebug     bool                    // 是否输出调试信息
-	serviceID   string                  // 实例ID
-	lock        *sync.RWMutex
+	ServiceAddr  *net.TCPAddr             // 管道服务端口
+	AuthKeys     map[string]string        // 客户端认证密钥, key: 认证名称, 为空时不认证
+	TLSConfig    *tls.Config              // 隧道端口的TLS配置, 为空时不加密
+	OnForward    onForward                // 反向转发回调, 为空时不支持反向转发
+	QueueSize    int                      // 每个隧道等待空闲连接的最大请求数, 为0时使用默认值, 小于0时不等待
+	QueueTimeout time.Duration            // 等待空闲连接的最长时间, 为0时使用默认值
+	Timeouts     Timeouts                 // 各阶段的超时时间, 运行时通过 SetTimeouts 更新
+	clients      map[string]*tunnelClient // 已连接的客户端, key: 客户端ID
+	pools        map[string]*tunnelPool   // 隧道连接池, key: 隧道名称
+	sessions     map[string]*sessionConn  // 正在传输的会话, key: 会话ID
+	metrics      *tunnelMetrics           // 监控指标
+	logger       *logtool.Logger          // 日志, 为空时使用默认日志
+	serviceID    string                   // 实例ID
+	listener     net.Listener             // 隧道端口的监听, 启动后有效
+	stopping     bool                     // 正在停止, 不再接受新的客户端和会话, 由lock保护
+	stopped      chan struct{}            // 停止完成后关闭
+	initOnce     sync.Once                // 初始化连接记录
+	stopOnce     sync.Once                // 只停止一次
+	lock         *sync.RWMutex
+	authLock     sync.RWMutex // 认证密钥锁, 运行时可以更新密钥
+	sessionLock  sync.Mutex   // 会话列表锁
+}
+
+// pooledConn 从连接池取出的连接, 归还时需要知道所属的连接池
+type pooledConn struct {
+	*TunnelConn
+	pool *tunnelPool
+}
+
+// SetForwardCallback 设置客户端请求反向转发时的回调函数
+func (service *TCPTunnelService) SetForwardCallback(fuc onForward) {
+	service.OnForward = fuc
+}
+
+// SetAuthKeys 更新客户端认证密钥, 只影响之后建立的连接
+func (service *TCPTunnelService) SetAuthKeys(keys map[string]string) {
+	service.authLock.Lock()
+	defer service.authLock.Unlock()
+	service.AuthKeys = keys
 }
 
-// printInfo 打印信息
-func (service *TCPTunnelService) printInfo(a ...interface{}) {
-	if service.isDebug {
-		fmt.Println("["+service.serviceID+"]", a)
+// getAuthKeys 获取客户端认证密钥
+func (service *TCPTunnelService) getAuthKeys() map[string]string {
+	service.authLock.RLock()
+	defer service.authLock.RUnlock()
+	return service.AuthKeys
+}
+
+// SetQueue 更新等待空闲连接的最大请求数和最长时间, 只影响之后的请求
+func (service *TCPTunnelService) SetQueue(size int, timeout time.Duration) {
+	service.init()
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	service.QueueSize = size
+	service.QueueTimeout = timeout
+}
+
+// getQueue 等待空闲连接的最大请求数和最长时间, 没有设置时使用默认值
+func (service *TCPTunnelService) getQueue() (int, time.Duration) {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	size, timeout := service.QueueSize, service.QueueTimeout
+	if size == 0 {
+		size = DEFAULTQUEUESIZE
+	}
+	if timeout <= 0 {
+		timeout = DEFAULTQUEUETIMEOUT
 	}
+	return size, timeout
+}
+
+// SetTimeouts 更新各阶段的超时时间, 只影响之后的连接和会话
+func (service *TCPTunnelService) SetTimeouts(timeouts Timeouts) {
+	service.init()
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	service.Timeouts = timeouts
+}
+
+// getTimeouts 各阶段的超时时间, 没有设置时使用默认值
+func (service *TCPTunnelService) getTimeouts() Timeouts {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	return service.Timeouts.withDefaults()
+}
+
+// SetLogger 设置日志
+func (service *TCPTunnelService) SetLogger(logger *logtool.Logger) {
+	service.logger = logger
+}
+
+// log 日志, 带有实例ID
+func (service *TCPTunnelService) log() *logtool.Logger {
+	return service.logger.With("serviceID", service.serviceID)
 }
 
 // GetID 获取实例ID
@@ -42,174 +131,768 @@ func (service *TCPTunnelService) GetID() string {
 	return service.serviceID
 }
 
-// DoStart 启动隧道服务
-func (service *TCPTunnelService) DoStart() (err error) {
-	service.lock = new(sync.RWMutex)
-	if len(service.serviceID) == 0 {
-		service.serviceID = strtool.GetUUID()
+// init 初始化连接记录和实例ID, 启动前就可以获取连接和查询状态
+func (service *TCPTunnelService) init() {
+	service.initOnce.Do(func() {
+		service.lock = new(sync.RWMutex)
+		service.clients = make(map[string]*tunnelClient)
+		service.pools = make(map[string]*tunnelPool)
+		service.sessions = make(map[string]*sessionConn)
+		service.stopped = make(chan struct{})
+		service.metrics = newTunnelMetrics()
+		service.metrics.registry.NewGaugeFunc("tcptunnel_pool_idle", "Idle connections in the tunnel pool.", []string{"tunnel"}, func(set func(float64, ...string)) {
+			for _, pool := range service.Pools() {
+				set(float64(pool.Idle), pool.Tunnel)
+			}
+		})
+		if len(service.serviceID) == 0 {
+			service.serviceID = strtool.GetUUID()
+		}
+	})
+}
+
+// Metrics 监控指标, 可以注册为 /metrics 的处理器
+func (service *TCPTunnelService) Metrics() *metrictool.Registry {
+	service.init()
+	return service.metrics.registry
+}
+
+// DoStart 启动隧道服务, 一直运行到服务停止
+func (service *TCPTunnelService) DoStart() error {
+	if err := service.Start(context.Background()); nil != err {
+		return err
+	}
+	<-service.Done()
+	return nil
+}
+
+// Start 启动隧道服务, 监听成功后返回, 在后台接收连接
+// ctx 取消时立即停止服务, 不等待正在传输的会话; 需要等待会话结束时调用 Stop
+func (service *TCPTunnelService) Start(ctx context.Context) error {
+	service.init()
+	if len(service.getAuthKeys()) == 0 {
+		service.log().Warn("no auth keys configured, any client can connect")
+	}
+	tcpListener, err := net.ListenTCP("tcp", service.ServiceAddr)
+	if nil != err {
+		return err
 	}
+	var listener net.Listener = tcpListener
+	if nil != service.TLSConfig {
+		listener = tls.NewListener(tcpListener, service.TLSConfig)
+	}
+	service.lock.Lock()
+	if service.stopping || nil != service.listener {
+		service.lock.Unlock()
+		listener.Close()
+		return errors.New("tunnel service is started or stopped")
+	}
+	service.listener = listener
+	service.lock.Unlock()
 	service.sendConnHeart() // 启动心跳检测
-	listener, err := net.ListenTCP("tcp", service.ServiceAddr)
-	if nil == err {
-		for {
-			conn, err := listener.AcceptTCP()
-			if nil != err {
-				service.printInfo("AcceptTCP error: ", err)
-				continue
+	go service.doServe(listener)
+	go func() {
+		select {
+		case <-ctx.Done():
+			service.Stop(ctx)
+		case <-service.stopped:
+		}
+	}()
+	return nil
+}
+
+// doServe 接收隧道连接, 监听关闭后返回
+func (service *TCPTunnelService) doServe(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if nil != err {
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
-			// 1. 检查是否是控制线程连接
-			cmd := service.getCMD(conn)
-			if nil == service.ctlConn && CMDCONNECTCTRL != cmd {
-				continue
+			service.log().Debug("accept error", "err", err)
+			continue
+		}
+		go service.doAccept(conn)
+	}
+}
+
+// Stop 停止隧道服务: 关闭隧道端口, 不再接受新的客户端和会话, 等待正在传输的会话结束
+// ctx 结束时关闭剩余的会话并返回 ctx.Err(), 最后断开所有客户端并关闭连接池中的连接, 停止后不能再次启动
+func (service *TCPTunnelService) Stop(ctx context.Context) (err error) {
+	service.init()
+	service.stopOnce.Do(func() {
+		service.lock.Lock()
+		service.stopping = true
+		listener := service.listener
+		service.lock.Unlock()
+		if nil != listener {
+			listener.Close()
+		}
+		service.log().Info("tunnel service stopping", "sessions", service.numSessions())
+		// 等待空闲连接的请求不再等待
+		service.lock.RLock()
+		for _, pool := range service.pools {
+			pool.wakeWaiters()
+		}
+		service.lock.RUnlock()
+		err = service.drain(ctx)
+		service.lock.Lock()
+		for _, client := range service.clients {
+			service.removeClientLocked(client)
+		}
+		service.lock.Unlock()
+		close(service.stopped)
+		service.log().Info("tunnel service stopped")
+	})
+	return err
+}
+
+// Done 服务停止后关闭的通道
+func (service *TCPTunnelService) Done() <-chan struct{} {
+	service.init()
+	return service.stopped
+}
+
+// Addr 隧道端口的监听地址, 启动前返回nil
+func (service *TCPTunnelService) Addr() net.Addr {
+	service.init()
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	if nil == service.listener {
+		return nil
+	}
+	return service.listener.Addr()
+}
+
+// isStopping 是否正在停止或已停止
+func (service *TCPTunnelService) isStopping() bool {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	return service.stopping
+}
+
+// numSessions 正在传输的会话数
+func (service *TCPTunnelService) numSessions() int {
+	service.sessionLock.Lock()
+	defer service.sessionLock.Unlock()
+	return len(service.sessions)
+}
+
+// drain 等待正在传输的会话结束, ctx 结束时关闭剩余的会话
+func (service *TCPTunnelService) drain(ctx context.Context) error {
+	ticker := time.NewTicker(DRAININTERVAL)
+	defer ticker.Stop()
+	for service.numSessions() > 0 {
+		select {
+		case <-ctx.Done():
+			service.sessionLock.Lock()
+			for _, session := range service.sessions {
+				session.Close()
 			}
-			switch cmd {
-			case CMDCONNECTCTRL: // 这是管理线程链接, 监听着, 不断开
-				// 记录链接, 并清空之前的连接
-				service.ctlConn = conn
-				service.clearConn()
-				go service.doConnCtrlAdapter()
-				break
-			case CMDCONNECT: // 客户端新建链接请求
-				service.lock.Lock()
-				service.conns[conn.RemoteAddr().String()] = conn
-				service.lock.Unlock()
-				break
-			default:
-				conn.Close()
+			service.sessionLock.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// doAccept 发送认证挑战码, 然后根据连接发送的第一个指令处理连接
+// TLS握手、挑战码和握手指令需要在握手超时时间内完成, 未认证的连接不会一直占用
+func (service *TCPTunnelService) doAccept(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(service.getTimeouts().Handshake))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); nil != err {
+			err = phaseError(service.metrics, "", PHASEHANDSHAKE, err)
+			service.log().Warn("tunnel TLS handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+			conn.Close()
+			return
+		}
+	}
+	nonce, err := newNonce()
+	if nil == err {
+		err = WriteFrame(conn, CMDCHALLENGE, nonce)
+	}
+	var frame *Frame
+	if nil == err {
+		frame, err = ReadFrame(conn)
+	}
+	if nil != err {
+		service.log().Debug("handshake error", "remote", conn.RemoteAddr().String(), "err", phaseError(service.metrics, "", PHASEHANDSHAKE, err))
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	hs, err := decodeHandshake(frame.Payload)
+	if nil != err {
+		service.log().Debug("handshake error", "remote", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	if !verifyHandshake(service.getAuthKeys(), nonce, frame.Type, hs) {
+		service.log().Warn("tunnel authentication failed", "remote", conn.RemoteAddr().String(), "name", hs.Name, "cmd", frame.Type)
+		service.sendCMD(conn, CMDERROR, []byte("403: authentication failed"))
+		conn.Close()
+		return
+	}
+	switch frame.Type {
+	case CMDCONNECTCTRL: // 这是管理线程链接, 监听着, 不断开
+		service.addClient(conn, hs)
+	case CMDCONNECT: // 客户端新建链接请求, 放入所属隧道的连接池
+		pool := service.getPool(hs.Tunnel)
+		if nil == pool || pool.client.id != hs.ClientID || pool.client.name != hs.Name || !pool.add(conn) {
+			conn.Close()
+		}
+	case CMDMUXCONNECT: // 客户端新建多路复用连接
+		service.lock.RLock()
+		client := service.clients[hs.ClientID]
+		service.lock.RUnlock()
+		if nil == client || client.name != hs.Name {
+			conn.Close()
+			return
+		}
+		service.addMux(client, conn)
+	case CMDFORWARD: // 客户端请求反向转发, 连接服务端的目标
+		service.doForward(conn, hs)
+	default:
+		conn.Close()
+	}
+}
+
+// doForward 处理反向转发请求, 只有已注册的客户端才能请求, 并且只能请求它注册的隧道, 传输结束后关闭连接
+func (service *TCPTunnelService) doForward(conn net.Conn, hs handshake) {
+	defer conn.Close()
+	info := TransportInfo{Tunnel: hs.Tunnel}
+	if len(info.Tunnel) == 0 {
+		info.Tunnel = DEFAULTTUNNEL
+	}
+	// 只能连接客户端自己注册的隧道的目标, 其他客户端的隧道不能使用
+	registered := false
+	service.lock.RLock()
+	client := service.clients[hs.ClientID]
+	if nil != client {
+		for _, name := range client.tunnels {
+			if name == info.Tunnel {
+				registered = true
 				break
 			}
 		}
 	}
-	return err
+	service.lock.RUnlock()
+	if nil == client || client.name != hs.Name {
+		service.sendCMD(conn, CMDERROR, []byte("403: client is not registered"))
+		return
+	}
+	if !registered {
+		service.log().Warn("forward to a tunnel of another client", "clientID", client.id, "tunnel", info.Tunnel)
+		service.sendCMD(conn, CMDERROR, []byte("403: tunnel "+info.Tunnel+" is not registered by the client"))
+		return
+	}
+	if nil == service.OnForward {
+		service.sendCMD(conn, CMDERROR, []byte("404: forward is not supported"))
+		return
+	}
+	if service.isStopping() {
+		service.sendCMD(conn, CMDERROR, []byte("503: tunnel service is stopping"))
+		return
+	}
+	if err := service.sendCMD(conn, CMDOK, nil); nil != err {
+		return
+	}
+	service.log().Debug("forward", "clientID", client.id, "tunnel", info.Tunnel)
+	if err := service.OnForward(newTunnelConn(conn), info); nil != err {
+		service.log().Warn("forward failed", "clientID", client.id, "tunnel", info.Tunnel, "err", err)
+	}
+}
+
+// addClient 记录客户端和它注册的隧道, 同一个客户端重连时替换之前的记录
+func (service *TCPTunnelService) addClient(conn net.Conn, hs handshake) {
+	if len(hs.ClientID) == 0 {
+		conn.Close()
+		return
+	}
+	if len(hs.Tunnels) == 0 {
+		hs.Tunnels = []string{DEFAULTTUNNEL}
+	}
+	service.lock.Lock()
+	if service.stopping {
+		service.lock.Unlock()
+		service.sendCMD(conn, CMDERROR, []byte("503: tunnel service is stopping"))
+		conn.Close()
+		return
+	}
+	if old, exist := service.clients[hs.ClientID]; exist {
+		// 只有同一个认证名称的客户端才能替换
+		if old.name != hs.Name {
+			service.lock.Unlock()
+			service.sendCMD(conn, CMDERROR, []byte("409: client id is used by another client"))
+			conn.Close()
+			return
+		}
+		service.removeClientLocked(old)
+		service.metrics.reconnects.Inc()
+	}
+	for _, name := range hs.Tunnels {
+		if _, exist := service.pools[name]; exist {
+			service.lock.Unlock()
+			service.log().Warn("tunnel is registered by another client", "tunnel", name, "clientID", hs.ClientID, "remote", conn.RemoteAddr().String())
+			service.sendCMD(conn, CMDERROR, []byte("409: tunnel "+name+" is registered by another client"))
+			conn.Close()
+			return
+		}
+	}
+	client := newTunnelClient(hs.ClientID, hs.Name, conn, hs.Tunnels)
+	client.setPoolSize(hs.MinIdle, hs.MaxIdle)
+	service.clients[client.id] = client
+	for _, name := range hs.Tunnels {
+		service.pools[name] = newTunnelPool(name, client)
+	}
+	service.lock.Unlock()
+	service.log().Info("client connected", "clientID", client.id, "tunnels", strings.Join(client.tunnels, ","), "remote", conn.RemoteAddr().String())
+	if err := client.sendReady(); nil != err {
+		service.removeClient(client)
+		return
+	}
+	// 预热: 新注册的隧道没有空闲连接, 通知客户端补充
+	service.checkClientDemand(client)
+	go service.doConnCtrlAdapter(client)
+}
+
+// removeClient 移除客户端, 关闭它的连接池和所有连接
+func (service *TCPTunnelService) removeClient(client *tunnelClient) {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	service.removeClientLocked(client)
+}
+
+// removeClientLocked 移除客户端, 调用前需持有锁
+func (service *TCPTunnelService) removeClientLocked(client *tunnelClient) {
+	if service.clients[client.id] == client {
+		delete(service.clients, client.id)
+	}
+	for _, name := range client.tunnels {
+		if pool, exist := service.pools[name]; exist && pool.client == client {
+			delete(service.pools, name)
+			pool.close()
+		}
+	}
+	client.close()
+	service.log().Info("client disconnected", "clientID", client.id)
+}
+
+// updateTunnels 更新客户端注册的隧道, 新增的隧道创建连接池, 删除的隧道关闭连接池
+// 正在传输的连接不受影响, 其他隧道的连接池保持不变
+func (service *TCPTunnelService) updateTunnels(client *tunnelClient, tunnels []string) error {
+	if len(tunnels) == 0 {
+		tunnels = []string{DEFAULTTUNNEL}
+	}
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	if service.clients[client.id] != client {
+		return errors.New("404: client not found")
+	}
+	keep := make(map[string]bool, len(tunnels))
+	for _, name := range tunnels {
+		if pool, exist := service.pools[name]; exist && pool.client != client {
+			return errors.New("409: tunnel " + name + " is registered by another client")
+		}
+		keep[name] = true
+	}
+	for _, name := range client.tunnels {
+		if pool, exist := service.pools[name]; exist && pool.client == client && !keep[name] {
+			delete(service.pools, name)
+			pool.close()
+		}
+	}
+	for _, name := range tunnels {
+		if _, exist := service.pools[name]; !exist {
+			service.pools[name] = newTunnelPool(name, client)
+		}
+	}
+	client.tunnels = tunnels
+	service.log().Info("client tunnels updated", "clientID", client.id, "tunnels", strings.Join(tunnels, ","))
+	return nil
+}
+
+// checkDemand 隧道的空闲连接低于客户端的低水位时, 在控制连接上通知客户端补充
+// 已通知、还未到达的连接也计算在内, 避免每次取出连接都重复通知
+func (service *TCPTunnelService) checkDemand(pool *tunnelPool) {
+	if !pool.client.isReady() {
+		return
+	}
+	count := pool.demand(pool.client.poolSize())
+	if count <= 0 {
+		return
+	}
+	service.metrics.demands.Add(float64(count), pool.name)
+	service.log().Debug("pool demand", "clientID", pool.client.id, "tunnel", pool.name, "count", count)
+	// 不阻塞获取连接的调用方
+	go func() {
+		if err := pool.client.send(CMDPOOLDEMAND, encodePoolDemand(poolDemand{Tunnel: pool.name, Count: count})); nil != err {
+			service.log().Debug("send pool demand error", "clientID", pool.client.id, "tunnel", pool.name, "err", err)
+		}
+	}()
 }
 
-// sendConnHeart 保持心跳
+// checkClientDemand 检查客户端注册的所有隧道是否需要补充连接
+func (service *TCPTunnelService) checkClientDemand(client *tunnelClient) {
+	service.lock.RLock()
+	pools := make([]*tunnelPool, 0, len(client.tunnels))
+	for _, name := range client.tunnels {
+		if pool, exist := service.pools[name]; exist && pool.client == client {
+			pools = append(pools, pool)
+		}
+	}
+	service.lock.RUnlock()
+	for _, pool := range pools {
+		service.checkDemand(pool)
+	}
+}
+
+// getPool 获取隧道的连接池, 隧道名称为空时使用默认隧道
+func (service *TCPTunnelService) getPool(tunnel string) *tunnelPool {
+	if len(tunnel) == 0 {
+		tunnel = DEFAULTTUNNEL
+	}
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	return service.pools[tunnel]
+}
+
+// sendConnHeart 保持心跳: 在控制连接上发送 CMDPING, 对空闲连接发送 CMDCONNHEART
+// 空闲连接先从连接池中取出, 心跳期间只有心跳协程读取该连接, 成功后再放回连接池
 func (service *TCPTunnelService) sendConnHeart() {
 	go (func() {
 		for {
 			service.lock.RLock()
-			if len(service.conns) > 0 {
-				for key, val := range service.conns {
-					go func(key string, val *net.TCPConn) {
-						service.printInfo("sendConnHeart: ", key)
-						_, err := val.Write([]byte(CMDCONNHEART))
-						if nil == err {
-							cmd := service.getCMD(val)
-							if cmd != CMDOK {
-								err = errors.New("Connect heart response is error, responsed: " + cmd)
-							}
-						}
-						if nil != err {
-							val.Close()
-							service.lock.Lock()
-							defer service.lock.Unlock()
-							delete(service.conns, key)
-							service.printInfo("deleteConn: ", key, err)
-						}
-					}(key, val)
-				}
+			pools := make([]*tunnelPool, 0, len(service.pools))
+			for _, pool := range service.pools {
+				pools = append(pools, pool)
+			}
+			clients := make([]*tunnelClient, 0, len(service.clients))
+			for _, client := range service.clients {
+				clients = append(clients, client)
 			}
 			service.lock.RUnlock()
-			time.Sleep(time.Duration(5) * time.Second)
+			for _, client := range clients {
+				service.pingClient(client)
+			}
+			for _, pool := range pools {
+				// 通知补充后长时间没有到达的连接重新通知
+				pool.expirePending(DEMANDTIMEOUT)
+				service.checkDemand(pool)
+				for key, val := range pool.list() {
+					if pool.checkout(key, val) {
+						go service.checkConn(pool, key, val)
+					}
+				}
+			}
+			select {
+			case <-service.stopped:
+				return
+			case <-time.After(HEARTINTERVAL):
+			}
 		}
 	})()
 }
 
-// doConnCtrlAdapter 启动控制侦听
-func (service *TCPTunnelService) doConnCtrlAdapter() {
-	if nil == service.ctlConn {
+// pingClient 在控制连接上发送心跳, 超过 HEARTTIMEOUT 没有收到客户端的指令时断开客户端
+func (service *TCPTunnelService) pingClient(client *tunnelClient) {
+	if !client.isReady() {
 		return
 	}
-	defer (func() {
-		service.clearConn()
-		service.ctlConn.Close()
-		service.ctlConn = nil
-	})()
+	if client.hb.expired(HEARTTIMEOUT) {
+		service.metrics.timeouts.Inc("", PHASEHEARTBEAT)
+		service.log().Warn("control heartbeat timeout, disconnecting", "clientID", client.id)
+		client.close()
+		return
+	}
+	if err := client.send(CMDPING, client.hb.next()); nil != err {
+		service.log().Warn("control heartbeat failed, disconnecting", "clientID", client.id, "err", err)
+		client.close()
+	}
+}
+
+// checkConn 对从连接池取出的空闲连接发送心跳, 成功后放回连接池, 失败时关闭连接并检查是否需要补充
+func (service *TCPTunnelService) checkConn(pool *tunnelPool, key string, conn net.Conn) {
+	service.log().Debug("heartbeat", "tunnel", pool.name, "conn", key)
+	start := time.Now()
+	err := service.sendCMD(conn, CMDCONNHEART, nil)
+	if nil == err {
+		frame, e := service.readReply(conn, pool.name)
+		if nil != e {
+			err = e
+		} else if frame.Type != CMDOK {
+			err = errors.New("Connect heart response is error")
+		}
+	}
+	if nil == err {
+		service.metrics.heartbeatRTT.Observe(time.Since(start).Seconds(), pool.name)
+	} else {
+		service.metrics.heartbeatFailures.Inc(pool.name)
+		service.log().Debug("heartbeat failed, conn removed", "tunnel", pool.name, "conn", key, "err", err)
+	}
+	_, maxIdle := pool.client.poolSize()
+	if !pool.checkin(key, conn, nil == err, maxIdle) {
+		conn.Close()
+		service.checkDemand(pool)
+	}
+}
+
+// doConnCtrlAdapter 启动控制侦听, 控制连接断开后移除客户端
+func (service *TCPTunnelService) doConnCtrlAdapter(client *tunnelClient) {
+	defer service.removeClient(client)
 	for {
-		cmd := service.getCMD(service.ctlConn)
-		service.printInfo("CMD:", cmd)
-		if len(cmd) > 0 {
+		frame := service.getCMD(client.ctlConn)
+		if nil != frame {
+			service.log().Debug("control cmd", "clientID", client.id, "cmd", frame.Type)
+			client.hb.seen()
 			var err error
-			switch cmd {
+			switch frame.Type {
+			case CMDPING:
+				err = client.send(CMDPONG, frame.Payload)
+				break
+			case CMDPONG:
+				if rtt, e := client.hb.pong(frame.Payload); nil == e {
+					service.metrics.controlRTT.Observe(rtt.Seconds())
+				} else {
+					service.log().Debug("control pong ignored", "clientID", client.id, "err", e)
+				}
+				break
 			case CMDCOUNTCONN:
-				_, err = service.ctlConn.Write([]byte(strconv.Itoa(len(service.conns))))
+				pool := service.getPool(string(frame.Payload))
+				if nil == pool || pool.client != client {
+					err = client.send(CMDERROR, []byte("404: tunnel not found!"))
+				} else {
+					err = client.send(CMDOK, []byte(strconv.Itoa(pool.count())))
+				}
+				break
+			case CMDUPDATETUNNELS:
+				hs, e := decodeHandshake(frame.Payload)
+				if nil == e {
+					e = service.updateTunnels(client, hs.Tunnels)
+				}
+				if nil != e {
+					err = client.send(CMDERROR, []byte(e.Error()))
+				} else {
+					client.setPoolSize(hs.MinIdle, hs.MaxIdle)
+					err = client.send(CMDOK, nil)
+					service.checkClientDemand(client)
+				}
 				break
 			default:
-				_, err = service.ctlConn.Write([]byte("401: cmd not support!"))
+				err = client.send(CMDERROR, []byte("401: cmd not support!"))
 				break
 			}
 			if nil != err {
-				fmt.Println("隧道终端-控制器连接异常,正在断开链接", "指令回复异常")
+				service.log().Warn("control connection broken, disconnecting", "clientID", client.id, "err", err)
 				break
 			}
 		} else {
-			fmt.Println("隧道终端-控制器连接异常,正在断开链接", "无法读取到指令")
+			service.log().Warn("control connection broken, disconnecting", "clientID", client.id, "err", "read cmd failed")
 			break
 		}
 	}
 }
 
-// GetConn 获取一个空闲连接, 可用链接-1
-func (service *TCPTunnelService) GetConn() *net.TCPConn {
-	service.lock.Lock()
-	defer service.lock.Unlock()
-	if len(service.conns) > 0 {
-		for key, conn := range service.conns {
-			delete(service.conns, key)
-			_, err := conn.Write([]byte(CMDTRANSPORTSTART))
+// addMux 记录多路复用连接, 连接断开后自动移除
+func (service *TCPTunnelService) addMux(client *tunnelClient, conn net.Conn) {
+	key := conn.RemoteAddr().String()
+	session := NewMuxSession(conn, false)
+	client.addMux(key, session)
+	go func() {
+		// 客户端不会主动打开逻辑流
+		for {
+			stream, err := session.AcceptStream()
 			if nil != err {
-				service.printInfo("send transport start cmd error: ", err)
-				continue
+				break
 			}
-			cmd := service.getCMD(conn)
-			if len(cmd) == 0 {
-				continue
+			stream.Close()
+		}
+		client.removeMux(key, session)
+		service.log().Debug("mux closed", "mux", key)
+	}()
+}
+
+// openStream 在客户端负载最少的多路复用连接上打开逻辑流, 没有可用连接时返回nil
+func (service *TCPTunnelService) openStream(client *tunnelClient, info TransportInfo) net.Conn {
+	session := client.pickMux()
+	if nil == session {
+		return nil
+	}
+	stream, err := session.OpenStream(encodeTransportInfo(info))
+	if nil != err {
+		service.log().Debug("open stream error", "tunnel", info.Tunnel, "err", err)
+		return nil
+	}
+	return stream
+}
+
+// GetConn 获取一个空闲连接, 可用链接-1
+// 根据 info.Tunnel 选择隧道, 客户端使用多路复用模式时返回逻辑流, 否则从隧道的连接池中取出一个连接
+// 连接池为空时排队等待归还或新建的连接, 队列已满、等待超时或服务停止时返回nil
+// 返回的连接只传输数据帧, 使用完后需要调用 RelaseConn 归还
+// info 会发送给隧道客户端, 用于决定本次传输如何处理
+func (service *TCPTunnelService) GetConn(info TransportInfo) net.Conn {
+	service.init()
+	if len(info.Tunnel) == 0 {
+		info.Tunnel = DEFAULTTUNNEL
+	}
+	if service.isStopping() {
+		return nil
+	}
+	pool := service.getPool(info.Tunnel)
+	if nil == pool {
+		service.metrics.misses.Inc(info.Tunnel)
+		return nil
+	}
+	if stream := service.openStream(pool.client, info); nil != stream {
+		return service.addSession(stream, pool.client, info)
+	}
+	var deadline time.Time
+	for {
+		conn := pool.take()
+		service.checkDemand(pool)
+		if nil == conn {
+			// 同一个请求重试时共用等待时间
+			if deadline.IsZero() {
+				_, timeout := service.getQueue()
+				deadline = time.Now().Add(timeout)
 			}
+			conn = service.waitConn(pool, deadline)
+		}
+		if nil == conn {
+			service.metrics.misses.Inc(info.Tunnel)
+			return nil
+		}
+		err := service.sendCMD(conn, CMDTRANSPORTSTART, encodeTransportInfo(info))
+		if nil != err {
+			service.log().Debug("send transport start error", "tunnel", info.Tunnel, "err", err)
+			conn.Close()
+			continue
+		}
+		frame, err := service.readReply(conn, info.Tunnel)
+		if nil != err || frame.Type != CMDOK {
+			service.log().Debug("transport start reply error", "tunnel", info.Tunnel, "err", err)
+			conn.Close()
+			continue
+		}
+		return service.addSession(&pooledConn{TunnelConn: newTunnelConn(conn), pool: pool}, pool.client, info)
+	}
+}
+
+// waitConn 排队等待连接池中的空闲连接, 队列已满、到达deadline或连接池关闭时返回nil
+func (service *TCPTunnelService) waitConn(pool *tunnelPool, deadline time.Time) net.Conn {
+	size, _ := service.getQueue()
+	if size < 0 || service.isStopping() {
+		return nil
+	}
+	waiter := pool.wait(size)
+	if nil == waiter {
+		service.log().Debug("wait queue is full", "tunnel", pool.name, "size", size)
+		return nil
+	}
+	start := time.Now()
+	service.metrics.waiting.Add(1, pool.name)
+	defer func() {
+		service.metrics.waiting.Add(-1, pool.name)
+		service.metrics.waitDuration.Observe(time.Since(start).Seconds(), pool.name)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case conn := <-waiter:
+		return conn
+	case <-timer.C:
+		if conn := pool.cancelWait(waiter); nil != conn {
 			return conn
 		}
+		service.log().Debug("wait for idle conn timeout", "tunnel", pool.name)
+		return nil
 	}
-	return nil
+}
+
+// addSession 记录正在传输的会话
+func (service *TCPTunnelService) addSession(conn net.Conn, client *tunnelClient, info TransportInfo) net.Conn {
+	session := newSessionConn(conn, client.id, info, service.metrics, service.getTimeouts())
+	service.sessionLock.Lock()
+	defer service.sessionLock.Unlock()
+	service.sessions[session.id] = session
+	return session
 }
 
 // RelaseConn 释放连接, 如不释放, 隧道终端可能会一直创建新的链接
-func (service *TCPTunnelService) RelaseConn(conn *net.TCPConn) {
-	cmd := service.getCMD(conn)
-	if cmd == CMDRESET {
-		service.lock.Lock()
-		defer service.lock.Unlock()
-		service.conns[conn.RemoteAddr().String()] = conn
-		service.printInfo("relaseConn", conn.RemoteAddr().String())
+func (service *TCPTunnelService) RelaseConn(conn net.Conn) {
+	if session, ok := conn.(*sessionConn); ok {
+		service.sessionLock.Lock()
+		delete(service.sessions, session.id)
+		service.sessionLock.Unlock()
+		session.finish()
+		conn = session.Conn
 	}
+	if stream, ok := conn.(*MuxStream); ok {
+		stream.Close()
+		return
+	}
+	pconn, ok := conn.(*pooledConn)
+	if !ok {
+		return
+	}
+	// 客户端在传输回调结束后发送重置指令, 超时没有收到时关闭连接
+	pconn.Conn.SetReadDeadline(time.Now().Add(service.getTimeouts().Reply))
+	err := pconn.waitReset()
+	pconn.Conn.SetReadDeadline(time.Time{})
+	if nil != err {
+		service.log().Debug("wait reset error", "tunnel", pconn.pool.name, "err", phaseError(service.metrics, pconn.pool.name, PHASEREPLY, err))
+		pconn.Close()
+		return
+	}
+	// 补充的连接已经到达时, 超过保持数量的连接直接关闭
+	_, maxIdle := pconn.pool.client.poolSize()
+	if !pconn.pool.put(pconn.Conn, maxIdle) {
+		pconn.Conn.Close()
+		return
+	}
+	service.log().Debug("conn released", "tunnel", pconn.pool.name, "remote", pconn.RemoteAddr().String())
 }
 
-// getCMD 读取隧道响应消息
-func (service *TCPTunnelService) getCMD(conn *net.TCPConn) string {
-	b := make([]byte, CMDMAXLEN)
-	n, err := conn.Read(b)
-	if nil == err || err == io.EOF {
-		return string(b[:n])
+// getCMD 读取隧道响应消息, 读取失败返回nil
+func (service *TCPTunnelService) getCMD(conn net.Conn) *Frame {
+	frame, err := ReadFrame(conn)
+	if nil != err {
+		service.log().Debug("read cmd error", "remote", conn.RemoteAddr().String(), "err", err)
+		return nil
 	}
-	return ""
+	return frame
 }
 
-// sendCmd 发送控制指令
-func (service *TCPTunnelService) sendCMD(conn *net.TCPConn, cmd string) error {
+// sendCmd 发送控制指令, 超过 CMDWTIMEOUT 没有写入时返回错误
+func (service *TCPTunnelService) sendCMD(conn net.Conn, cmd byte, payload []byte) error {
 	if nil == conn {
 		return errors.New("conn is nil")
 	}
-	return nil
+	conn.SetWriteDeadline(time.Now().Add(CMDWTIMEOUT))
+	defer conn.SetWriteDeadline(time.Time{})
+	return WriteFrame(conn, cmd, payload)
 }
 
-// clearConn 关闭所有连接
-func (service *TCPTunnelService) clearConn() {
-	service.lock.Lock()
-	if len(service.conns) > 0 {
-		for key, val := range service.conns {
-			delete(service.conns, key)
-			val.Close()
-			service.printInfo("closeConn: ", key)
-		}
+// readReply 读取指令回复, 超过回复超时时间时返回阶段超时的错误
+func (service *TCPTunnelService) readReply(conn net.Conn, tunnel string) (*Frame, error) {
+	conn.SetReadDeadline(time.Now().Add(service.getTimeouts().Reply))
+	defer conn.SetReadDeadline(time.Time{})
+	frame, err := ReadFrame(conn)
+	return frame, phaseError(service.metrics, tunnel, PHASEREPLY, err)
+}
+
+// ReadDialResult 读取客户端回复的目标连接结果, 用于传输信息中要求确认(Confirm)的连接
+// 客户端回复错误时返回 *DialError, 超过回复超时时间时返回阶段超时的错误
+func (service *TCPTunnelService) ReadDialResult(conn net.Conn, tunnel string) error {
+	if len(tunnel) == 0 {
+		tunnel = DEFAULTTUNNEL
 	}
-	service.conns = make(map[string]*net.TCPConn)
-	service.lock.Unlock()
+	frame, err := service.readReply(conn, tunnel)
+	if nil != err {
+		return err
+	}
+	return parseDialResult(frame)
 }
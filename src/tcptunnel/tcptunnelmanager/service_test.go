@@ -0,0 +1,416 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"context"
+	"gutils/logtool"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTunnel 启动服务端和回显数据的客户端, 等待隧道有空闲连接
+func startTunnel(t *testing.T) (*TCPTunnelService, *TCPTunnelConnector, chan error) {
+	logger := logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT)
+	service := &TCPTunnelService{ServiceAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	service.SetLogger(logger)
+	if err := service.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	connector := &TCPTunnelConnector{ServiceAddr: service.Addr().(*net.TCPAddr), MaxCount: 2}
+	connector.SetLogger(logger)
+	connector.SetTransportCallback(func(conn net.Conn, info TransportInfo, release func()) error {
+		io.Copy(conn, conn)
+		conn.(*sessionConn).CloseWrite()
+		return nil
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- connector.Connect(context.Background())
+	}()
+	for i := 0; i < 50; i++ {
+		if pools := service.Pools(); len(pools) > 0 && pools[0].Idle > 0 {
+			return service, connector, errs
+		}
+		time.Sleep(DRAININTERVAL)
+	}
+	t.Fatal("tunnel has no idle conn")
+	return nil, nil, nil
+}
+
+// echo 通过会话发送数据并读取回显
+func echo(t *testing.T, conn net.Conn, data string) {
+	if _, err := conn.Write([]byte(data)); nil != err {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); nil != err || string(buf) != data {
+		t.Fatal("echo error: ", string(buf), err)
+	}
+}
+
+// finish 结束会话: 单向关闭后读完回显, 再归还连接
+func finish(service *TCPTunnelService, conn net.Conn) {
+	conn.(*sessionConn).CloseWrite()
+	io.ReadAll(conn)
+	service.RelaseConn(conn)
+}
+
+// 测试服务端停止: 拒绝新会话, 等待正在传输的会话结束, 然后断开客户端
+func TestServiceStop(t *testing.T) {
+	service, connector, errs := startTunnel(t)
+	defer connector.Stop(context.Background())
+	conn := service.GetConn(TransportInfo{})
+	if nil == conn {
+		t.Fatal("no tunnel conn")
+	}
+	echo(t, conn, "ping")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- service.Stop(ctx)
+	}()
+	for !service.isStopping() {
+		time.Sleep(time.Millisecond)
+	}
+	if nil != service.GetConn(TransportInfo{}) {
+		t.Fatal("new session accepted while stopping")
+	}
+	// 正在传输的会话不受影响
+	echo(t, conn, "pong")
+	select {
+	case err := <-stopped:
+		t.Fatal("stopped before the session ended: ", err)
+	case <-time.After(3 * DRAININTERVAL):
+	}
+	conn.(*sessionConn).CloseWrite()
+	io.ReadAll(conn)
+	service.RelaseConn(conn)
+	if err := <-stopped; nil != err {
+		t.Fatal(err)
+	}
+	<-service.Done()
+	select {
+	case err := <-errs:
+		if nil == err {
+			t.Fatal("connect should fail after the service stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connector is still connected")
+	}
+}
+
+// 测试停止超时: 关闭没有结束的会话并返回超时错误
+func TestServiceStopTimeout(t *testing.T) {
+	service, connector, _ := startTunnel(t)
+	defer connector.Stop(context.Background())
+	conn := service.GetConn(TransportInfo{})
+	if nil == conn {
+		t.Fatal("no tunnel conn")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*DRAININTERVAL)
+	defer cancel()
+	if err := service.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded: ", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); nil == err {
+		t.Fatal("session should be closed")
+	}
+	service.RelaseConn(conn)
+}
+
+// 测试客户端停止: 关闭空闲连接, 等待正在传输的会话结束后断开控制连接
+func TestConnectorStop(t *testing.T) {
+	service, connector, errs := startTunnel(t)
+	defer service.Stop(context.Background())
+	conn := service.GetConn(TransportInfo{})
+	if nil == conn {
+		t.Fatal("no tunnel conn")
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- connector.Stop(context.Background())
+	}()
+	// 服务端在下次心跳时才发现空闲连接已关闭, 这里检查客户端的记录
+	remain := 0
+	for i := 0; i < 50; i++ {
+		connector.connLock.Lock()
+		remain = len(connector.conns)
+		connector.connLock.Unlock()
+		if remain <= 1 {
+			break
+		}
+		time.Sleep(DRAININTERVAL)
+	}
+	if remain != 1 {
+		t.Fatal("idle conns are not closed: ", remain)
+	}
+	echo(t, conn, "ping")
+	select {
+	case err := <-stopped:
+		t.Fatal("stopped before the session ended: ", err)
+	case <-time.After(3 * DRAININTERVAL):
+	}
+	conn.(*sessionConn).CloseWrite()
+	io.ReadAll(conn)
+	service.RelaseConn(conn)
+	if err := <-stopped; nil != err {
+		t.Fatal(err)
+	}
+	if err := <-errs; nil != err {
+		t.Fatal("connect should return nil after stop: ", err)
+	}
+	if err := connector.Connect(context.Background()); nil == err {
+		t.Fatal("connect after stop")
+	}
+}
+
+// 测试补充通知: 注册后预热到保持的数量, 取出连接低于低水位后服务端通知客户端补充
+func TestPoolDemand(t *testing.T) {
+	service, connector, _ := startTunnel(t)
+	defer service.Stop(context.Background())
+	defer connector.Stop(context.Background())
+	waitIdle := func(idle int) {
+		for i := 0; i < 20; i++ {
+			if pools := service.Pools(); len(pools) == 1 && pools[0].Idle == idle && pools[0].Pending == 0 {
+				return
+			}
+			time.Sleep(DRAININTERVAL)
+		}
+		t.Fatal("pools: ", service.Pools())
+	}
+	waitIdle(2)
+	if pools := service.Pools(); pools[0].MinIdle != 1 || pools[0].MaxIdle != 2 {
+		t.Fatal("pool size: ", pools)
+	}
+	demands := service.metrics.demands.With(DEFAULTTUNNEL)
+	if demands.Get() != 2 {
+		t.Fatal("prewarm demand: ", demands.Get())
+	}
+	// 取出一个连接后仍不低于低水位, 不通知
+	first := service.GetConn(TransportInfo{})
+	if nil == first {
+		t.Fatal("no tunnel conn")
+	}
+	defer finish(service, first)
+	if demands.Get() != 2 {
+		t.Fatal("demand above low water: ", demands.Get())
+	}
+	second := service.GetConn(TransportInfo{})
+	if nil == second {
+		t.Fatal("no tunnel conn")
+	}
+	defer finish(service, second)
+	// 低于心跳间隔完成补充
+	waitIdle(2)
+	if demands.Get() != 4 {
+		t.Fatal("refill demand: ", demands.Get())
+	}
+}
+
+// 测试连接池为空时排队等待: 等待超时和队列已满时返回nil, 新建的连接交给等待的请求
+func TestGetConnWait(t *testing.T) {
+	service := &TCPTunnelService{QueueSize: 1, QueueTimeout: 3 * DRAININTERVAL}
+	service.init()
+	service.SetLogger(logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT))
+	ctlConn, ctlPeer := net.Pipe()
+	defer ctlPeer.Close()
+	client := newTunnelClient("c1", "client1", ctlConn, []string{DEFAULTTUNNEL})
+	pool := newTunnelPool(DEFAULTTUNNEL, client)
+	service.clients[client.id] = client
+	service.pools[DEFAULTTUNNEL] = pool
+	start := time.Now()
+	if nil != service.GetConn(TransportInfo{}) {
+		t.Fatal("got conn from an empty pool")
+	}
+	if time.Since(start) < 3*DRAININTERVAL {
+		t.Fatal("returned before the wait timeout")
+	}
+	got := make(chan net.Conn, 1)
+	go func() {
+		got <- service.GetConn(TransportInfo{})
+	}()
+	for pool.numWaiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	start = time.Now()
+	if nil != service.GetConn(TransportInfo{}) || time.Since(start) >= DRAININTERVAL {
+		t.Fatal("wait queue is full, should return at once")
+	}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		if frame, err := ReadFrame(peer); nil == err && frame.Type == CMDTRANSPORTSTART {
+			WriteFrame(peer, CMDOK, nil)
+		}
+	}()
+	pool.add(conn)
+	select {
+	case session := <-got:
+		if nil == session {
+			t.Fatal("waiting request got no conn")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting request is not woken")
+	}
+	if waiting := service.metrics.waiting.With(DEFAULTTUNNEL).Get(); waiting != 0 || pool.numWaiting() != 0 {
+		t.Fatal("waiting: ", waiting, pool.numWaiting())
+	}
+}
+
+// 测试多个客户端注册: 每个隧道使用注册它的客户端的连接池, 隧道名称冲突时回复409, 同一个ID重新连接时替换旧的客户端
+func TestMultiClient(t *testing.T) {
+	logger := logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT)
+	service := &TCPTunnelService{ServiceAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	service.SetLogger(logger)
+	if err := service.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	defer service.Stop(context.Background())
+	// connect 启动注册指定隧道的客户端, 会话先发送客户端的标记再回显数据
+	connect := func(id, tag string, tunnels ...string) (*TCPTunnelConnector, chan error) {
+		connector := &TCPTunnelConnector{ServiceAddr: service.Addr().(*net.TCPAddr), MaxCount: 2, Tunnels: tunnels, connectorID: id}
+		connector.SetLogger(logger)
+		connector.SetTransportCallback(func(conn net.Conn, info TransportInfo, release func()) error {
+			conn.Write([]byte(tag))
+			io.Copy(conn, conn)
+			conn.(*sessionConn).CloseWrite()
+			return nil
+		})
+		errs := make(chan error, 1)
+		go func() {
+			errs <- connector.Connect(context.Background())
+		}()
+		return connector, errs
+	}
+	// waitPool 等待隧道由指定的客户端注册并且有空闲连接
+	waitPool := func(tunnel, clientID string) {
+		for i := 0; i < 50; i++ {
+			for _, pool := range service.Pools() {
+				if pool.Tunnel == tunnel && pool.ClientID == clientID && pool.Idle > 0 {
+					return
+				}
+			}
+			time.Sleep(DRAININTERVAL)
+		}
+		t.Fatal("tunnel ", tunnel, " has no idle conn of ", clientID, ": ", service.Pools())
+	}
+	// expect 从隧道取出连接, 检查由哪个客户端处理
+	expect := func(tunnel, tag string) {
+		conn := service.GetConn(TransportInfo{Tunnel: tunnel})
+		if nil == conn {
+			t.Fatal("no tunnel conn: ", tunnel)
+		}
+		defer service.RelaseConn(conn)
+		conn.Write([]byte("ping"))
+		conn.(*sessionConn).CloseWrite()
+		if data, err := io.ReadAll(conn); nil != err || string(data) != tag+"ping" {
+			t.Fatal("tunnel ", tunnel, " received ", string(data), err)
+		}
+	}
+	first, firstErrs := connect("c1", "c1", "a")
+	defer first.Stop(context.Background())
+	second, _ := connect("c2", "c2", "b")
+	defer second.Stop(context.Background())
+	waitPool("a", "c1")
+	waitPool("b", "c2")
+	expect("a", "c1")
+	expect("b", "c2")
+	// 其他客户端不能注册已有的隧道
+	conflict, conflictErrs := connect("c3", "c3", "a")
+	defer conflict.Stop(context.Background())
+	select {
+	case err := <-conflictErrs:
+		if nil == err || !strings.Contains(err.Error(), "409") {
+			t.Fatal("expected 409: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("conflicting tunnel is registered")
+	}
+	// 同一个ID重新连接, 旧的客户端被断开, 隧道交给新的连接
+	reconnect, _ := connect("c1", "c1-new", "a")
+	defer reconnect.Stop(context.Background())
+	select {
+	case err := <-firstErrs:
+		if nil == err {
+			t.Fatal("replaced client should return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaced client is still connected")
+	}
+	waitPool("a", "c1")
+	expect("a", "c1-new")
+	if clients := service.Clients(); len(clients) != 2 {
+		t.Fatal("clients: ", clients)
+	}
+	if reconnects := service.metrics.reconnects.With().Get(); reconnects != 1 {
+		t.Fatal("reconnects: ", reconnects)
+	}
+	expect("b", "c2")
+}
+
+// 测试反向转发: 已注册的客户端请求服务端按隧道名称处理连接, 未注册的客户端和其他客户端的隧道被拒绝
+func TestForward(t *testing.T) {
+	logger := logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT)
+	service := &TCPTunnelService{ServiceAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	service.SetLogger(logger)
+	// 先发送隧道名称再回显数据
+	service.SetForwardCallback(func(conn net.Conn, info TransportInfo) error {
+		conn.Write([]byte(info.Tunnel + ":"))
+		io.Copy(conn, conn)
+		return conn.(*TunnelConn).CloseWrite()
+	})
+	if err := service.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	defer service.Stop(context.Background())
+	connector := &TCPTunnelConnector{ServiceAddr: service.Addr().(*net.TCPAddr), MaxCount: 1, Tunnels: []string{"db", DEFAULTTUNNEL}}
+	connector.SetLogger(logger)
+	go connector.Connect(context.Background())
+	defer connector.Stop(context.Background())
+	second := &TCPTunnelConnector{ServiceAddr: service.Addr().(*net.TCPAddr), MaxCount: 1, Tunnels: []string{"cache"}}
+	second.SetLogger(logger)
+	go second.Connect(context.Background())
+	defer second.Stop(context.Background())
+	for i := 0; i < 50 && len(service.Clients()) < 2; i++ {
+		time.Sleep(DRAININTERVAL)
+	}
+	for _, tunnel := range []string{"db", ""} {
+		conn, err := connector.Forward(tunnel)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if len(tunnel) == 0 {
+			tunnel = DEFAULTTUNNEL
+		}
+		conn.Write([]byte("ping"))
+		conn.(*TunnelConn).CloseWrite()
+		if data, err := io.ReadAll(conn); nil != err || string(data) != tunnel+":ping" {
+			t.Fatal("forward received: ", string(data), err)
+		}
+		conn.Close()
+	}
+	// 只能请求自己注册的隧道
+	for _, tunnel := range []string{"cache", "none"} {
+		if _, err := connector.Forward(tunnel); nil == err || !strings.Contains(err.Error(), "403") {
+			t.Fatal("expected 403 for tunnel ", tunnel, ": ", err)
+		}
+	}
+	// 没有注册的客户端不能请求反向转发
+	other := &TCPTunnelConnector{ServiceAddr: service.Addr().(*net.TCPAddr)}
+	other.SetLogger(logger)
+	if _, err := other.Forward("db"); nil == err || !strings.Contains(err.Error(), "403") {
+		t.Fatal("expected 403: ", err)
+	}
+}
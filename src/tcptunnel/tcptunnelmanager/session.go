@@ -0,0 +1,211 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 正在传输的会话: 统计传输字节数, 供管理接口查看和关闭
+
+package tcptunnelmanager
+
+import (
+	"gutils/metrictool"
+	"gutils/strtool"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionConn 正在传输的隧道连接, 统计传输字节数, 第一个数据、空闲或总时长超时时关闭连接
+// 服务端由 GetConn 返回, RelaseConn 时结束; 客户端在传输回调释放时结束
+type sessionConn struct {
+	sent     int64 // 写入隧道的字节数, 原子操作, 放在开头保证64位对齐
+	received int64 // 从隧道读取的字节数
+	active   int64 // 最近一次读写数据的时间(UnixNano)
+	net.Conn
+	id         string            // 会话ID
+	clientID   string            // 隧道客户端ID
+	info       TransportInfo     // 传输信息
+	started    time.Time         // 开始时间
+	metrics    *tunnelMetrics    // 所属服务端或客户端的监控指标
+	sentBytes  *metrictool.Value // 隧道的发送字节数指标
+	recvBytes  *metrictool.Value // 隧道的接收字节数指标
+	timeouts   Timeouts          // 会话的超时时间
+	expired    atomic.Value      // 超时关闭时的错误(*TimeoutError)
+	done       chan struct{}     // 会话结束后关闭
+	finishOnce sync.Once
+}
+
+// newSessionConn 开始一个会话, 记录会话数, 有超时限制时开始检查
+func newSessionConn(conn net.Conn, clientID string, info TransportInfo, metrics *tunnelMetrics, timeouts Timeouts) *sessionConn {
+	metrics.sessions.Inc(info.Tunnel)
+	metrics.activeSessions.Add(1, info.Tunnel)
+	session := &sessionConn{
+		Conn:      conn,
+		id:        strtool.GetUUID(),
+		clientID:  clientID,
+		info:      info,
+		started:   time.Now(),
+		metrics:   metrics,
+		sentBytes: metrics.bytes.With(info.Tunnel, "sent"),
+		recvBytes: metrics.bytes.With(info.Tunnel, "received"),
+		timeouts:  timeouts,
+		done:      make(chan struct{}),
+	}
+	session.active = session.started.UnixNano()
+	if timeouts.watched() {
+		go session.watch()
+	}
+	return session
+}
+
+// watch 检查会话是否超时, 超时时关闭连接, 会话结束后退出
+func (conn *sessionConn) watch() {
+	timer := time.NewTimer(conn.check(time.Now()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case now := <-timer.C:
+			wait := conn.check(now)
+			if wait <= 0 {
+				return
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// check 检查各阶段是否超时, 超时时关闭连接并返回0, 否则返回距离下一次可能超时的时间
+func (conn *sessionConn) check(now time.Time) time.Duration {
+	wait := time.Duration(-1)
+	phase := ""
+	limit := func(name string, timeout time.Duration, since time.Time) {
+		if timeout <= 0 || len(phase) > 0 {
+			return
+		}
+		left := timeout - now.Sub(since)
+		if left <= 0 {
+			phase = name
+		} else if wait < 0 || left < wait {
+			wait = left
+		}
+	}
+	limit(PHASESESSION, conn.timeouts.Session, conn.started)
+	if atomic.LoadInt64(&conn.received) == 0 {
+		limit(PHASEFIRSTBYTE, conn.timeouts.FirstByte, conn.started)
+	}
+	limit(PHASEIDLE, conn.timeouts.Idle, time.Unix(0, atomic.LoadInt64(&conn.active)))
+	if len(phase) == 0 {
+		return wait
+	}
+	conn.expired.Store(&TimeoutError{Phase: phase})
+	conn.metrics.timeouts.Inc(conn.info.Tunnel, phase)
+	conn.Conn.Close()
+	return 0
+}
+
+// timeoutError 会话超时关闭时返回超时的错误, 否则返回err
+func (conn *sessionConn) timeoutError(err error) error {
+	if nil == err {
+		return nil
+	}
+	if expired, ok := conn.expired.Load().(*TimeoutError); ok {
+		return expired
+	}
+	return err
+}
+
+// finish 会话结束, 记录传输时长, 多次调用只记录一次
+func (conn *sessionConn) finish() {
+	conn.finishOnce.Do(func() {
+		close(conn.done)
+		conn.metrics.activeSessions.Add(-1, conn.info.Tunnel)
+		conn.metrics.exchangeDuration.Observe(time.Since(conn.started).Seconds(), conn.info.Tunnel, conn.info.Mode)
+	})
+}
+
+// Read 读取数据并计数
+func (conn *sessionConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&conn.received, int64(n))
+		atomic.StoreInt64(&conn.active, time.Now().UnixNano())
+		conn.recvBytes.Add(float64(n))
+	}
+	return n, conn.timeoutError(err)
+}
+
+// Write 写入数据并计数
+func (conn *sessionConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&conn.sent, int64(n))
+		atomic.StoreInt64(&conn.active, time.Now().UnixNano())
+		conn.sentBytes.Add(float64(n))
+	}
+	return n, conn.timeoutError(err)
+}
+
+// CloseWrite 关闭写入方向, 不支持单向关闭的连接不做处理
+func (conn *sessionConn) CloseWrite() error {
+	if cw, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// stat 会话状态
+func (conn *sessionConn) stat() SessionStat {
+	return SessionStat{
+		ID:            conn.id,
+		ClientID:      conn.clientID,
+		Tunnel:        conn.info.Tunnel,
+		Mode:          conn.info.Mode,
+		Dest:          conn.info.Dest,
+		BytesSent:     atomic.LoadInt64(&conn.sent),
+		BytesReceived: atomic.LoadInt64(&conn.received),
+		StartedAt:     conn.started,
+		Age:           time.Since(conn.started).Seconds(),
+	}
+}
+
+// ClientStat 已连接的隧道客户端
+type ClientStat struct {
+	ID          string    `json:"id"`             // 客户端ID
+	Name        string    `json:"name,omitempty"` // 认证名称
+	Addr        string    `json:"addr"`           // 控制连接的来源地址
+	Tunnels     []string  `json:"tunnels"`        // 注册的隧道
+	MuxCount    int       `json:"muxCount"`       // 多路复用连接数
+	ConnectedAt time.Time `json:"connectedAt"`    // 连接时间
+	RTT         float64   `json:"rttMs"`          // 控制连接心跳的往返时间(毫秒), 还没有收到回复时为0
+}
+
+// PoolStat 隧道连接池
+type PoolStat struct {
+	Tunnel   string `json:"tunnel"`   // 隧道名称
+	ClientID string `json:"clientId"` // 注册该隧道的客户端
+	Idle     int    `json:"idle"`     // 空闲连接数
+	Pending  int    `json:"pending"`  // 已通知客户端补充、还未到达的连接数
+	Waiting  int    `json:"waiting"`  // 正在等待空闲连接的请求数
+	MinIdle  int    `json:"minIdle"`  // 空闲连接低水位
+	MaxIdle  int    `json:"maxIdle"`  // 保持的空闲连接数, 为0时客户端自行补充
+}
+
+// SessionStat 正在传输的会话
+type SessionStat struct {
+	ID            string    `json:"id"`             // 会话ID
+	ClientID      string    `json:"clientId"`       // 隧道客户端ID
+	Tunnel        string    `json:"tunnel"`         // 隧道名称
+	Mode          string    `json:"mode,omitempty"` // 数据交换模式
+	Dest          string    `json:"dest,omitempty"` // 服务端指定的目标地址
+	BytesSent     int64     `json:"bytesSent"`      // 发送给隧道客户端的字节数
+	BytesReceived int64     `json:"bytesReceived"`  // 从隧道客户端收到的字节数
+	StartedAt     time.Time `json:"startedAt"`      // 开始时间
+	Age           float64   `json:"age"`            // 已持续的秒数
+}
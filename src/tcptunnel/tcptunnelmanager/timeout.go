@@ -0,0 +1,107 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 隧道各阶段的超时: 握手、指令回复、第一个数据、传输空闲和会话总时长
+
+package tcptunnelmanager
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// 超时的阶段, 用于错误信息和监控指标
+const (
+	// PHASEHANDSHAKE 新连接的TLS握手、认证挑战和握手指令
+	PHASEHANDSHAKE = "handshake"
+	// PHASEREPLY 等待指令回复: 开始传输、心跳、控制指令和传输结束的重置
+	PHASEREPLY = "reply"
+	// PHASEFIRSTBYTE 开始传输后等待对端的第一个数据
+	PHASEFIRSTBYTE = "first_byte"
+	// PHASEIDLE 传输中两个方向都没有数据
+	PHASEIDLE = "idle"
+	// PHASESESSION 一次传输的总时长
+	PHASESESSION = "session"
+	// PHASEHEARTBEAT 控制连接超过 HEARTTIMEOUT 没有收到对端的指令
+	PHASEHEARTBEAT = "heartbeat"
+)
+
+// Timeouts 隧道各阶段的超时时间
+// Handshake 和 Reply 为0时使用默认值, FirstByte、Idle 和 Session 为0时不限制
+type Timeouts struct {
+	Handshake time.Duration // 新连接完成握手的时间
+	Reply     time.Duration // 等待指令回复的时间
+	FirstByte time.Duration // 开始传输后等待第一个数据的时间
+	Idle      time.Duration // 传输中两个方向都没有数据的最长时间
+	Session   time.Duration // 一次传输的最长时间
+}
+
+// withDefaults 填充默认值
+func (timeouts Timeouts) withDefaults() Timeouts {
+	if timeouts.Handshake <= 0 {
+		timeouts.Handshake = DEFAULTHANDSHAKETIMEOUT
+	}
+	if timeouts.Reply <= 0 {
+		timeouts.Reply = DEFAULTREPLYTIMEOUT
+	}
+	return timeouts
+}
+
+// watched 是否需要检查会话的超时
+func (timeouts Timeouts) watched() bool {
+	return timeouts.FirstByte > 0 || timeouts.Idle > 0 || timeouts.Session > 0
+}
+
+// TimeoutError 某个阶段超时的错误
+type TimeoutError struct {
+	Phase string // 超时的阶段, 见 PHASEXXX
+	Err   error  // 原始错误, 会话超时时为空
+}
+
+// Error 错误信息
+func (err *TimeoutError) Error() string {
+	if nil == err.Err {
+		return "tunnel " + err.Phase + " timeout"
+	}
+	return "tunnel " + err.Phase + " timeout: " + err.Err.Error()
+}
+
+// Timeout 实现 net.Error
+func (err *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary 实现 net.Error
+func (err *TimeoutError) Temporary() bool {
+	return false
+}
+
+// Unwrap 原始错误
+func (err *TimeoutError) Unwrap() error {
+	return err.Err
+}
+
+// isTimeout 是否是读写超时的错误
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// phaseError 读写超时时转换为阶段超时的错误并计数, 其他错误原样返回
+func phaseError(metrics *tunnelMetrics, tunnel string, phase string, err error) error {
+	if nil == err || !isTimeout(err) {
+		return err
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return err
+	}
+	metrics.timeouts.Inc(tunnel, phase)
+	return &TimeoutError{Phase: phase, Err: err}
+}
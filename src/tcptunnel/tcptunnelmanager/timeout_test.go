@@ -0,0 +1,93 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"context"
+	"errors"
+	"gutils/logtool"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 测试会话超时: 没有收到第一个数据、传输空闲和总时长超时时关闭连接, 读写返回对应阶段的超时错误
+func TestSessionTimeout(t *testing.T) {
+	cases := []struct {
+		timeouts Timeouts
+		reply    bool // 对端先回复一次数据, 之后不再发送
+		phase    string
+	}{
+		{Timeouts{FirstByte: 50 * time.Millisecond}, false, PHASEFIRSTBYTE},
+		{Timeouts{FirstByte: 50 * time.Millisecond, Idle: 100 * time.Millisecond}, true, PHASEIDLE},
+		{Timeouts{Session: 80 * time.Millisecond}, true, PHASESESSION},
+	}
+	for _, item := range cases {
+		metrics := newTunnelMetrics()
+		local, remote := net.Pipe()
+		session := newSessionConn(local, "client", TransportInfo{Tunnel: "web"}, metrics, item.timeouts)
+		if item.reply {
+			go remote.Write([]byte("x"))
+		}
+		buf := make([]byte, 1)
+		var err error
+		for nil == err {
+			_, err = session.Read(buf)
+		}
+		var timeoutErr *TimeoutError
+		if !errors.As(err, &timeoutErr) || timeoutErr.Phase != item.phase || !isTimeout(err) {
+			t.Fatal("want ", item.phase, " timeout, got: ", err)
+		}
+		if val := metrics.timeouts.With("web", item.phase).Get(); val != 1 {
+			t.Fatal("timeout metric: ", val)
+		}
+		session.finish()
+		remote.Close()
+	}
+	// 没有超时限制时不检查, 结束后不会关闭连接
+	local, remote := net.Pipe()
+	session := newSessionConn(local, "client", TransportInfo{Tunnel: "web"}, newTunnelMetrics(), Timeouts{})
+	go remote.Write([]byte("x"))
+	if _, err := session.Read(make([]byte, 1)); nil != err {
+		t.Fatal(err)
+	}
+	session.finish()
+	local.Close()
+	remote.Close()
+}
+
+// 测试握手超时: 未认证的连接没有在握手时间内发送握手指令时被服务端关闭
+func TestHandshakeTimeout(t *testing.T) {
+	service := &TCPTunnelService{ServiceAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	service.SetLogger(logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT))
+	service.SetTimeouts(Timeouts{Handshake: 100 * time.Millisecond})
+	if err := service.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	defer service.Stop(context.Background())
+	conn, err := net.Dial("tcp4", service.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if frame, err := ReadFrame(conn); nil != err || frame.Type != CMDCHALLENGE {
+		t.Fatal("challenge error: ", err)
+	}
+	// 不发送握手指令, 服务端超时后关闭连接
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ReadFrame(conn); nil == err || isTimeout(err) {
+		t.Fatal("conn should be closed by the service: ", err)
+	}
+	time.Sleep(DRAININTERVAL)
+	if val := service.metrics.timeouts.With("", PHASEHANDSHAKE).Get(); val != 1 {
+		t.Fatal("timeout metric: ", val)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tcptunnelmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gutils/logtool"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert 测试用的证书和私钥, 同时写入PEM文件
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert 生成证书, parent 为空时生成自签名的CA证书, 否则使用 parent 签发证书
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if nil == parent {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	result := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	os.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return result
+}
+
+// startTLSService 使用TLS配置启动服务端
+func startTLSService(t *testing.T, config *tls.Config) *TCPTunnelService {
+	service := &TCPTunnelService{ServiceAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, TLSConfig: config}
+	service.SetLogger(logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT))
+	if err := service.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// connectTLS 使用TLS配置连接服务端, 返回 Connect 的结果
+func connectTLS(service *TCPTunnelService, config *tls.Config) (*TCPTunnelConnector, chan error) {
+	connector := &TCPTunnelConnector{ServiceAddr: service.Addr().(*net.TCPAddr), MaxCount: 1, TLSConfig: config}
+	connector.SetLogger(logtool.NewLogger(io.Discard, logtool.ERROR, logtool.FORMATTEXT))
+	connector.SetTransportCallback(func(conn net.Conn, info TransportInfo, release func()) error {
+		io.Copy(conn, conn)
+		conn.(*sessionConn).CloseWrite()
+		return nil
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- connector.Connect(context.Background())
+	}()
+	return connector, errs
+}
+
+// 测试双向TLS: 验证通过后隧道正常传输
+func TestTLSTunnel(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "tunnel.test", ca)
+	client := newTestCert(t, "client1", ca)
+	serverConfig, err := NewServerTLSConfig(server.certFile, server.keyFile, ca.certFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	clientConfig, err := NewClientTLSConfig(ca.certFile, client.certFile, client.keyFile, "tunnel.test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	service := startTLSService(t, serverConfig)
+	defer service.Stop(context.Background())
+	connector, _ := connectTLS(service, clientConfig)
+	defer connector.Stop(context.Background())
+	var conn net.Conn
+	for i := 0; i < 50 && nil == conn; i++ {
+		if pools := service.Pools(); len(pools) > 0 && pools[0].Idle > 0 {
+			conn = service.GetConn(TransportInfo{})
+		}
+		time.Sleep(DRAININTERVAL)
+	}
+	if nil == conn {
+		t.Fatal("no tunnel conn over TLS")
+	}
+	echo(t, conn, "ping")
+	finish(service, conn)
+}
+
+// 测试证书验证失败: 服务端拒绝没有证书或证书不受信任的客户端, 客户端拒绝证书不受信任的服务端
+func TestTLSReject(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "tunnel.test", ca)
+	other := newTestCert(t, "other-ca", nil)
+	untrusted := newTestCert(t, "client1", other)
+	serverConfig, err := NewServerTLSConfig(server.certFile, server.keyFile, ca.certFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	fakeServer := newTestCert(t, "tunnel.test", other)
+	fakeConfig, err := NewServerTLSConfig(fakeServer.certFile, fakeServer.keyFile, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	noCert, _ := NewClientTLSConfig(ca.certFile, "", "", "tunnel.test")
+	untrustedCert, _ := NewClientTLSConfig(ca.certFile, untrusted.certFile, untrusted.keyFile, "tunnel.test")
+	// 证书不是服务端要求的CA签发的, 默认不会发送, 这里强制发送
+	untrustedCert.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &untrustedCert.Certificates[0], nil
+	}
+	cases := []struct {
+		name   string
+		server *tls.Config
+		client *tls.Config
+		reason string // 客户端收到的错误
+	}{
+		{"client without cert", serverConfig, noCert, "certificate required"},
+		{"untrusted client cert", serverConfig, untrustedCert, "unknown certificate authority"},
+		{"untrusted server cert", fakeConfig, noCert, "certificate signed by unknown authority"},
+	}
+	for _, c := range cases {
+		service := startTLSService(t, c.server)
+		connector, errs := connectTLS(service, c.client)
+		select {
+		case err := <-errs:
+			if nil == err || !strings.Contains(err.Error(), c.reason) {
+				t.Fatal(c.name, ": ", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(c.name, ": connect does not fail")
+		}
+		if clients := service.Clients(); len(clients) != 0 {
+			t.Fatal(c.name, ": client registered ", clients)
+		}
+		connector.Stop(context.Background())
+		service.Stop(context.Background())
+	}
+}
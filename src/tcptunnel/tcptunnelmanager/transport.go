@@ -0,0 +1,92 @@
+// Copyright (C) 2020 WuPeng <wupeng364@outlook.com>.
+// Use of this source code is governed by an MIT-style.
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software,
+// and to permit persons to whom the Software is furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the Software.
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// 隧道协议中以JSON编码的负载: 握手信息、传输信息和补充通知
+
+package tcptunnelmanager
+
+import (
+	"encoding/json"
+)
+
+// handshake 握手信息, 客户端新建连接时随第一个指令发送
+type handshake struct {
+	ClientID string   `json:"clientId"`          // 客户端ID
+	Tunnels  []string `json:"tunnels,omitempty"` // 控制连接: 注册的隧道名称
+	MinIdle  int      `json:"minIdle,omitempty"` // 控制连接: 空闲连接低水位, 低于该数量时服务端通知补充
+	MaxIdle  int      `json:"maxIdle,omitempty"` // 控制连接: 每个隧道保持的空闲连接数, 为0时服务端不通知补充
+	Tunnel   string   `json:"tunnel,omitempty"`  // 空闲连接: 所属隧道名称
+	Name     string   `json:"name,omitempty"`    // 认证名称, 服务端据此查找密钥
+	Sign     string   `json:"sign,omitempty"`    // 认证签名, 见 signHandshake
+}
+
+// TransportInfo 传输信息, 随开始传输指令(或打开逻辑流)发送给隧道客户端
+type TransportInfo struct {
+	Tunnel  string `json:"tunnel,omitempty"`  // 隧道名称
+	Mode    string `json:"mode,omitempty"`    // 数据交换模式, 为空时由客户端决定
+	Dest    string `json:"dest,omitempty"`    // 目标地址(host:port), 为空时使用客户端为隧道配置的目标
+	Confirm bool   `json:"confirm,omitempty"` // 客户端是否需要在交换数据前回复目标连接结果, 见 SendDialResult
+}
+
+// poolDemand 补充通知, 服务端在隧道的空闲连接低于低水位时发送给客户端
+type poolDemand struct {
+	Tunnel string `json:"tunnel"` // 隧道名称
+	Count  int    `json:"count"`  // 需要新建的连接数
+}
+
+// encodeTransportInfo 编码传输信息
+func encodeTransportInfo(info TransportInfo) []byte {
+	b, err := json.Marshal(info)
+	if nil != err {
+		return nil
+	}
+	return b
+}
+
+// decodeTransportInfo 解码传输信息, 负载为空时返回空信息
+func decodeTransportInfo(payload []byte) (info TransportInfo, err error) {
+	if len(payload) == 0 {
+		return info, nil
+	}
+	err = json.Unmarshal(payload, &info)
+	return info, err
+}
+
+// encodeHandshake 编码握手信息
+func encodeHandshake(hs handshake) []byte {
+	b, err := json.Marshal(hs)
+	if nil != err {
+		return nil
+	}
+	return b
+}
+
+// decodeHandshake 解码握手信息, 负载为空时返回空信息
+func decodeHandshake(payload []byte) (hs handshake, err error) {
+	if len(payload) == 0 {
+		return hs, nil
+	}
+	err = json.Unmarshal(payload, &hs)
+	return hs, err
+}
+
+// encodePoolDemand 编码补充通知
+func encodePoolDemand(demand poolDemand) []byte {
+	b, err := json.Marshal(demand)
+	if nil != err {
+		return nil
+	}
+	return b
+}
+
+// decodePoolDemand 解码补充通知
+func decodePoolDemand(payload []byte) (demand poolDemand, err error) {
+	err = json.Unmarshal(payload, &demand)
+	return demand, err
+}